@@ -0,0 +1,72 @@
+package golapis
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodeArgsLua(t *testing.T) {
+	code := `
+		golapis.say(golapis.encode_args({ foo = 3, ["b r"] = "hello world" }))
+		golapis.say(golapis.encode_args({ a = true, b = false, c = "x&y=z" }))
+		golapis.say(golapis.encode_args({ list = { "1", 2, true, false } }))
+		golapis.say("[", golapis.encode_args({}), "]")
+		golapis.say(select(2, golapis.encode_args({ f = print })))
+		golapis.say(select(2, golapis.encode_args("str")))
+	`
+	output, err := runLuaAndCapture(t, code)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	expected := []string{
+		"b%20r=hello%20world&foo=3",
+		"a&c=x%26y%3Dz",
+		"list=1&list=2&list",
+		"[]",
+		"encode_args: attempt to use function as query arg value",
+		"encode_args: argument must be a table",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %d: %q", len(expected), len(lines), output)
+	}
+	for i, exp := range expected {
+		if lines[i] != exp {
+			t.Errorf("line %d: expected %q, got %q", i, exp, lines[i])
+		}
+	}
+}
+
+func TestDecodeArgsLua(t *testing.T) {
+	code := `
+		local args = golapis.decode_args("a=1&b=hello%20world&flag&a=2&empty=")
+		golapis.say(args.a[1], " ", args.a[2], " ", args.b, " ", tostring(args.flag), " [", args.empty, "]")
+		local limited = golapis.decode_args("a=1&b=2&c=3", 2)
+		golapis.say(limited.a, " ", limited.b, " ", tostring(limited.c))
+		local round = golapis.decode_args(golapis.encode_args({ q = "x y&z" }))
+		golapis.say(round.q)
+	`
+	output, err := runLuaAndCapture(t, code)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+	expected := "1 2 hello world true []\n1 2 nil\nx y&z\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestCRC32Lua(t *testing.T) {
+	code := `
+		golapis.say(golapis.crc32_short("hello"), " ", golapis.crc32_long("hello"), " ", golapis.crc32_short(""))
+		golapis.say(golapis.quote_sql_str("it's"))
+	`
+	output, err := runLuaAndCapture(t, code)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+	expected := "907060870 907060870 0\n'it\\'s'\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
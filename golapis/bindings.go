@@ -11,6 +11,14 @@ extern int golapis_print(lua_State *L);
 extern int golapis_say(lua_State *L);
 extern int golapis_req_get_uri_args(lua_State *L);
 extern int golapis_req_get_headers(lua_State *L);
+extern int golapis_req_get_raw_headers(lua_State *L);
+extern int golapis_req_get_method(lua_State *L);
+extern int golapis_req_http_version(lua_State *L);
+extern int golapis_req_raw_header(lua_State *L);
+extern int golapis_req_is_internal(lua_State *L);
+extern int golapis_req_socket(lua_State *L);
+extern int golapis_req_get_uploads(lua_State *L);
+extern int golapis_req_get_body_file(lua_State *L);
 extern int golapis_req_headers_index(lua_State *L);
 extern int golapis_req_read_body(lua_State *L);
 extern int golapis_req_get_body_data(lua_State *L);
@@ -19,20 +27,45 @@ extern int golapis_timer_at(lua_State *L);
 extern int golapis_debug_cancel_timers(lua_State *L);
 extern int golapis_debug_pending_timer_count(lua_State *L);
 extern int golapis_var_index(lua_State *L);
+extern int golapis_var_newindex(lua_State *L);
 extern int golapis_header_index(lua_State *L);
 extern int golapis_header_newindex(lua_State *L);
+extern int golapis_resp_get_headers(lua_State *L);
+extern int golapis_resp_add_header(lua_State *L);
 extern int golapis_now(lua_State *L);
+extern int golapis_cookie_time(lua_State *L);
+extern int golapis_http_time(lua_State *L);
+extern int golapis_parse_http_time(lua_State *L);
+extern int golapis_utctime(lua_State *L);
+extern int golapis_localtime(lua_State *L);
 extern int golapis_today(lua_State *L);
 extern int golapis_time(lua_State *L);
 extern int golapis_req_start_time(lua_State *L);
 extern int golapis_escape_uri(lua_State *L);
 extern int golapis_unescape_uri(lua_State *L);
+extern int golapis_encode_args(lua_State *L);
+extern int golapis_decode_args(lua_State *L);
+extern int golapis_quote_sql_str(lua_State *L);
+extern int golapis_crc32_short(lua_State *L);
+extern int golapis_crc32_long(lua_State *L);
 extern int golapis_status_get(lua_State *L);
 extern int golapis_status_set(lua_State *L);
 extern int golapis_md5(lua_State *L);
 extern int golapis_md5_bin(lua_State *L);
 extern int golapis_sha1_bin(lua_State *L);
 extern int golapis_hmac_sha1(lua_State *L);
+extern int golapis_crypto_sha256_bin(lua_State *L);
+extern int golapis_crypto_sha512_bin(lua_State *L);
+extern int golapis_crypto_hmac_sha256(lua_State *L);
+extern int golapis_crypto_hmac_sha512(lua_State *L);
+extern int golapis_crypto_digest(lua_State *L);
+extern int golapis_crypto_random_bytes(lua_State *L);
+extern int golapis_crypto_bytes_to_key(lua_State *L);
+extern int golapis_crypto_aes_encrypt(lua_State *L);
+extern int golapis_crypto_aes_decrypt(lua_State *L);
+extern int golapis_lock_acquire(lua_State *L);
+extern int golapis_lock_release(lua_State *L);
+extern int golapis_lock_expire(lua_State *L);
 extern int golapis_encode_base64(lua_State *L);
 extern int golapis_decode_base64(lua_State *L);
 extern int golapis_decode_base64mime(lua_State *L);
@@ -111,6 +144,38 @@ static int c_req_get_headers_wrapper(lua_State *L) {
     return golapis_req_get_headers(L);
 }
 
+static int c_req_get_raw_headers_wrapper(lua_State *L) {
+    return golapis_req_get_raw_headers(L);
+}
+
+static int c_req_get_method_wrapper(lua_State *L) {
+    return golapis_req_get_method(L);
+}
+
+static int c_req_http_version_wrapper(lua_State *L) {
+    return golapis_req_http_version(L);
+}
+
+static int c_req_raw_header_wrapper(lua_State *L) {
+    return golapis_req_raw_header(L);
+}
+
+static int c_req_is_internal_wrapper(lua_State *L) {
+    return golapis_req_is_internal(L);
+}
+
+static int c_req_socket_wrapper(lua_State *L) {
+    return golapis_req_socket(L);
+}
+
+static int c_req_get_uploads_wrapper(lua_State *L) {
+    return golapis_req_get_uploads(L);
+}
+
+static int c_req_get_body_file_wrapper(lua_State *L) {
+    return golapis_req_get_body_file(L);
+}
+
 static int c_req_headers_index_wrapper(lua_State *L) {
     return golapis_req_headers_index(L);
 }
@@ -160,6 +225,14 @@ static int c_var_index_wrapper(lua_State *L) {
     return result;
 }
 
+static int c_var_newindex_wrapper(lua_State *L) {
+    int result = golapis_var_newindex(L);
+    if (result < 0) {
+        return luaL_error(L, "%s", lua_tostring(L, -1));
+    }
+    return result;
+}
+
 static int c_header_index_wrapper(lua_State *L) {
     int result = golapis_header_index(L);
     if (result < 0) {
@@ -176,10 +249,58 @@ static int c_header_newindex_wrapper(lua_State *L) {
     return result;
 }
 
+static int c_resp_get_headers_wrapper(lua_State *L) {
+    int result = golapis_resp_get_headers(L);
+    if (result < 0) {
+        return luaL_error(L, "%s", lua_tostring(L, -1));
+    }
+    return result;
+}
+
+static int c_resp_add_header_wrapper(lua_State *L) {
+    int result = golapis_resp_add_header(L);
+    if (result < 0) {
+        return luaL_error(L, "%s", lua_tostring(L, -1));
+    }
+    return result;
+}
+
 static int c_now_wrapper(lua_State *L) {
     return golapis_now(L);
 }
 
+static int c_cookie_time_wrapper(lua_State *L) {
+    int result = golapis_cookie_time(L);
+    if (result < 0) {
+        return luaL_error(L, "%s", lua_tostring(L, -1));
+    }
+    return result;
+}
+
+static int c_http_time_wrapper(lua_State *L) {
+    int result = golapis_http_time(L);
+    if (result < 0) {
+        return luaL_error(L, "%s", lua_tostring(L, -1));
+    }
+    return result;
+}
+
+static int c_parse_http_time_wrapper(lua_State *L) {
+    int result = golapis_parse_http_time(L);
+    if (result < 0) {
+        return luaL_error(L, "%s", lua_tostring(L, -1));
+    }
+    return result;
+}
+
+static int c_utctime_wrapper(lua_State *L) {
+    return golapis_utctime(L);
+}
+
+static int c_localtime_wrapper(lua_State *L) {
+    return golapis_localtime(L);
+}
+
 static int c_today_wrapper(lua_State *L) {
     return golapis_today(L);
 }
@@ -196,6 +317,26 @@ static int c_unescape_uri_wrapper(lua_State *L) {
     return golapis_unescape_uri(L);
 }
 
+static int c_encode_args_wrapper(lua_State *L) {
+    return golapis_encode_args(L);
+}
+
+static int c_decode_args_wrapper(lua_State *L) {
+    return golapis_decode_args(L);
+}
+
+static int c_quote_sql_str_wrapper(lua_State *L) {
+    return golapis_quote_sql_str(L);
+}
+
+static int c_crc32_short_wrapper(lua_State *L) {
+    return golapis_crc32_short(L);
+}
+
+static int c_crc32_long_wrapper(lua_State *L) {
+    return golapis_crc32_long(L);
+}
+
 static int c_md5_wrapper(lua_State *L) {
     return golapis_md5(L);
 }
@@ -212,6 +353,54 @@ static int c_hmac_sha1_wrapper(lua_State *L) {
     return golapis_hmac_sha1(L);
 }
 
+static int c_crypto_sha256_bin_wrapper(lua_State *L) {
+    return golapis_crypto_sha256_bin(L);
+}
+
+static int c_crypto_sha512_bin_wrapper(lua_State *L) {
+    return golapis_crypto_sha512_bin(L);
+}
+
+static int c_crypto_hmac_sha256_wrapper(lua_State *L) {
+    return golapis_crypto_hmac_sha256(L);
+}
+
+static int c_crypto_hmac_sha512_wrapper(lua_State *L) {
+    return golapis_crypto_hmac_sha512(L);
+}
+
+static int c_crypto_digest_wrapper(lua_State *L) {
+    return golapis_crypto_digest(L);
+}
+
+static int c_crypto_random_bytes_wrapper(lua_State *L) {
+    return golapis_crypto_random_bytes(L);
+}
+
+static int c_crypto_bytes_to_key_wrapper(lua_State *L) {
+    return golapis_crypto_bytes_to_key(L);
+}
+
+static int c_crypto_aes_encrypt_wrapper(lua_State *L) {
+    return golapis_crypto_aes_encrypt(L);
+}
+
+static int c_crypto_aes_decrypt_wrapper(lua_State *L) {
+    return golapis_crypto_aes_decrypt(L);
+}
+
+static int c_lock_acquire_wrapper(lua_State *L) {
+    return golapis_lock_acquire(L);
+}
+
+static int c_lock_release_wrapper(lua_State *L) {
+    return golapis_lock_release(L);
+}
+
+static int c_lock_expire_wrapper(lua_State *L) {
+    return golapis_lock_expire(L);
+}
+
 static int c_encode_base64_wrapper(lua_State *L) {
     return golapis_encode_base64(L);
 }
@@ -557,6 +746,21 @@ static int setup_golapis_global(lua_State *L) {
     lua_pushcfunction(L, c_time_wrapper);
     lua_setfield(L, -2, "time");
 
+    lua_pushcfunction(L, c_utctime_wrapper);
+    lua_setfield(L, -2, "utctime");
+
+    lua_pushcfunction(L, c_localtime_wrapper);
+    lua_setfield(L, -2, "localtime");
+
+    lua_pushcfunction(L, c_cookie_time_wrapper);
+    lua_setfield(L, -2, "cookie_time");
+
+    lua_pushcfunction(L, c_http_time_wrapper);
+    lua_setfield(L, -2, "http_time");
+
+    lua_pushcfunction(L, c_parse_http_time_wrapper);
+    lua_setfield(L, -2, "parse_http_time");
+
     lua_pushcfunction(L, c_print_wrapper);
     lua_setfield(L, -2, "print");
 
@@ -571,6 +775,16 @@ static int setup_golapis_global(lua_State *L) {
 
     lua_pushcfunction(L, c_unescape_uri_wrapper);
     lua_setfield(L, -2, "unescape_uri");
+    lua_pushcfunction(L, c_encode_args_wrapper);
+    lua_setfield(L, -2, "encode_args");
+    lua_pushcfunction(L, c_decode_args_wrapper);
+    lua_setfield(L, -2, "decode_args");
+    lua_pushcfunction(L, c_quote_sql_str_wrapper);
+    lua_setfield(L, -2, "quote_sql_str");
+    lua_pushcfunction(L, c_crc32_short_wrapper);
+    lua_setfield(L, -2, "crc32_short");
+    lua_pushcfunction(L, c_crc32_long_wrapper);
+    lua_setfield(L, -2, "crc32_long");
 
     lua_pushcfunction(L, c_md5_wrapper);
     lua_setfield(L, -2, "md5");
@@ -649,16 +863,72 @@ static int setup_golapis_global(lua_State *L) {
     lua_setfield(L, -2, "get_uri_args");
     lua_pushcfunction(L, c_req_get_headers_wrapper);
     lua_setfield(L, -2, "get_headers");
+    lua_pushcfunction(L, c_req_get_raw_headers_wrapper);
+    lua_setfield(L, -2, "get_raw_headers");
+    lua_pushcfunction(L, c_req_get_method_wrapper);
+    lua_setfield(L, -2, "get_method");
+    lua_pushcfunction(L, c_req_http_version_wrapper);
+    lua_setfield(L, -2, "http_version");
+    lua_pushcfunction(L, c_req_raw_header_wrapper);
+    lua_setfield(L, -2, "raw_header");
+    lua_pushcfunction(L, c_req_is_internal_wrapper);
+    lua_setfield(L, -2, "is_internal");
     lua_pushcfunction(L, c_req_read_body_wrapper);
     lua_setfield(L, -2, "read_body");
     lua_pushcfunction(L, c_req_get_body_data_wrapper);
     lua_setfield(L, -2, "get_body_data");
     lua_pushcfunction(L, c_req_get_post_args_wrapper);
     lua_setfield(L, -2, "get_post_args");
+    lua_pushcfunction(L, c_req_get_uploads_wrapper);
+    lua_setfield(L, -2, "get_uploads");
+    lua_pushcfunction(L, c_req_get_body_file_wrapper);
+    lua_setfield(L, -2, "get_body_file");
     lua_pushcfunction(L, c_req_start_time_wrapper);
     lua_setfield(L, -2, "start_time");
+    lua_pushcfunction(L, c_req_socket_wrapper);
+    lua_setfield(L, -2, "socket");
     lua_setfield(L, -2, "req");         // Add req table to `golapis`
 
+    // Create resp table (for response header inspection functions)
+    lua_newtable(L);
+    lua_pushcfunction(L, c_resp_get_headers_wrapper);
+    lua_setfield(L, -2, "get_headers");
+    lua_pushcfunction(L, c_resp_add_header_wrapper);
+    lua_setfield(L, -2, "add_header");
+    lua_setfield(L, -2, "resp");        // Add resp table to `golapis`
+
+    // Create crypto table (hashes, HMAC, random bytes and AES)
+    lua_newtable(L);
+    lua_pushcfunction(L, c_crypto_sha256_bin_wrapper);
+    lua_setfield(L, -2, "sha256_bin");
+    lua_pushcfunction(L, c_crypto_sha512_bin_wrapper);
+    lua_setfield(L, -2, "sha512_bin");
+    lua_pushcfunction(L, c_crypto_hmac_sha256_wrapper);
+    lua_setfield(L, -2, "hmac_sha256");
+    lua_pushcfunction(L, c_crypto_hmac_sha512_wrapper);
+    lua_setfield(L, -2, "hmac_sha512");
+    lua_pushcfunction(L, c_crypto_digest_wrapper);
+    lua_setfield(L, -2, "digest");
+    lua_pushcfunction(L, c_crypto_random_bytes_wrapper);
+    lua_setfield(L, -2, "random_bytes");
+    lua_pushcfunction(L, c_crypto_bytes_to_key_wrapper);
+    lua_setfield(L, -2, "bytes_to_key");
+    lua_pushcfunction(L, c_crypto_aes_encrypt_wrapper);
+    lua_setfield(L, -2, "aes_encrypt");
+    lua_pushcfunction(L, c_crypto_aes_decrypt_wrapper);
+    lua_setfield(L, -2, "aes_decrypt");
+    lua_setfield(L, -2, "crypto");      // Add crypto table to `golapis`
+
+    // Create lock table (process-wide named locks, used by resty.lock)
+    lua_newtable(L);
+    lua_pushcfunction(L, c_lock_acquire_wrapper);
+    lua_setfield(L, -2, "acquire");
+    lua_pushcfunction(L, c_lock_release_wrapper);
+    lua_setfield(L, -2, "release");
+    lua_pushcfunction(L, c_lock_expire_wrapper);
+    lua_setfield(L, -2, "expire");
+    lua_setfield(L, -2, "lock");        // Add lock table to `golapis`
+
     // Create timer table
     lua_newtable(L);
     lua_pushcfunction(L, c_timer_at_wrapper);
@@ -673,11 +943,13 @@ static int setup_golapis_global(lua_State *L) {
     lua_setfield(L, -2, "pending_timer_count");
     lua_setfield(L, -2, "debug");       // Add debug table to `golapis`
 
-    // Create var proxy table with __index metatable
+    // Create var proxy table with __index and __newindex metamethods
     lua_newtable(L);                    // Create empty 'var' table
     lua_newtable(L);                    // Create metatable
     lua_pushcfunction(L, c_var_index_wrapper);
     lua_setfield(L, -2, "__index");     // metatable.__index = handler
+    lua_pushcfunction(L, c_var_newindex_wrapper);
+    lua_setfield(L, -2, "__newindex");  // metatable.__newindex = handler
     lua_setmetatable(L, -2);            // setmetatable(var, metatable)
     lua_setfield(L, -2, "var");         // golapis.var = var
 
@@ -730,6 +1002,7 @@ static int setup_golapis_global(lua_State *L) {
 import "C"
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha1"
@@ -738,6 +1011,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"math"
@@ -745,6 +1019,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -758,6 +1034,9 @@ var luaBootstrap string
 //go:embed http.lua
 var httpLua string
 
+//go:embed resty.lua
+var restyLua string
+
 // bufferPool is used to reduce allocations in golapisOutput
 var bufferPool = sync.Pool{
 	New: func() interface{} {
@@ -885,6 +1164,29 @@ func getTableFloat64Default(L *C.lua_State, idx C.int, field string, def float64
 	return def
 }
 
+// getTableStringMap extracts a table of string keys to string or number values
+func getTableStringMap(L *C.lua_State, idx C.int, field string) map[string]string {
+	cfield := C.CString(field)
+	defer C.free(unsafe.Pointer(cfield))
+	C.lua_getfield(L, idx, cfield)
+	defer C.lua_pop_wrapper(L, 1)
+
+	if C.lua_istable_wrapper(L, -1) == 0 {
+		return nil
+	}
+
+	result := make(map[string]string)
+	C.lua_pushnil(L) // first key
+	for C.lua_next_wrapper(L, -2) != 0 {
+		// Only convert string keys: lua_tostring on a number key would break lua_next
+		if C.lua_type(L, -2) == C.LUA_TSTRING && C.lua_isstring(L, -1) != 0 {
+			result[C.GoString(C.lua_tostring_wrapper(L, -2))] = string(luaStringBytes(L, -1))
+		}
+		C.lua_pop_wrapper(L, 1) // pop value, keep key for next iteration
+	}
+	return result
+}
+
 // getTableHeaders extracts a headers table to http.Header
 func getTableHeaders(L *C.lua_State, idx C.int, field string) http.Header {
 	headers := make(http.Header)
@@ -940,6 +1242,7 @@ func golapis_http_request_internal(L *C.lua_State) C.int {
 		pushGoString(L, "http._request: could not find thread context")
 		return 2
 	}
+	ctx := thread.context() // canceled if the thread is aborted
 
 	go func() {
 		var body io.Reader
@@ -947,7 +1250,7 @@ func golapis_http_request_internal(L *C.lua_State) C.int {
 			body = strings.NewReader(bodyStr)
 		}
 
-		req, err := http.NewRequest(method, url, body)
+		req, err := http.NewRequestWithContext(ctx, method, url, body)
 		if err != nil {
 			thread.state.eventChan <- &StateEvent{
 				Type:         EventResumeThread,
@@ -1063,7 +1366,32 @@ func golapis_location_capture(L *C.lua_State) C.int {
 		ProtoMinor: 1,
 	}
 
+	// Optional opts table: variable inheritance
+	var subVars *subrequestVars
+	if C.lua_gettop(L) >= 2 && C.lua_istable_wrapper(L, 2) != 0 {
+		shareAll := getTableBoolDefault(L, 2, "share_all_vars", false)
+		copyAll := getTableBoolDefault(L, 2, "copy_all_vars", false)
+		set := getTableStringMap(L, 2, "vars")
+		if shareAll || copyAll || len(set) > 0 {
+			subVars = &subrequestVars{set: set}
+			if shareAll || copyAll {
+				if thread.request.vars == nil {
+					thread.request.vars = make(map[string]*string)
+				}
+				subVars.vars = thread.request.vars
+				subVars.shared = shareAll
+			}
+		}
+	}
+	// Subrequests end with the parent thread
+	ctx := context.WithValue(thread.context(), internalRequestKey{}, true)
+	if subVars != nil {
+		ctx = context.WithValue(ctx, subrequestVarsKey{}, subVars)
+	}
+	httpReq = httpReq.WithContext(ctx)
+
 	req := NewGolapisRequest(httpReq)
+	req.internal = true
 
 	if thread.state.httpMux != nil {
 		// Route through the HTTP mux so file-server and other mux-registered
@@ -1086,6 +1414,7 @@ func golapis_location_capture(L *C.lua_State) C.int {
 		// Fallback: no mux available (CLI mode, tests without mux).
 		// Dispatch through the Lua event loop directly.
 		var buf bytes.Buffer
+		req.applySubrequestVars(subVars)
 
 		go func() {
 			resp := make(chan *StateResponse, 1)
@@ -1093,6 +1422,7 @@ func golapis_location_capture(L *C.lua_State) C.int {
 				Type:         EventRunEntryPoint,
 				OutputWriter: &buf,
 				Request:      req,
+				Context:      ctx,
 				Response:     resp,
 			}
 
@@ -1172,8 +1502,15 @@ func golapis_sleep(L *C.lua_State) C.int {
 		}
 	} else {
 		// Start async timer that will send to eventChan when done
+		aborted := thread.aborted()
 		go func() {
-			time.Sleep(time.Duration(seconds * float64(time.Second)))
+			timer := time.NewTimer(time.Duration(seconds * float64(time.Second)))
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-aborted:
+				return // the thread is aborted rather than resumed
+			}
 			thread.state.eventChan <- &StateEvent{
 				Type:         EventResumeThread,
 				Thread:       thread,
@@ -1204,9 +1541,9 @@ func golapis_exit(L *C.lua_State) C.int {
 		return -1
 	}
 
-	// Only allow in HTTP request context
-	if thread.request == nil {
-		pushGoString(L, "exit can only be called from HTTP request context")
+	// Only allow in HTTP request or stream session context
+	if thread.request == nil && thread.stream == nil {
+		pushGoString(L, "exit can only be called from HTTP request or stream context")
 		return -1
 	}
 
@@ -1217,7 +1554,7 @@ func golapis_exit(L *C.lua_State) C.int {
 	}
 
 	// Set response status if headers not sent
-	if !thread.request.HeadersSent {
+	if thread.request != nil && !thread.request.HeadersSent {
 		if status >= 100 && status <= 599 {
 			thread.request.ResponseStatus = status
 		}
@@ -1395,6 +1732,83 @@ func golapis_now(L *C.lua_State) C.int {
 	return 1
 }
 
+//export golapis_utctime
+func golapis_utctime(L *C.lua_State) C.int {
+	pushGoString(L, time.Now().UTC().Format("2006-01-02 15:04:05"))
+	return 1
+}
+
+//export golapis_localtime
+func golapis_localtime(L *C.lua_State) C.int {
+	pushGoString(L, time.Now().Format("2006-01-02 15:04:05"))
+	return 1
+}
+
+// checkTimeArg returns the single numeric seconds argument of a time formatting
+// function, or pushes an error message and returns false.
+func checkTimeArg(L *C.lua_State, name string) (time.Time, bool) {
+	if C.lua_gettop(L) != 1 {
+		pushGoString(L, fmt.Sprintf("%s: expecting one argument", name))
+		return time.Time{}, false
+	}
+	if C.lua_isnumber(L, 1) == 0 {
+		pushGoString(L, fmt.Sprintf("%s: number argument only", name))
+		return time.Time{}, false
+	}
+	return time.Unix(int64(C.lua_tonumber(L, 1)), 0).UTC(), true
+}
+
+// formatCookieTime formats t like nginx's ngx_http_cookie_time, using a two
+// digit year unless the year is past 2037.
+func formatCookieTime(t time.Time) string {
+	t = t.UTC()
+	if t.Year() > 2037 {
+		return t.Format("Mon, 02-Jan-2006 15:04:05 GMT")
+	}
+	return t.Format("Mon, 02-Jan-06 15:04:05 GMT")
+}
+
+//export golapis_cookie_time
+func golapis_cookie_time(L *C.lua_State) C.int {
+	t, ok := checkTimeArg(L, "cookie_time")
+	if !ok {
+		return -1
+	}
+	pushGoString(L, formatCookieTime(t))
+	return 1
+}
+
+//export golapis_http_time
+func golapis_http_time(L *C.lua_State) C.int {
+	t, ok := checkTimeArg(L, "http_time")
+	if !ok {
+		return -1
+	}
+	pushGoString(L, t.Format(http.TimeFormat))
+	return 1
+}
+
+//export golapis_parse_http_time
+func golapis_parse_http_time(L *C.lua_State) C.int {
+	if C.lua_gettop(L) != 1 {
+		pushGoString(L, "parse_http_time: expecting one argument")
+		return -1
+	}
+	if C.lua_isstring(L, 1) == 0 {
+		pushGoString(L, "parse_http_time: string argument only")
+		return -1
+	}
+
+	// Accepts RFC 1123, RFC 850 and ANSI C asctime formats, like nginx
+	t, err := http.ParseTime(C.GoString(C.lua_tostring_wrapper(L, 1)))
+	if err != nil {
+		C.lua_pushnil(L)
+		return 1
+	}
+	C.lua_pushnumber(L, C.lua_Number(t.Unix()))
+	return 1
+}
+
 //export golapis_today
 func golapis_today(L *C.lua_State) C.int {
 	now := time.Now()
@@ -1413,12 +1827,23 @@ func golapis_time(L *C.lua_State) C.int {
 //export golapis_req_start_time
 func golapis_req_start_time(L *C.lua_State) C.int {
 	thread := getLuaThreadFromRegistry(L)
-	if thread == nil || thread.request == nil {
+	if thread == nil {
 		C.lua_pushnil(L)
 		return 1
 	}
 
-	startTime := float64(thread.request.StartTime().UnixNano()) / 1e9
+	var start time.Time
+	switch {
+	case thread.request != nil:
+		start = thread.request.StartTime()
+	case thread.stream != nil:
+		start = thread.stream.StartTime()
+	default:
+		C.lua_pushnil(L)
+		return 1
+	}
+
+	startTime := float64(start.UnixNano()) / 1e9
 	C.lua_pushnumber(L, C.lua_Number(startTime))
 	return 1
 }
@@ -1481,6 +1906,159 @@ func golapis_unescape_uri(L *C.lua_State) C.int {
 	return 1
 }
 
+//export golapis_encode_args
+func golapis_encode_args(L *C.lua_State) C.int {
+	if C.lua_gettop(L) != 1 || C.lua_type(L, 1) != C.LUA_TTABLE {
+		C.lua_pushnil(L)
+		pushGoString(L, "encode_args: argument must be a table")
+		return 2
+	}
+
+	type encodedArg struct {
+		key   string
+		pairs []string // "key=value", or "key" for true values
+	}
+	var args []encodedArg
+
+	// argValue returns the encoded value of the arg at idx: ok is false for
+	// false (skipped), and bare is true for true (key only)
+	argValue := func(idx C.int) (value string, bare bool, ok bool, err error) {
+		switch C.lua_type(L, idx) {
+		case C.LUA_TBOOLEAN:
+			if C.lua_toboolean(L, idx) == 0 {
+				return "", false, false, nil
+			}
+			return "", true, true, nil
+		case C.LUA_TSTRING:
+			return escapeURI(string(luaStringBytes(L, idx)), 2), false, true, nil
+		case C.LUA_TNUMBER:
+			return formatLuaNumber(float64(C.lua_tonumber(L, idx))), false, true, nil
+		}
+		typeName := C.GoString(C.lua_typename(L, C.lua_type(L, idx)))
+		return "", false, false, fmt.Errorf("encode_args: attempt to use %s as query arg value", typeName)
+	}
+
+	C.lua_pushnil(L)
+	for C.lua_next_wrapper(L, 1) != 0 {
+		// Stack: key at -2, value at -1
+		var key string
+		switch C.lua_type(L, -2) {
+		case C.LUA_TSTRING:
+			key = escapeURI(string(luaStringBytes(L, -2)), 2)
+		case C.LUA_TNUMBER:
+			key = formatLuaNumber(float64(C.lua_tonumber(L, -2)))
+		default:
+			typeName := C.GoString(C.lua_typename(L, C.lua_type(L, -2)))
+			C.lua_pop_wrapper(L, 2)
+			C.lua_pushnil(L)
+			pushGoString(L, fmt.Sprintf("encode_args: attempt to use %s as query arg key", typeName))
+			return 2
+		}
+
+		arg := encodedArg{key: key}
+		var err error
+		if C.lua_type(L, -1) == C.LUA_TTABLE {
+			// Array value: one key=value pair per element
+			valueIdx := C.lua_gettop(L)
+			n := int(C.lua_objlen(L, valueIdx))
+			for i := 1; i <= n && err == nil; i++ {
+				C.lua_rawgeti_wrapper(L, valueIdx, C.int(i))
+				value, bare, ok, elemErr := argValue(-1)
+				C.lua_pop_wrapper(L, 1)
+				err = elemErr
+				if ok && bare {
+					arg.pairs = append(arg.pairs, key)
+				} else if ok {
+					arg.pairs = append(arg.pairs, key+"="+value)
+				}
+			}
+		} else {
+			value, bare, ok, valueErr := argValue(-1)
+			err = valueErr
+			if ok && bare {
+				arg.pairs = []string{key}
+			} else if ok {
+				arg.pairs = []string{key + "=" + value}
+			}
+		}
+		C.lua_pop_wrapper(L, 1) // pop value, keep key for next iteration
+
+		if err != nil {
+			C.lua_pop_wrapper(L, 1)
+			C.lua_pushnil(L)
+			pushGoString(L, err.Error())
+			return 2
+		}
+		args = append(args, arg)
+	}
+
+	// Sort by key so the output doesn't depend on table iteration order
+	sort.Slice(args, func(i, j int) bool { return args[i].key < args[j].key })
+
+	var pairs []string
+	for _, arg := range args {
+		pairs = append(pairs, arg.pairs...)
+	}
+	pushGoString(L, strings.Join(pairs, "&"))
+	return 1
+}
+
+//export golapis_decode_args
+func golapis_decode_args(L *C.lua_State) C.int {
+	nargs := int(C.lua_gettop(L))
+	if nargs < 1 || C.lua_isstring(L, 1) == 0 {
+		C.lua_pushnil(L)
+		pushGoString(L, "decode_args: first argument must be a string")
+		return 2
+	}
+
+	// 0 means unlimited
+	maxArgs := 100
+	if nargs >= 2 && C.lua_isnumber(L, 2) != 0 {
+		maxArgs = int(C.lua_tonumber(L, 2))
+	}
+
+	queryArgs, _ := parseQueryString(string(luaStringBytes(L, 1)), maxArgs)
+	pushQueryArgsToLuaTable(L, queryArgs)
+	return 1
+}
+
+//export golapis_quote_sql_str
+func golapis_quote_sql_str(L *C.lua_State) C.int {
+	if C.lua_gettop(L) != 1 || C.lua_isstring(L, 1) == 0 {
+		C.lua_pushnil(L)
+		pushGoString(L, "quote_sql_str: argument must be a string")
+		return 2
+	}
+	pushGoString(L, quoteSQLStr(string(luaStringBytes(L, 1))))
+	return 1
+}
+
+//export golapis_crc32_short
+func golapis_crc32_short(L *C.lua_State) C.int {
+	if C.lua_gettop(L) != 1 || C.lua_isstring(L, 1) == 0 {
+		C.lua_pushnil(L)
+		pushGoString(L, "crc32_short: argument must be a string")
+		return 2
+	}
+	C.lua_pushnumber(L, C.lua_Number(crc32.ChecksumIEEE(luaStringBytes(L, 1))))
+	return 1
+}
+
+// golapis_crc32_long is the same checksum as crc32_short; nginx only picks a
+// different implementation for long inputs
+//
+//export golapis_crc32_long
+func golapis_crc32_long(L *C.lua_State) C.int {
+	if C.lua_gettop(L) != 1 || C.lua_isstring(L, 1) == 0 {
+		C.lua_pushnil(L)
+		pushGoString(L, "crc32_long: argument must be a string")
+		return 2
+	}
+	C.lua_pushnumber(L, C.lua_Number(crc32.ChecksumIEEE(luaStringBytes(L, 1))))
+	return 1
+}
+
 //export golapis_md5
 func golapis_md5(L *C.lua_State) C.int {
 	if C.lua_gettop(L) != 1 {
@@ -2323,17 +2901,15 @@ func golapis_req_get_post_args(L *C.lua_State) C.int {
 		return 2
 	}
 
-	// Get the cached body
-	bodyData := thread.request.GetBody()
-	if bodyData == nil {
-		// Empty body - return empty table
-		C.lua_newtable_wrapper(L)
-		return 1
+	// Parse body as multipart/form-data (non-file fields only) or
+	// application/x-www-form-urlencoded
+	postArgs, truncated, err := thread.request.readPostArgs(maxArgs)
+	if err != nil {
+		C.lua_pushnil(L)
+		pushGoString(L, err.Error())
+		return 2
 	}
 
-	// Parse body as application/x-www-form-urlencoded
-	postArgs, truncated := parseQueryString(string(bodyData), maxArgs)
-
 	pushQueryArgsToLuaTable(L, postArgs)
 
 	// Return table and optional "truncated" error
@@ -2381,6 +2957,8 @@ func (gls *GolapisLuaState) writeOutput(text string) {
 func (gls *GolapisLuaState) SetupGolapis() {
 	gls.golapisRef = C.setup_golapis_global(gls.luaState)
 	gls.injectCoroutineModule()
+	gls.setupCJSON()
+	gls.setupLRUCache()
 	if err := gls.runBootstrap(); err != nil {
 		panic(fmt.Sprintf("failed to run bootstrap: %v", err))
 	}
@@ -2436,6 +3014,12 @@ func (gls *GolapisLuaState) runBootstrap() error {
 	defer C.free(unsafe.Pointer(chttpSrc))
 	C.lua_setfield(gls.luaState, -2, chttpSrc)
 
+	// Set _resty_src for bootstrap to register the resty.* modules
+	pushGoString(gls.luaState, restyLua)
+	crestySrc := C.CString("_resty_src")
+	defer C.free(unsafe.Pointer(crestySrc))
+	C.lua_setfield(gls.luaState, -2, crestySrc)
+
 	// Call bootstrap with 1 arg (golapis), 0 returns
 	if C.lua_pcall(gls.luaState, 1, 0, 0) != 0 {
 		errMsg := C.GoString(C.lua_tostring_wrapper(gls.luaState, -1))
@@ -2481,6 +3065,15 @@ func golapis_var_index(L *C.lua_State) C.int {
 	key := C.GoString(C.lua_tostring_wrapper(L, 2))
 
 	thread := getLuaThreadFromRegistry(L)
+	if thread != nil && thread.stream != nil {
+		value := resolveStreamVar(thread.stream, key)
+		if value == nil {
+			C.lua_pushnil(L)
+		} else {
+			pushGoString(L, *value)
+		}
+		return 1
+	}
 	if thread == nil || thread.request == nil {
 		errMsg := C.CString("golapis.var can only be used in HTTP request context")
 		defer C.free(unsafe.Pointer(errMsg))
@@ -2500,6 +3093,11 @@ func golapis_var_index(L *C.lua_State) C.int {
 // resolveVar resolves an nginx-style variable name to its value from the HTTP request.
 // Returns nil if the variable is not set or not applicable.
 func resolveVar(req *GolapisRequest, key string) *string {
+	// User-defined variables (declared in config or set from Lua/Go)
+	if value, ok := req.vars[key]; ok {
+		return value
+	}
+
 	var result string
 	httpReq := req.Request
 
@@ -2528,6 +3126,12 @@ func resolveVar(req *GolapisRequest, key string) *string {
 		}
 
 	case "server_port":
+		if addr, ok := httpReq.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			if _, port := streamAddrParts(addr); port != "" {
+				result = port
+				break
+			}
+		}
 		_, port, err := net.SplitHostPort(httpReq.Host)
 		if err != nil {
 			if httpReq.TLS != nil {
@@ -2540,8 +3144,17 @@ func resolveVar(req *GolapisRequest, key string) *string {
 		}
 
 	case "server_addr":
-		// Server address requires additional plumbing from http.Server
-		return nil
+		addr, ok := httpReq.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		if !ok {
+			return nil
+		}
+		result, _ = streamAddrParts(addr)
+
+	case "server_name":
+		result = req.serverName
+
+	case "server_protocol":
+		result = httpReq.Proto
 
 	case "remote_addr":
 		host, _, err := net.SplitHostPort(httpReq.RemoteAddr)
@@ -2551,6 +3164,91 @@ func resolveVar(req *GolapisRequest, key string) *string {
 			result = host
 		}
 
+	case "remote_port":
+		_, port, err := net.SplitHostPort(httpReq.RemoteAddr)
+		if err != nil || port == "" {
+			return nil
+		}
+		result = port
+
+	case "binary_remote_addr":
+		host, _, err := net.SplitHostPort(httpReq.RemoteAddr)
+		if err != nil {
+			host = httpReq.RemoteAddr
+		}
+		value, ok := binaryIP(host)
+		if !ok {
+			return nil
+		}
+		result = value
+
+	case "uri", "document_uri":
+		result = httpReq.URL.Path
+		if result == "" {
+			result = "/"
+		}
+
+	case "content_type":
+		if _, ok := httpReq.Header["Content-Type"]; !ok {
+			return nil
+		}
+		result = httpReq.Header.Get("Content-Type")
+
+	case "content_length":
+		if value := httpReq.Header.Get("Content-Length"); value != "" {
+			result = value
+		} else if httpReq.ContentLength > 0 {
+			result = strconv.FormatInt(httpReq.ContentLength, 10)
+		} else {
+			return nil
+		}
+
+	case "request_length":
+		result = strconv.FormatInt(estimateRequestLength(req), 10)
+
+	case "request_time":
+		result = strconv.FormatFloat(time.Since(req.StartTime()).Seconds(), 'f', 3, 64)
+
+	case "request_id":
+		result = req.RequestID()
+
+	case "status":
+		switch {
+		case req.ResponseStatus != 0:
+			result = strconv.Itoa(req.ResponseStatus)
+		case req.HeadersSent:
+			result = "200"
+		default:
+			result = "000"
+		}
+
+	case "body_bytes_sent":
+		result = strconv.FormatInt(req.bodyBytesSent(), 10)
+
+	case "bytes_sent":
+		result = strconv.FormatInt(req.headerBytesSent+req.bodyBytesSent(), 10)
+
+	case "time_local":
+		result = time.Now().Format("02/Jan/2006:15:04:05 -0700")
+
+	case "time_iso8601":
+		result = time.Now().Format("2006-01-02T15:04:05-07:00")
+
+	case "msec":
+		result = strconv.FormatFloat(float64(time.Now().UnixNano())/1e9, 'f', 3, 64)
+
+	case "connection":
+		if req.connID == 0 {
+			return nil
+		}
+		result = strconv.FormatUint(req.connID, 10)
+
+	case "connection_requests":
+		if req.connID == 0 {
+			return nil
+		}
+		result = strconv.FormatUint(req.connRequests, 10)
+
 	case "host":
 		host, _, err := net.SplitHostPort(httpReq.Host)
 		if err != nil {
@@ -2566,8 +3264,20 @@ func resolveVar(req *GolapisRequest, key string) *string {
 		result = httpReq.URL.RawQuery
 
 	default:
-		// Check for http_* pattern (header access)
-		if strings.HasPrefix(key, "http_") {
+		if strings.HasPrefix(key, "cookie_") {
+			value, ok := requestCookieValue(httpReq, key[7:])
+			if !ok {
+				return nil
+			}
+			result = value
+		} else if strings.HasPrefix(key, "arg_") {
+			value, ok := requestArgValue(httpReq.URL.RawQuery, key[4:])
+			if !ok {
+				return nil
+			}
+			result = value
+		} else if strings.HasPrefix(key, "http_") {
+			// Check for http_* pattern (header access)
 			headerName := http.CanonicalHeaderKey(strings.ReplaceAll(key[5:], "_", "-"))
 			// Go's http.Request moves Host header to req.Host, not req.Header
 			if headerName == "Host" {
@@ -2590,6 +3300,74 @@ func resolveVar(req *GolapisRequest, key string) *string {
 	return &result
 }
 
+// binaryIP returns the binary form of an IP address: 4 bytes for IPv4 and
+// 16 bytes for IPv6, like nginx's $binary_remote_addr
+func binaryIP(host string) (string, bool) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return string(ip), true
+}
+
+// estimateRequestLength approximates nginx's $request_length: the request
+// line, header block and body bytes as received
+func estimateRequestLength(req *GolapisRequest) int64 {
+	httpReq := req.Request
+	var counter byteCounter
+	fmt.Fprintf(&counter, "%s %s %s\r\n", httpReq.Method, httpReq.RequestURI, httpReq.Proto)
+	if httpReq.Host != "" {
+		fmt.Fprintf(&counter, "Host: %s\r\n", httpReq.Host)
+	}
+	httpReq.Header.Write(&counter)
+	length := int64(counter) + 2
+
+	if req.BodyWasRead() && req.bodyErr == nil {
+		if req.bodyFile != "" {
+			if info, err := os.Stat(req.bodyFile); err == nil {
+				length += info.Size()
+			}
+		} else {
+			length += int64(len(req.bodyData))
+		}
+	} else if httpReq.ContentLength > 0 {
+		length += httpReq.ContentLength
+	}
+	return length
+}
+
+// requestCookieValue returns the raw value of the first cookie named name
+// across all Cookie headers, matching the name case-insensitively like nginx's
+// $cookie_NAME. The value is not unescaped.
+func requestCookieValue(r *http.Request, name string) (string, bool) {
+	for _, header := range r.Header.Values("Cookie") {
+		for _, pair := range strings.Split(header, ";") {
+			pair = strings.TrimLeft(pair, " \t")
+			key, value, found := strings.Cut(pair, "=")
+			if found && strings.EqualFold(key, name) {
+				return value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// requestArgValue returns the raw value of the first query argument named name,
+// matching the name case-insensitively like nginx's $arg_NAME. Arguments
+// without "=" do not match, and the value is not unescaped.
+func requestArgValue(rawQuery, name string) (string, bool) {
+	for _, pair := range strings.Split(rawQuery, "&") {
+		key, value, found := strings.Cut(pair, "=")
+		if found && strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
 // normalizeHeaderName converts underscore to hyphen and canonicalizes the header name.
 // This matches ngx.header behavior where content_type becomes Content-Type.
 func normalizeHeaderName(key string) string {
@@ -2775,6 +3553,151 @@ func golapis_header_index(L *C.lua_State) C.int {
 	return 1
 }
 
+//export golapis_resp_get_headers
+func golapis_resp_get_headers(L *C.lua_State) C.int {
+	// 0 means unlimited
+	maxHeaders := 100
+	if C.lua_gettop(L) >= 1 && C.lua_isnumber(L, 1) != 0 {
+		maxHeaders = int(C.lua_tonumber(L, 1))
+	}
+
+	// raw keeps canonical header casing and skips the normalizing metatable
+	raw := false
+	if C.lua_gettop(L) >= 2 && C.lua_type(L, 2) == C.LUA_TBOOLEAN {
+		raw = C.lua_toboolean(L, 2) != 0
+	}
+
+	thread := getLuaThreadFromRegistry(L)
+	if thread == nil || thread.request == nil {
+		pushGoString(L, "golapis.resp can only be used in HTTP request context")
+		return -1
+	}
+	if thread.request.HeadersSent {
+		pushGoString(L, "attempt to read response headers after headers have been sent")
+		return -1
+	}
+
+	headers := thread.request.ResponseHeaders
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	batch := AcquireBatch()
+	defer ReleaseBatch(batch)
+	batch.TableSized(0, len(names))
+
+	count := 0
+	truncated := false
+	for _, name := range names {
+		values := headers[name]
+		if len(values) == 0 {
+			continue
+		}
+		if singleValueHeaders[name] {
+			values = values[len(values)-1:]
+		}
+		if maxHeaders > 0 {
+			remaining := maxHeaders - count
+			if remaining <= 0 {
+				truncated = true
+				break
+			}
+			if remaining < len(values) {
+				truncated = true
+				values = values[:remaining]
+			}
+		}
+
+		key := name
+		if !raw {
+			key = strings.ToLower(name)
+		}
+		batch.String(key)
+		if len(values) == 1 {
+			batch.String(values[0])
+		} else {
+			batch.TableSized(len(values), 0)
+			for i, v := range values {
+				batch.String(v).SetIndex(i + 1)
+			}
+		}
+		batch.Set()
+		count += len(values)
+	}
+	batch.Push(L)
+
+	if !raw {
+		C.setup_headers_metatable(L)
+	}
+
+	if truncated {
+		pushGoString(L, "truncated")
+		return 2
+	}
+	return 1
+}
+
+//export golapis_resp_add_header
+func golapis_resp_add_header(L *C.lua_State) C.int {
+	if C.lua_gettop(L) < 2 {
+		pushGoString(L, "expecting 2 arguments")
+		return -1
+	}
+	if C.lua_type(L, 1) != C.LUA_TSTRING {
+		pushGoString(L, "header name must be a string")
+		return -1
+	}
+	headerName := normalizeHeaderName(C.GoString(C.lua_tostring_wrapper(L, 1)))
+
+	thread := getLuaThreadFromRegistry(L)
+	if thread == nil || thread.request == nil {
+		pushGoString(L, "golapis.resp can only be used in HTTP request context")
+		return -1
+	}
+	if thread.request.HeadersSent {
+		pushGoString(L, fmt.Sprintf("attempt to set header '%s' after headers have been sent", headerName))
+		return -1
+	}
+
+	var values []string
+	switch C.lua_type(L, 2) {
+	case C.LUA_TSTRING, C.LUA_TNUMBER:
+		values = []string{string(luaStringBytes(L, 2))}
+	case C.LUA_TTABLE:
+		maxKey, err := validateArrayTable(L, 2)
+		if err != nil {
+			pushGoString(L, "header value table must be an array")
+			return -1
+		}
+		for i := 1; i <= maxKey; i++ {
+			C.lua_rawgeti_wrapper(L, 2, C.int(i))
+			if C.lua_isstring(L, -1) != 0 {
+				values = append(values, string(luaStringBytes(L, -1)))
+			}
+			C.lua_pop_wrapper(L, 1)
+		}
+	default:
+		typeName := C.GoString(C.lua_typename(L, C.lua_type(L, 2)))
+		pushGoString(L, fmt.Sprintf("header value must be a string, number, or table (got %s)", typeName))
+		return -1
+	}
+	if len(values) == 0 {
+		return 0
+	}
+
+	// Single-value headers are replaced rather than appended to
+	if singleValueHeaders[headerName] {
+		thread.request.ResponseHeaders.Set(headerName, values[len(values)-1])
+		return 0
+	}
+	for _, value := range values {
+		thread.request.ResponseHeaders.Add(headerName, value)
+	}
+	return 0
+}
+
 //export golapis_status_get
 func golapis_status_get(L *C.lua_State) C.int {
 	// Stack: [golapis_table, "status"]
@@ -30,3 +30,9 @@ do
   golapis.http.request = http_mod.request
   golapis._http_src = nil  -- Clean up after loading
 end
+
+-- Register lua-resty-string compatible modules (resty.sha256, resty.aes, ...)
+do
+  assert(loadstring(golapis._resty_src, "@resty.lua"))(golapis)
+  golapis._resty_src = nil
+end
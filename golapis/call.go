@@ -0,0 +1,177 @@
+package golapis
+
+/*
+#include "lua_helpers.h"
+*/
+import "C"
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Call calls the Lua function at name, a dotted path such as
+// "app.handle_job", with args and returns its results converted to Go (see
+// LuaArgs for the types). The first path segment is looked up as a global and
+// then in package.loaded, so functions of modules that have been required can
+// be called by module name. Arguments are converted like LuaValues.
+//
+// The function runs as a Lua thread on the event loop, so it may sleep, use
+// sockets and call async Go functions, which receive ctx. If ctx ends before
+// the function returns, the thread is aborted at its next yield point (see
+// RunStringContext) and Call returns ctx.Err().
+func (gls *GolapisLuaState) Call(ctx context.Context, name string, args ...interface{}) ([]interface{}, error) {
+	return gls.runForResults(ctx, &StateEvent{
+		Type:          EventCall,
+		FuncName:      name,
+		ResumeValues:  args,
+		Context:       ctx,
+		ReturnResults: true,
+		Response:      make(chan *StateResponse, 1),
+	})
+}
+
+// Eval runs a Lua code string like RunString and returns the values the chunk
+// returns, converted to Go. See Call for how ctx is used.
+func (gls *GolapisLuaState) Eval(ctx context.Context, code string) ([]interface{}, error) {
+	return gls.runForResults(ctx, &StateEvent{
+		Type:          EventRunString,
+		Code:          code,
+		Context:       ctx,
+		ReturnResults: true,
+		Response:      make(chan *StateResponse, 1),
+	})
+}
+
+// runForResults sends event and waits for the thread it starts to finish
+func (gls *GolapisLuaState) runForResults(ctx context.Context, event *StateEvent) ([]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	select {
+	case gls.eventChan <- event:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	resp := <-event.Response
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	if resp.Thread == nil {
+		return nil, nil
+	}
+	return resp.Thread.results, resp.Thread.resultsErr
+}
+
+// handleCall calls a Lua function by name (internal, called by event loop)
+// Returns nil if thread is still running (response will be sent later via thread.responseChan)
+func (gls *GolapisLuaState) handleCall(event *StateEvent) *StateResponse {
+	if err := gls.pushFunctionByName(event.FuncName); err != nil {
+		return &StateResponse{Error: err}
+	}
+
+	thread, err := gls.newThread()
+	if err != nil {
+		return &StateResponse{Error: err}
+	}
+
+	// Store the response channel, output writer, and request context on the thread
+	thread.responseChan = event.Response
+	thread.outputWriter = event.OutputWriter
+	thread.setRequest(event.Request)
+	thread.stream = event.StreamRequest
+	thread.setEventOptions(event)
+
+	if err := thread.resume(event.ResumeValues); err != nil {
+		thread.close()
+		return &StateResponse{Error: err}
+	}
+
+	// If thread is dead or exited, clean up and respond immediately
+	if thread.status == ThreadDead || thread.status == ThreadExited {
+		thread.close()
+		return &StateResponse{Thread: thread}
+	}
+
+	// Thread yielded - response will be sent when thread completes
+	return nil
+}
+
+// pushFunctionByName pushes the function at the dotted path name onto the
+// main stack. Nothing is pushed if an error is returned.
+func (gls *GolapisLuaState) pushFunctionByName(name string) error {
+	parts := strings.Split(name, ".")
+	for _, part := range parts {
+		if part == "" {
+			return fmt.Errorf("invalid function name %q", name)
+		}
+	}
+
+	L := gls.luaState
+	top := C.lua_gettop(L)
+
+	// Tables are read with rawget so lookups never run Lua code
+	start := 1
+	C.lua_pushvalue(L, C.LUA_GLOBALSINDEX)
+	pushGoString(L, parts[0])
+	C.lua_rawget(L, -2)
+	if C.lua_type(L, -1) == C.LUA_TNIL && len(parts) > 1 {
+		start = gls.pushLoadedModule(parts)
+	}
+
+	for i := start; i < len(parts); i++ {
+		if C.lua_type(L, -1) != C.LUA_TTABLE {
+			C.lua_settop(L, top)
+			return fmt.Errorf("cannot call %q: %q is not a table", name, strings.Join(parts[:i], "."))
+		}
+		pushGoString(L, parts[i])
+		C.lua_rawget(L, -2)
+	}
+
+	if C.lua_type(L, -1) != C.LUA_TFUNCTION {
+		C.lua_settop(L, top)
+		return fmt.Errorf("cannot call %q: not a function", name)
+	}
+	C.lua_replace(L, top+1)
+	C.lua_settop(L, top+1)
+	return nil
+}
+
+// pushLoadedModule pushes package.loaded[prefix] for the longest prefix of
+// parts (excluding the last part) naming a loaded module, returning the number
+// of parts used. Pushes nil and returns 1 if there is none.
+func (gls *GolapisLuaState) pushLoadedModule(parts []string) int {
+	L := gls.luaState
+	pushGoString(L, "_LOADED") // package.loaded
+	C.lua_rawget(L, C.LUA_REGISTRYINDEX)
+	if C.lua_type(L, -1) == C.LUA_TTABLE {
+		for n := len(parts) - 1; n >= 1; n-- {
+			pushGoString(L, strings.Join(parts[:n], "."))
+			C.lua_rawget(L, -2)
+			if C.lua_type(L, -1) != C.LUA_TNIL {
+				C.lua_remove(L, -2)
+				return n
+			}
+			C.lua_pop_wrapper(L, 1)
+		}
+	}
+	C.lua_pop_wrapper(L, 1)
+	C.lua_pushnil(L)
+	return 1
+}
+
+// saveResults converts the values returned by the entry coroutine co
+func (t *LuaThread) saveResults(co *C.lua_State) {
+	n := int(C.lua_gettop(co))
+	results := make([]interface{}, n)
+	for i := 0; i < n; i++ {
+		value, err := luaToGoValue(co, C.int(i+1), 0)
+		if err != nil {
+			t.resultsErr = fmt.Errorf("return value #%d: %v", i+1, err)
+			return
+		}
+		results[i] = value
+	}
+	t.results = results
+}
@@ -0,0 +1,112 @@
+package golapis
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newCallState(t *testing.T) *GolapisLuaState {
+	t.Helper()
+
+	gls, _ := newOptionsState(t, DefaultOptions())
+	err := gls.RunString(`
+		app = {}
+		function app.handle_job(payload, attempt)
+			golapis.sleep(0.01)
+			return { id = payload.id, tags = payload.tags }, attempt + 1, "done"
+		end
+		function app.fail()
+			error("job failed", 0)
+		end
+		package.loaded["jobs.math"] = {
+			add = function(a, b) return a + b end,
+		}
+	`)
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	return gls
+}
+
+func TestCall(t *testing.T) {
+	gls := newCallState(t)
+
+	payload := map[string]any{"id": 7, "tags": []string{"a", "b"}}
+	results, err := gls.Call(context.Background(), "app.handle_job", payload, 1)
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	expected := []interface{}{
+		map[string]any{"id": int64(7), "tags": []any{"a", "b"}},
+		int64(2),
+		"done",
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected %#v, got %#v", expected, results)
+	}
+
+	results, err = gls.Call(context.Background(), "jobs.math.add", 2, 0.5)
+	if err != nil {
+		t.Fatalf("Call module function: %v", err)
+	}
+	if !reflect.DeepEqual(results, []interface{}{2.5}) {
+		t.Errorf("expected [2.5], got %#v", results)
+	}
+
+	if _, err := gls.Call(context.Background(), "app.fail"); err == nil || !strings.Contains(err.Error(), "job failed") {
+		t.Errorf("expected Lua error, got %v", err)
+	}
+	if _, err := gls.Call(context.Background(), "app.missing"); err == nil || !strings.Contains(err.Error(), "not a function") {
+		t.Errorf("expected not a function error, got %v", err)
+	}
+	if _, err := gls.Call(context.Background(), "nope.func"); err == nil || !strings.Contains(err.Error(), `"nope" is not a table`) {
+		t.Errorf("expected not a table error, got %v", err)
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+
+	gls.RegisterAsyncFunc("wait_forever", func(ctx context.Context, args LuaArgs) (LuaValues, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	gls.Start()
+	defer gls.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := gls.Eval(ctx, `return wait_forever()`)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	gls.Wait()
+}
+
+func TestEval(t *testing.T) {
+	gls := newCallState(t)
+
+	results, err := gls.Eval(context.Background(), `return 1, nil, golapis.null, { x = true }`)
+	if err != nil {
+		t.Fatalf("Eval: %v", err)
+	}
+	expected := []interface{}{int64(1), nil, nil, map[string]any{"x": true}}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected %#v, got %#v", expected, results)
+	}
+
+	if _, err := gls.Eval(context.Background(), `return print`); err == nil || !strings.Contains(err.Error(), "return value #1") {
+		t.Errorf("expected conversion error, got %v", err)
+	}
+	if _, err := gls.Eval(context.Background(), `return (`); err == nil {
+		t.Error("expected syntax error")
+	}
+}
@@ -0,0 +1,1042 @@
+package golapis
+
+/*
+#include <string.h>
+#include "lua_helpers.h"
+
+// Per-instance cjson settings, stored in a userdata shared as upvalue 1 by
+// every function of a module instance (cjson, cjson.safe, or cjson.new())
+typedef struct {
+    int safe;                          // return nil, err instead of raising
+    int encode_empty_table_as_object;
+    int decode_array_with_array_mt;
+    int encode_number_precision;
+    int encode_max_depth;
+    int decode_max_depth;
+    int encode_escape_forward_slash;
+    int encode_invalid_numbers;        // 0 = off, 1 = on, 2 = "null"
+    int decode_invalid_numbers;
+    int encode_sparse_convert;
+    int encode_sparse_ratio;
+    int encode_sparse_safe;
+    int array_mt_ref;                  // registry refs of the shared metatables
+    int empty_array_mt_ref;
+} golapis_cjson_config;
+
+#define CJSON_OPT_ENCODE_EMPTY_TABLE_AS_OBJECT 1
+#define CJSON_OPT_DECODE_ARRAY_WITH_ARRAY_MT   2
+#define CJSON_OPT_ENCODE_NUMBER_PRECISION      3
+#define CJSON_OPT_ENCODE_MAX_DEPTH             4
+#define CJSON_OPT_DECODE_MAX_DEPTH             5
+#define CJSON_OPT_ENCODE_ESCAPE_FORWARD_SLASH  6
+#define CJSON_OPT_ENCODE_INVALID_NUMBERS       7
+#define CJSON_OPT_DECODE_INVALID_NUMBERS       8
+#define CJSON_OPT_ENCODE_SPARSE_ARRAY          9
+#define CJSON_OPT_ENCODE_KEEP_BUFFER           10
+
+extern int golapis_cjson_encode(lua_State *L, golapis_cjson_config *cfg);
+extern int golapis_cjson_decode(lua_State *L, golapis_cjson_config *cfg);
+extern int golapis_cjson_option(lua_State *L, golapis_cjson_config *cfg, int option);
+
+// Address used as the cjson.empty_array lightuserdata sentinel
+static char golapis_cjson_empty_array;
+// Registry keys for the array_mt and empty_array_mt tables shared by all instances
+static char golapis_cjson_array_mt_key;
+static char golapis_cjson_empty_array_mt_key;
+
+static int cjson_is_empty_array(lua_State *L, int idx) {
+    return lua_touserdata(L, idx) == (void *)&golapis_cjson_empty_array;
+}
+
+// cjson_shared_table_ref returns the registry reference of the table stored
+// under key, creating it on first use
+static int cjson_shared_table_ref(lua_State *L, void *key) {
+    int ref;
+    lua_pushlightuserdata(L, key);
+    lua_rawget(L, LUA_REGISTRYINDEX);
+    if (lua_isnumber(L, -1)) {
+        ref = (int)lua_tointeger(L, -1);
+        lua_pop(L, 1);
+        return ref;
+    }
+    lua_pop(L, 1);
+    lua_newtable(L);
+    ref = luaL_ref(L, LUA_REGISTRYINDEX);
+    lua_pushlightuserdata(L, key);
+    lua_pushinteger(L, ref);
+    lua_rawset(L, LUA_REGISTRYINDEX);
+    return ref;
+}
+
+static golapis_cjson_config *cjson_config(lua_State *L) {
+    return (golapis_cjson_config *)lua_touserdata(L, lua_upvalueindex(1));
+}
+
+// cjson_error raises the error message on top of the stack, or returns it as
+// nil, err for cjson.safe instances
+static int cjson_error(lua_State *L, golapis_cjson_config *cfg) {
+    if (cfg->safe) {
+        lua_pushnil(L);
+        lua_insert(L, -2);
+        return 2;
+    }
+    return luaL_error(L, "%s", lua_tostring(L, -1));
+}
+
+static int c_cjson_encode(lua_State *L) {
+    golapis_cjson_config *cfg = cjson_config(L);
+    int result = golapis_cjson_encode(L, cfg);
+    if (result < 0) {
+        return cjson_error(L, cfg);
+    }
+    return result;
+}
+
+static int c_cjson_decode(lua_State *L) {
+    golapis_cjson_config *cfg = cjson_config(L);
+    int result = golapis_cjson_decode(L, cfg);
+    if (result < 0) {
+        return cjson_error(L, cfg);
+    }
+    return result;
+}
+
+static int c_cjson_option(lua_State *L) {
+    golapis_cjson_config *cfg = cjson_config(L);
+    int option = (int)lua_tointeger(L, lua_upvalueindex(2));
+    int result = golapis_cjson_option(L, cfg, option);
+    if (result < 0) {
+        return luaL_error(L, "%s", lua_tostring(L, -1));
+    }
+    return result;
+}
+
+static void cjson_set_function(lua_State *L, int mod, int cfg, lua_CFunction fn, const char *name) {
+    lua_pushvalue(L, cfg);
+    lua_pushcclosure(L, fn, 1);
+    lua_setfield(L, mod, name);
+}
+
+static void cjson_set_option(lua_State *L, int mod, int cfg, int option, const char *name) {
+    lua_pushvalue(L, cfg);
+    lua_pushinteger(L, option);
+    lua_pushcclosure(L, c_cjson_option, 2);
+    lua_setfield(L, mod, name);
+}
+
+static int c_cjson_new(lua_State *L);
+
+// cjson_push_module pushes a new cjson module table with default settings
+static void cjson_push_module(lua_State *L, int safe) {
+    lua_newtable(L);
+    int mod = lua_gettop(L);
+
+    golapis_cjson_config *cfg = (golapis_cjson_config *)lua_newuserdata(L, sizeof(golapis_cjson_config));
+    int cfg_idx = lua_gettop(L);
+    memset(cfg, 0, sizeof(*cfg));
+    cfg->safe = safe;
+    cfg->encode_empty_table_as_object = 1;
+    cfg->encode_number_precision = 14;
+    cfg->encode_max_depth = 1000;
+    cfg->decode_max_depth = 1000;
+    cfg->encode_escape_forward_slash = 1;
+    cfg->decode_invalid_numbers = 1;
+    cfg->encode_sparse_ratio = 2;
+    cfg->encode_sparse_safe = 10;
+    cfg->array_mt_ref = cjson_shared_table_ref(L, &golapis_cjson_array_mt_key);
+    cfg->empty_array_mt_ref = cjson_shared_table_ref(L, &golapis_cjson_empty_array_mt_key);
+
+    cjson_set_function(L, mod, cfg_idx, c_cjson_encode, "encode");
+    cjson_set_function(L, mod, cfg_idx, c_cjson_decode, "decode");
+    cjson_set_function(L, mod, cfg_idx, c_cjson_new, "new");
+
+    cjson_set_option(L, mod, cfg_idx, CJSON_OPT_ENCODE_EMPTY_TABLE_AS_OBJECT, "encode_empty_table_as_object");
+    cjson_set_option(L, mod, cfg_idx, CJSON_OPT_DECODE_ARRAY_WITH_ARRAY_MT, "decode_array_with_array_mt");
+    cjson_set_option(L, mod, cfg_idx, CJSON_OPT_ENCODE_NUMBER_PRECISION, "encode_number_precision");
+    cjson_set_option(L, mod, cfg_idx, CJSON_OPT_ENCODE_MAX_DEPTH, "encode_max_depth");
+    cjson_set_option(L, mod, cfg_idx, CJSON_OPT_DECODE_MAX_DEPTH, "decode_max_depth");
+    cjson_set_option(L, mod, cfg_idx, CJSON_OPT_ENCODE_ESCAPE_FORWARD_SLASH, "encode_escape_forward_slash");
+    cjson_set_option(L, mod, cfg_idx, CJSON_OPT_ENCODE_INVALID_NUMBERS, "encode_invalid_numbers");
+    cjson_set_option(L, mod, cfg_idx, CJSON_OPT_DECODE_INVALID_NUMBERS, "decode_invalid_numbers");
+    cjson_set_option(L, mod, cfg_idx, CJSON_OPT_ENCODE_SPARSE_ARRAY, "encode_sparse_array");
+    cjson_set_option(L, mod, cfg_idx, CJSON_OPT_ENCODE_KEEP_BUFFER, "encode_keep_buffer");
+
+    lua_pushlightuserdata(L, NULL);
+    lua_setfield(L, mod, "null");
+    lua_pushlightuserdata(L, (void *)&golapis_cjson_empty_array);
+    lua_setfield(L, mod, "empty_array");
+    lua_rawgeti(L, LUA_REGISTRYINDEX, cfg->array_mt_ref);
+    lua_setfield(L, mod, "array_mt");
+    lua_rawgeti(L, LUA_REGISTRYINDEX, cfg->empty_array_mt_ref);
+    lua_setfield(L, mod, "empty_array_mt");
+    lua_pushstring(L, safe ? "cjson.safe" : "cjson");
+    lua_setfield(L, mod, "_NAME");
+    lua_pushstring(L, "2.1.0.14");
+    lua_setfield(L, mod, "_VERSION");
+
+    lua_pop(L, 1); // pop config userdata, leaving the module table
+}
+
+static int c_cjson_new(lua_State *L) {
+    cjson_push_module(L, cjson_config(L)->safe);
+    return 1;
+}
+
+static int c_cjson_loader(lua_State *L) {
+    cjson_push_module(L, 0);
+    return 1;
+}
+
+static int c_cjson_safe_loader(lua_State *L) {
+    cjson_push_module(L, 1);
+    return 1;
+}
+
+// setup_cjson_preload registers cjson and cjson.safe in package.preload
+static void setup_cjson_preload(lua_State *L) {
+    lua_getglobal(L, "package");
+    if (!lua_istable(L, -1)) {
+        lua_pop(L, 1);
+        return;
+    }
+    lua_getfield(L, -1, "preload");
+    if (!lua_istable(L, -1)) {
+        lua_pop(L, 2);
+        return;
+    }
+    lua_pushcfunction(L, c_cjson_loader);
+    lua_setfield(L, -2, "cjson");
+    lua_pushcfunction(L, c_cjson_safe_loader);
+    lua_setfield(L, -2, "cjson.safe");
+    lua_pop(L, 2);
+}
+*/
+import "C"
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// setupCJSON registers the built-in cjson and cjson.safe modules so that
+// require "cjson" works without a separately compiled C module
+func (gls *GolapisLuaState) setupCJSON() {
+	C.setup_cjson_preload(gls.luaState)
+}
+
+var cjsonBufferPool = sync.Pool{
+	New: func() interface{} { return make([]byte, 0, 256) },
+}
+
+// cjsonEncoder serializes Lua values following lua-cjson's rules
+type cjsonEncoder struct {
+	L   *C.lua_State
+	cfg *C.golapis_cjson_config
+	buf []byte
+}
+
+//export golapis_cjson_encode
+func golapis_cjson_encode(L *C.lua_State, cfg *C.golapis_cjson_config) C.int {
+	if C.lua_gettop(L) != 1 {
+		pushGoString(L, "bad argument #1 to 'encode' (expected 1 argument)")
+		return -1
+	}
+
+	enc := cjsonEncoder{L: L, cfg: cfg, buf: cjsonBufferPool.Get().([]byte)[:0]}
+	defer func() { cjsonBufferPool.Put(enc.buf) }()
+
+	if err := enc.encodeValue(1, 0); err != nil {
+		pushGoString(L, err.Error())
+		return -1
+	}
+	C.lua_pushlstring(L, (*C.char)(unsafe.Pointer(&enc.buf[0])), C.size_t(len(enc.buf)))
+	return 1
+}
+
+// encodeValue appends the JSON encoding of the value at absolute index idx
+func (e *cjsonEncoder) encodeValue(idx C.int, depth int) error {
+	L := e.L
+	switch C.lua_type(L, idx) {
+	case C.LUA_TSTRING:
+		e.appendString(luaStringBytes(L, idx))
+	case C.LUA_TNUMBER:
+		return e.appendNumber(float64(C.lua_tonumber(L, idx)))
+	case C.LUA_TBOOLEAN:
+		if C.lua_toboolean(L, idx) != 0 {
+			e.buf = append(e.buf, "true"...)
+		} else {
+			e.buf = append(e.buf, "false"...)
+		}
+	case C.LUA_TNIL:
+		e.buf = append(e.buf, "null"...)
+	case C.LUA_TLIGHTUSERDATA:
+		if C.lua_touserdata_wrapper(L, idx) == nil {
+			e.buf = append(e.buf, "null"...)
+		} else if C.cjson_is_empty_array(L, idx) != 0 {
+			e.buf = append(e.buf, "[]"...)
+		} else {
+			return fmt.Errorf("Cannot serialise userdata: type not supported")
+		}
+	case C.LUA_TTABLE:
+		return e.encodeTable(idx, depth+1)
+	default:
+		typeName := C.GoString(C.lua_typename(L, C.lua_type(L, idx)))
+		return fmt.Errorf("Cannot serialise %s: type not supported", typeName)
+	}
+	return nil
+}
+
+// encodeTable appends a table as a JSON array or object
+func (e *cjsonEncoder) encodeTable(idx C.int, depth int) error {
+	L := e.L
+	if depth > int(e.cfg.encode_max_depth) {
+		return fmt.Errorf("Cannot serialise, excessive nesting (%d)", depth)
+	}
+	// Each nesting level uses a key, a value and a metatable slot
+	if C.lua_checkstack(L, 3) == 0 {
+		return fmt.Errorf("Cannot serialise, excessive nesting (%d)", depth)
+	}
+
+	length, err := e.arrayLength(idx)
+	if err != nil {
+		return err
+	}
+	if length > 0 {
+		return e.encodeArray(idx, length, depth)
+	}
+	if length == 0 {
+		if e.cfg.encode_empty_table_as_object != 0 {
+			e.buf = append(e.buf, "{}"...)
+		} else {
+			e.buf = append(e.buf, "[]"...)
+		}
+		return nil
+	}
+	if length == -2 {
+		e.buf = append(e.buf, "[]"...)
+		return nil
+	}
+	return e.encodeObject(idx, depth)
+}
+
+// arrayLength returns the array length of the table at idx, -1 if it should
+// be encoded as an object, or -2 for an empty table marked as an array with
+// array_mt or empty_array_mt. Like lua-cjson, empty_array_mt only affects
+// empty tables; other tables with it are encoded normally.
+func (e *cjsonEncoder) arrayLength(idx C.int) (int, error) {
+	L := e.L
+	if C.lua_getmetatable(L, idx) != 0 {
+		arrayMT := e.isRegistryRef(e.cfg.array_mt_ref)
+		emptyArrayMT := e.isRegistryRef(e.cfg.empty_array_mt_ref)
+		C.lua_pop_wrapper(L, 1) // pop metatable
+		if arrayMT {
+			if n := int(C.lua_objlen(L, idx)); n > 0 {
+				return n, nil
+			}
+			return -2, nil
+		}
+		if emptyArrayMT {
+			C.lua_pushnil(L)
+			if C.lua_next_wrapper(L, idx) == 0 {
+				return -2, nil
+			}
+			C.lua_pop_wrapper(L, 2) // pop key and value
+		}
+	}
+
+	maxKey, items := 0, 0
+	C.lua_pushnil(L)
+	for C.lua_next_wrapper(L, idx) != 0 {
+		// Stack: key at -2, value at -1
+		if C.lua_type(L, -2) == C.LUA_TNUMBER {
+			k := float64(C.lua_tonumber(L, -2))
+			if k >= 1 && k == math.Floor(k) {
+				if int(k) > maxKey {
+					maxKey = int(k)
+				}
+				items++
+				C.lua_pop_wrapper(L, 1)
+				continue
+			}
+		}
+		C.lua_pop_wrapper(L, 2) // not an array: pop key and value
+		return -1, nil
+	}
+
+	ratio, safe := int(e.cfg.encode_sparse_ratio), int(e.cfg.encode_sparse_safe)
+	if ratio > 0 && maxKey > items*ratio && maxKey > safe {
+		if e.cfg.encode_sparse_convert != 0 {
+			return -1, nil
+		}
+		return 0, fmt.Errorf("Cannot serialise table: excessively sparse array")
+	}
+	return maxKey, nil
+}
+
+// isRegistryRef reports whether the value on top of the stack is the registry
+// value ref
+func (e *cjsonEncoder) isRegistryRef(ref C.int) bool {
+	C.lua_rawgeti_wrapper(e.L, C.LUA_REGISTRYINDEX, ref)
+	equal := C.lua_rawequal(e.L, -1, -2) != 0
+	C.lua_pop_wrapper(e.L, 1)
+	return equal
+}
+
+func (e *cjsonEncoder) encodeArray(idx C.int, length int, depth int) error {
+	L := e.L
+	e.buf = append(e.buf, '[')
+	for i := 1; i <= length; i++ {
+		if i > 1 {
+			e.buf = append(e.buf, ',')
+		}
+		C.lua_rawgeti_wrapper(L, idx, C.int(i))
+		err := e.encodeValue(C.lua_gettop(L), depth)
+		C.lua_pop_wrapper(L, 1)
+		if err != nil {
+			return err
+		}
+	}
+	e.buf = append(e.buf, ']')
+	return nil
+}
+
+func (e *cjsonEncoder) encodeObject(idx C.int, depth int) error {
+	L := e.L
+	e.buf = append(e.buf, '{')
+	first := true
+	C.lua_pushnil(L)
+	for C.lua_next_wrapper(L, idx) != 0 {
+		// Stack: key at -2, value at -1
+		if !first {
+			e.buf = append(e.buf, ',')
+		}
+		first = false
+
+		keyIdx := C.lua_gettop(L) - 1
+		switch C.lua_type(L, keyIdx) {
+		case C.LUA_TSTRING:
+			e.appendString(luaStringBytes(L, keyIdx))
+		case C.LUA_TNUMBER:
+			e.buf = append(e.buf, '"')
+			if err := e.appendNumber(float64(C.lua_tonumber(L, keyIdx))); err != nil {
+				C.lua_pop_wrapper(L, 2)
+				return err
+			}
+			e.buf = append(e.buf, '"')
+		default:
+			typeName := C.GoString(C.lua_typename(L, C.lua_type(L, keyIdx)))
+			C.lua_pop_wrapper(L, 2)
+			return fmt.Errorf("Cannot serialise %s: table key must be a number or string", typeName)
+		}
+		e.buf = append(e.buf, ':')
+
+		if err := e.encodeValue(keyIdx+1, depth); err != nil {
+			C.lua_pop_wrapper(L, 2)
+			return err
+		}
+		C.lua_pop_wrapper(L, 1) // pop value, keep key for next iteration
+	}
+	e.buf = append(e.buf, '}')
+	return nil
+}
+
+func (e *cjsonEncoder) appendNumber(n float64) error {
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		switch e.cfg.encode_invalid_numbers {
+		case 0:
+			return fmt.Errorf("Cannot serialise number: must not be NaN or Infinity")
+		case 2:
+			e.buf = append(e.buf, "null"...)
+			return nil
+		}
+		// Javascript compatible spellings, like lua-cjson
+		switch {
+		case math.IsNaN(n):
+			e.buf = append(e.buf, "NaN"...)
+		case n > 0:
+			e.buf = append(e.buf, "Infinity"...)
+		default:
+			e.buf = append(e.buf, "-Infinity"...)
+		}
+		return nil
+	}
+	e.buf = strconv.AppendFloat(e.buf, n, 'g', int(e.cfg.encode_number_precision), 64)
+	return nil
+}
+
+const cjsonHexDigits = "0123456789abcdef"
+
+func (e *cjsonEncoder) appendString(s []byte) {
+	e.buf = append(e.buf, '"')
+	for _, c := range s {
+		switch {
+		case c == '"':
+			e.buf = append(e.buf, '\\', '"')
+		case c == '\\':
+			e.buf = append(e.buf, '\\', '\\')
+		case c == '/' && e.cfg.encode_escape_forward_slash != 0:
+			e.buf = append(e.buf, '\\', '/')
+		case c == '\b':
+			e.buf = append(e.buf, '\\', 'b')
+		case c == '\f':
+			e.buf = append(e.buf, '\\', 'f')
+		case c == '\n':
+			e.buf = append(e.buf, '\\', 'n')
+		case c == '\r':
+			e.buf = append(e.buf, '\\', 'r')
+		case c == '\t':
+			e.buf = append(e.buf, '\\', 't')
+		case c < 0x20 || c == 0x7f:
+			e.buf = append(e.buf, '\\', 'u', '0', '0', cjsonHexDigits[c>>4], cjsonHexDigits[c&0xf])
+		default:
+			e.buf = append(e.buf, c)
+		}
+	}
+	e.buf = append(e.buf, '"')
+}
+
+// cjsonDecoder parses JSON into LuaBatch instructions following lua-cjson's rules
+type cjsonDecoder struct {
+	data     []byte
+	pos      int
+	cfg      *C.golapis_cjson_config
+	batch    *LuaBatch
+	depth    int
+	maxDepth int // deepest nesting reached, for sizing the Lua stack
+}
+
+//export golapis_cjson_decode
+func golapis_cjson_decode(L *C.lua_State, cfg *C.golapis_cjson_config) C.int {
+	if C.lua_gettop(L) != 1 {
+		pushGoString(L, "bad argument #1 to 'decode' (expected 1 argument)")
+		return -1
+	}
+	if C.lua_isstring(L, 1) == 0 {
+		typeName := C.GoString(C.lua_typename(L, C.lua_type(L, 1)))
+		pushGoString(L, fmt.Sprintf("bad argument #1 to 'decode' (string expected, got %s)", typeName))
+		return -1
+	}
+
+	batch := AcquireBatch()
+	defer ReleaseBatch(batch)
+
+	dec := cjsonDecoder{data: luaStringBytes(L, 1), cfg: cfg, batch: batch}
+	if err := dec.decode(); err != nil {
+		pushGoString(L, err.Error())
+		return -1
+	}
+	// Each open table holds a key and a value above it while being filled
+	if C.lua_checkstack(L, C.int(dec.maxDepth*2+2)) == 0 {
+		pushGoString(L, fmt.Sprintf("Found too many nested data structures (%d) at character 1", dec.maxDepth))
+		return -1
+	}
+	batch.Push(L)
+	return 1
+}
+
+func (d *cjsonDecoder) decode() error {
+	d.skipWhitespace()
+	if err := d.value(); err != nil {
+		return err
+	}
+	d.skipWhitespace()
+	if d.pos < len(d.data) {
+		return d.expected("the end")
+	}
+	return nil
+}
+
+func (d *cjsonDecoder) skipWhitespace() {
+	for d.pos < len(d.data) {
+		switch d.data[d.pos] {
+		case ' ', '\t', '\n', '\r':
+			d.pos++
+		default:
+			return
+		}
+	}
+}
+
+// tokenName names the token at the current position the way lua-cjson does
+func (d *cjsonDecoder) tokenName() string {
+	if d.pos >= len(d.data) {
+		return "T_END"
+	}
+	switch c := d.data[d.pos]; {
+	case c == '{':
+		return "T_OBJ_BEGIN"
+	case c == '}':
+		return "T_OBJ_END"
+	case c == '[':
+		return "T_ARR_BEGIN"
+	case c == ']':
+		return "T_ARR_END"
+	case c == '"':
+		return "T_STRING"
+	case c == ':':
+		return "T_COLON"
+	case c == ',':
+		return "T_COMMA"
+	case c == '-' || (c >= '0' && c <= '9'):
+		return "T_NUMBER"
+	case d.hasLiteral("true") || d.hasLiteral("false"):
+		return "T_BOOLEAN"
+	case d.hasLiteral("null"):
+		return "T_NULL"
+	}
+	return "invalid token"
+}
+
+func (d *cjsonDecoder) expected(what string) error {
+	return d.expectedFound(what, d.tokenName())
+}
+
+func (d *cjsonDecoder) expectedFound(what, found string) error {
+	return fmt.Errorf("Expected %s but found %s at character %d", what, found, d.pos+1)
+}
+
+func (d *cjsonDecoder) hasLiteral(lit string) bool {
+	return len(d.data)-d.pos >= len(lit) && string(d.data[d.pos:d.pos+len(lit)]) == lit
+}
+
+// value parses one JSON value, appending instructions that push it
+func (d *cjsonDecoder) value() error {
+	if d.pos >= len(d.data) {
+		return d.expected("value")
+	}
+
+	switch c := d.data[d.pos]; {
+	case c == '{':
+		return d.object()
+	case c == '[':
+		return d.array()
+	case c == '"':
+		s, err := d.string()
+		if err != nil {
+			return err
+		}
+		d.batch.String(s)
+		return nil
+	case d.hasLiteral("true"):
+		d.pos += 4
+		d.batch.Bool(true)
+		return nil
+	case d.hasLiteral("false"):
+		d.pos += 5
+		d.batch.Bool(false)
+		return nil
+	case d.hasLiteral("null"):
+		d.pos += 4
+		d.batch.Null()
+		return nil
+	case c == '-' || c == '+' || c == '.' || (c >= '0' && c <= '9') ||
+		c == 'i' || c == 'I' || c == 'n' || c == 'N':
+		return d.number()
+	}
+	return d.expected("value")
+}
+
+func (d *cjsonDecoder) descend() error {
+	d.depth++
+	if d.depth > int(d.cfg.decode_max_depth) {
+		return fmt.Errorf("Found too many nested data structures (%d) at character %d", d.depth, d.pos+1)
+	}
+	if d.depth > d.maxDepth {
+		d.maxDepth = d.depth
+	}
+	return nil
+}
+
+func (d *cjsonDecoder) object() error {
+	if err := d.descend(); err != nil {
+		return err
+	}
+	d.pos++ // '{'
+	d.batch.Table()
+
+	d.skipWhitespace()
+	if d.pos < len(d.data) && d.data[d.pos] == '}' {
+		d.pos++
+		d.depth--
+		return nil
+	}
+
+	for {
+		d.skipWhitespace()
+		if d.pos >= len(d.data) || d.data[d.pos] != '"' {
+			return d.expected("object key string")
+		}
+		key, err := d.string()
+		if err != nil {
+			return err
+		}
+		d.batch.String(key)
+
+		d.skipWhitespace()
+		if d.pos >= len(d.data) || d.data[d.pos] != ':' {
+			return d.expected("colon")
+		}
+		d.pos++
+
+		d.skipWhitespace()
+		if err := d.value(); err != nil {
+			return err
+		}
+		d.batch.Set()
+
+		d.skipWhitespace()
+		if d.pos < len(d.data) {
+			switch d.data[d.pos] {
+			case ',':
+				d.pos++
+				continue
+			case '}':
+				d.pos++
+				d.depth--
+				return nil
+			}
+		}
+		return d.expected("comma or object end")
+	}
+}
+
+func (d *cjsonDecoder) array() error {
+	if err := d.descend(); err != nil {
+		return err
+	}
+	d.pos++ // '['
+	d.batch.Table()
+	if d.cfg.decode_array_with_array_mt != 0 {
+		d.batch.SetMetatableRef(int(d.cfg.array_mt_ref))
+	}
+
+	d.skipWhitespace()
+	if d.pos < len(d.data) && d.data[d.pos] == ']' {
+		d.pos++
+		d.depth--
+		return nil
+	}
+
+	for i := 1; ; i++ {
+		d.skipWhitespace()
+		if err := d.value(); err != nil {
+			return err
+		}
+		d.batch.SetIndex(i)
+
+		d.skipWhitespace()
+		if d.pos < len(d.data) {
+			switch d.data[d.pos] {
+			case ',':
+				d.pos++
+				continue
+			case ']':
+				d.pos++
+				d.depth--
+				return nil
+			}
+		}
+		return d.expected("comma or array end")
+	}
+}
+
+// string parses a JSON string starting at the opening quote
+func (d *cjsonDecoder) string() (string, error) {
+	start := d.pos
+	d.pos++ // opening quote
+
+	// Fast path: no escapes
+	for i := d.pos; i < len(d.data); i++ {
+		if d.data[i] == '"' {
+			s := string(d.data[d.pos:i])
+			d.pos = i + 1
+			return s, nil
+		}
+		if d.data[i] == '\\' {
+			break
+		}
+	}
+
+	var out []byte
+	for d.pos < len(d.data) {
+		c := d.data[d.pos]
+		if c == '"' {
+			d.pos++
+			return string(out), nil
+		}
+		if c != '\\' {
+			out = append(out, c)
+			d.pos++
+			continue
+		}
+
+		if d.pos+1 >= len(d.data) {
+			break
+		}
+		switch esc := d.data[d.pos+1]; esc {
+		case '"', '\\', '/':
+			out = append(out, esc)
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'u':
+			r, n := d.unicodeEscape(d.pos)
+			if n == 0 {
+				pos := d.pos
+				d.pos = start
+				return "", fmt.Errorf("Expected value but found invalid unicode escape code at character %d", pos+1)
+			}
+			out = utf8.AppendRune(out, r)
+			d.pos += n
+			continue
+		default:
+			d.pos = start
+			return "", d.expectedFound("value", "invalid escape code")
+		}
+		d.pos += 2
+	}
+
+	d.pos = start
+	return "", d.expectedFound("value", "unexpected end of string")
+}
+
+// unicodeEscape decodes a \uXXXX escape (or surrogate pair) at pos, returning
+// the rune and the number of bytes consumed, or 0 if it is invalid
+func (d *cjsonDecoder) unicodeEscape(pos int) (rune, int) {
+	hex := func(at int) (rune, bool) {
+		if at+6 > len(d.data) || d.data[at] != '\\' || d.data[at+1] != 'u' {
+			return 0, false
+		}
+		v, err := strconv.ParseUint(string(d.data[at+2:at+6]), 16, 16)
+		return rune(v), err == nil
+	}
+
+	r, ok := hex(pos)
+	if !ok {
+		return 0, 0
+	}
+	if utf16.IsSurrogate(r) {
+		if r >= 0xdc00 {
+			return 0, 0 // lone low surrogate
+		}
+		low, ok := hex(pos + 6)
+		if !ok || low < 0xdc00 || low > 0xdfff {
+			return 0, 0
+		}
+		return utf16.DecodeRune(r, low), 12
+	}
+	return r, 6
+}
+
+// number parses a number token. With decode_invalid_numbers (the default),
+// hexadecimal numbers, a leading '+', and inf/nan are accepted like strtod does.
+func (d *cjsonDecoder) number() error {
+	end := d.pos
+	for end < len(d.data) {
+		c := d.data[end]
+		if (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			c == '-' || c == '+' || c == '.' {
+			end++
+			continue
+		}
+		break
+	}
+	token := string(d.data[d.pos:end])
+
+	value, strict, ok := parseCJSONNumber(token)
+	if !ok || (!strict && d.cfg.decode_invalid_numbers == 0) {
+		return d.expectedFound("value", "invalid number")
+	}
+	d.pos = end
+	d.batch.Number(value)
+	return nil
+}
+
+// parseCJSONNumber parses a number token, reporting whether it is valid JSON
+// (strict) or only accepted as an extension
+func parseCJSONNumber(token string) (value float64, strict bool, ok bool) {
+	if isStrictJSONNumber(token) {
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil && !math.IsInf(value, 0) {
+			return 0, false, false
+		}
+		return value, true, true
+	}
+
+	body := token
+	if len(body) > 0 && (body[0] == '-' || body[0] == '+') {
+		body = body[1:]
+	}
+	if len(body) > 2 && body[0] == '0' && (body[1] == 'x' || body[1] == 'X') {
+		v, err := strconv.ParseUint(body[2:], 16, 64)
+		if err != nil {
+			return 0, false, false
+		}
+		if token[0] == '-' {
+			return -float64(v), false, true
+		}
+		return float64(v), false, true
+	}
+
+	value, err := strconv.ParseFloat(token, 64)
+	if err != nil && !math.IsInf(value, 0) {
+		return 0, false, false
+	}
+	return value, false, true
+}
+
+// isStrictJSONNumber reports whether s matches the JSON number grammar
+func isStrictJSONNumber(s string) bool {
+	i := 0
+	if i < len(s) && s[i] == '-' {
+		i++
+	}
+	if i >= len(s) {
+		return false
+	}
+	if s[i] == '0' {
+		i++
+	} else if s[i] >= '1' && s[i] <= '9' {
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+	} else {
+		return false
+	}
+	if i < len(s) && s[i] == '.' {
+		i++
+		start := i
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		if i == start {
+			return false
+		}
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		start := i
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		if i == start {
+			return false
+		}
+	}
+	return i == len(s)
+}
+
+//export golapis_cjson_option
+func golapis_cjson_option(L *C.lua_State, cfg *C.golapis_cjson_config, option C.int) C.int {
+	switch option {
+	case C.CJSON_OPT_ENCODE_EMPTY_TABLE_AS_OBJECT:
+		return cjsonBoolOption(L, &cfg.encode_empty_table_as_object, "encode_empty_table_as_object")
+	case C.CJSON_OPT_DECODE_ARRAY_WITH_ARRAY_MT:
+		return cjsonBoolOption(L, &cfg.decode_array_with_array_mt, "decode_array_with_array_mt")
+	case C.CJSON_OPT_ENCODE_ESCAPE_FORWARD_SLASH:
+		return cjsonBoolOption(L, &cfg.encode_escape_forward_slash, "encode_escape_forward_slash")
+	case C.CJSON_OPT_DECODE_INVALID_NUMBERS:
+		return cjsonBoolOption(L, &cfg.decode_invalid_numbers, "decode_invalid_numbers")
+	case C.CJSON_OPT_ENCODE_KEEP_BUFFER:
+		// Buffers are always pooled; accepted for compatibility
+		var keep C.int = 1
+		return cjsonBoolOption(L, &keep, "encode_keep_buffer")
+	case C.CJSON_OPT_ENCODE_NUMBER_PRECISION:
+		return cjsonIntOption(L, 1, &cfg.encode_number_precision, 1, 16, "encode_number_precision")
+	case C.CJSON_OPT_ENCODE_MAX_DEPTH:
+		return cjsonIntOption(L, 1, &cfg.encode_max_depth, 1, math.MaxInt32, "encode_max_depth")
+	case C.CJSON_OPT_DECODE_MAX_DEPTH:
+		return cjsonIntOption(L, 1, &cfg.decode_max_depth, 1, math.MaxInt32, "decode_max_depth")
+	case C.CJSON_OPT_ENCODE_INVALID_NUMBERS:
+		if C.lua_type(L, 1) == C.LUA_TSTRING && C.GoString(C.lua_tostring_wrapper(L, 1)) == "null" {
+			cfg.encode_invalid_numbers = 2
+		} else if ret := cjsonBoolOption(L, &cfg.encode_invalid_numbers, "encode_invalid_numbers"); ret < 0 {
+			return ret
+		} else {
+			C.lua_pop_wrapper(L, 1)
+		}
+		if cfg.encode_invalid_numbers == 2 {
+			pushGoString(L, "null")
+		} else {
+			C.lua_pushboolean(L, cfg.encode_invalid_numbers)
+		}
+		return 1
+	case C.CJSON_OPT_ENCODE_SPARSE_ARRAY:
+		if ret := cjsonBoolOption(L, &cfg.encode_sparse_convert, "encode_sparse_array"); ret < 0 {
+			return ret
+		}
+		C.lua_pop_wrapper(L, 1)
+		if ret := cjsonIntOption(L, 2, &cfg.encode_sparse_ratio, 0, math.MaxInt32, "encode_sparse_array"); ret < 0 {
+			return ret
+		}
+		C.lua_pop_wrapper(L, 1)
+		if ret := cjsonIntOption(L, 3, &cfg.encode_sparse_safe, 0, math.MaxInt32, "encode_sparse_array"); ret < 0 {
+			return ret
+		}
+		C.lua_pop_wrapper(L, 1)
+		C.lua_pushboolean(L, cfg.encode_sparse_convert)
+		C.lua_pushinteger(L, C.lua_Integer(cfg.encode_sparse_ratio))
+		C.lua_pushinteger(L, C.lua_Integer(cfg.encode_sparse_safe))
+		return 3
+	}
+	pushGoString(L, "unknown cjson option")
+	return -1
+}
+
+// cjsonBoolOption updates a boolean setting from argument 1 (a boolean, "on"
+// or "off") if given, and pushes the current value
+func cjsonBoolOption(L *C.lua_State, setting *C.int, name string) C.int {
+	switch C.lua_type(L, 1) {
+	case C.LUA_TNONE, C.LUA_TNIL:
+	case C.LUA_TBOOLEAN:
+		*setting = C.lua_toboolean(L, 1)
+	case C.LUA_TSTRING:
+		switch value := C.GoString(C.lua_tostring_wrapper(L, 1)); value {
+		case "on":
+			*setting = 1
+		case "off":
+			*setting = 0
+		default:
+			pushGoString(L, fmt.Sprintf("bad argument #1 to '%s' (invalid option '%s')", name, value))
+			return -1
+		}
+	default:
+		typeName := C.GoString(C.lua_typename(L, C.lua_type(L, 1)))
+		pushGoString(L, fmt.Sprintf("bad argument #1 to '%s' (boolean expected, got %s)", name, typeName))
+		return -1
+	}
+	if *setting != 0 {
+		*setting = 1
+	}
+	C.lua_pushboolean(L, *setting)
+	return 1
+}
+
+// cjsonIntOption updates an integer setting from argument arg if given, and
+// pushes the current value
+func cjsonIntOption(L *C.lua_State, arg C.int, setting *C.int, min, max int, name string) C.int {
+	if t := C.lua_type(L, arg); t != C.LUA_TNONE && t != C.LUA_TNIL {
+		value := float64(C.lua_tonumber(L, arg))
+		if C.lua_isnumber(L, arg) == 0 || value != math.Floor(value) || value < float64(min) || value > float64(max) {
+			pushGoString(L, fmt.Sprintf("bad argument #%d to '%s' (expected integer between %d and %d)", arg, name, min, max))
+			return -1
+		}
+		*setting = C.int(value)
+	}
+	C.lua_pushinteger(L, C.lua_Integer(*setting))
+	return 1
+}
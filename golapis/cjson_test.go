@@ -0,0 +1,203 @@
+package golapis
+
+import (
+	"strings"
+	"testing"
+)
+
+func runCJSON(t *testing.T, code string) string {
+	t.Helper()
+	w, _, err := runLuaWithHTTP(t, code)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+	return w.Body.String()
+}
+
+func TestCJSONEncode(t *testing.T) {
+	body := runCJSON(t, `
+		local cjson = require "cjson"
+		golapis.say(cjson.encode({ 1, 2, "three", true, false }))
+		golapis.say(cjson.encode({ name = "leafo" }))
+		golapis.say(cjson.encode({ nested = { list = { 1.5, { a = cjson.null } } } }))
+		golapis.say(cjson.encode("quote\" slash/ back\\ tab\t nl\n \1 \127"))
+		golapis.say(cjson.encode({}))
+		golapis.say(cjson.encode({ [1] = "a", [2] = "b", [4] = "d" }))
+		golapis.say(cjson.encode(cjson.null), " ", cjson.encode(golapis.null), " ", cjson.encode(nil))
+		golapis.say(cjson.encode(0.1), " ", cjson.encode(-5), " ", cjson.encode(1e20), " ", cjson.encode(1/3))
+	`)
+
+	expected := strings.Join([]string{
+		`[1,2,"three",true,false]`,
+		`{"name":"leafo"}`,
+		`{"nested":{"list":[1.5,{"a":null}]}}`,
+		`"quote\" slash\/ back\\ tab\t nl\n \u0001 \u007f"`,
+		`{}`,
+		`["a","b",null,"d"]`,
+		`null null null`,
+		`0.1 -5 1e+20 0.33333333333333`,
+	}, "\n") + "\n"
+	if body != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, body)
+	}
+}
+
+func TestCJSONDecode(t *testing.T) {
+	body := runCJSON(t, `
+		local cjson = require "cjson"
+		local obj = cjson.decode('{"a": [1, 2.5, "x\\u00e9\\ud83d\\ude00", null], "b": {"c": false}, "d": "\\"\\/\\n"}')
+		golapis.say(obj.a[1], " ", obj.a[2], " ", obj.a[3], " ", obj.a[4] == cjson.null, " ", #obj.a)
+		golapis.say(tostring(obj.b.c), " ", obj.d == '"/\n')
+		golapis.say(cjson.decode("12"), " ", cjson.decode("-1.5e3"), " ", cjson.decode('"str"'))
+		golapis.say(cjson.decode("0x10"), " ", tostring(cjson.decode("true")))
+		golapis.say(type(cjson.decode("[]")), " ", getmetatable(cjson.decode("[]")) == nil)
+	`)
+
+	expected := "1 2.5 xé😀 true 4\nfalse true\n12 -1500 str\n16 true\ntable true\n"
+	if body != expected {
+		t.Errorf("expected %q, got %q", expected, body)
+	}
+}
+
+func TestCJSONRoundTrip(t *testing.T) {
+	input := `[{"tags":["a","b"]},{"tags":{}},"x\/y",null,-2.5,[[1]]]`
+	body := runCJSON(t, `
+		local cjson = require "cjson"
+		golapis.say(cjson.encode(cjson.decode([=[`+input+`]=])))
+	`)
+
+	if body != input+"\n" {
+		t.Errorf("expected %q, got %q", input+"\n", body)
+	}
+}
+
+func TestCJSONEmptyArrays(t *testing.T) {
+	body := runCJSON(t, `
+		local cjson = require "cjson"
+		golapis.say(cjson.encode({ list = cjson.empty_array }))
+		golapis.say(cjson.encode(setmetatable({}, cjson.empty_array_mt)))
+		golapis.say(cjson.encode(setmetatable({ a = 1 }, cjson.empty_array_mt)))
+		golapis.say(cjson.encode(setmetatable({ 1, 2 }, cjson.empty_array_mt)))
+		golapis.say(cjson.encode(setmetatable({}, cjson.array_mt)))
+		golapis.say(cjson.encode(setmetatable({ 1, 2 }, cjson.array_mt)))
+
+		cjson.encode_empty_table_as_object(false)
+		golapis.say(cjson.encode({}))
+		cjson.encode_empty_table_as_object(true)
+
+		cjson.decode_array_with_array_mt(true)
+		local arr = cjson.decode("[]")
+		golapis.say(getmetatable(arr) == cjson.array_mt, " ", cjson.encode(arr))
+		golapis.say(getmetatable(cjson.decode("{}")) == nil)
+		cjson.decode_array_with_array_mt(false)
+	`)
+
+	expected := "{\"list\":[]}\n[]\n{\"a\":1}\n[1,2]\n[]\n[1,2]\n[]\ntrue []\ntrue\n"
+	if body != expected {
+		t.Errorf("expected %q, got %q", expected, body)
+	}
+}
+
+func TestCJSONOptions(t *testing.T) {
+	body := runCJSON(t, `
+		local cjson = require "cjson"
+		local json = cjson.new()
+		golapis.say(json.encode_number_precision())
+		json.encode_number_precision(4)
+		golapis.say(json.encode(3.14159265))
+		golapis.say(cjson.encode(3.14159265))
+
+		json.encode_escape_forward_slash(false)
+		golapis.say(json.encode("a/b"))
+
+		json.encode_invalid_numbers(true)
+		golapis.say(json.encode(1/0), " ", json.encode(-1/0))
+		json.encode_invalid_numbers("null")
+		golapis.say(json.encode({ 0/0 }))
+
+		json.encode_sparse_array(true)
+		golapis.say(json.encode({ [1] = "a", [20] = "b" }) ~= nil)
+		golapis.say(json.encode_sparse_array())
+
+		json.encode_max_depth(2)
+		golapis.say(pcall(json.encode, { { { 1 } } }))
+		golapis.say(pcall(json.encode_number_precision, 20))
+		golapis.say(cjson._NAME, " ", json._NAME, " ", cjson._VERSION)
+	`)
+
+	expected := strings.Join([]string{
+		"14",
+		"3.142",
+		"3.14159265",
+		`"a/b"`,
+		"Infinity -Infinity",
+		"[null]",
+		"true",
+		"true210",
+		"falseCannot serialise, excessive nesting (3)",
+		"falsebad argument #1 to 'encode_number_precision' (expected integer between 1 and 16)",
+		"cjson cjson 2.1.0.14",
+	}, "\n") + "\n"
+	if body != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, body)
+	}
+}
+
+func TestCJSONErrors(t *testing.T) {
+	body := runCJSON(t, `
+		local cjson = require "cjson"
+		golapis.say(select(2, pcall(cjson.decode, '{"a": 1,}')))
+		golapis.say(select(2, pcall(cjson.decode, '[1, 2')))
+		golapis.say(select(2, pcall(cjson.decode, '{"a" 1}')))
+		golapis.say(select(2, pcall(cjson.decode, '[1] x')))
+		golapis.say(select(2, pcall(cjson.encode, { f = function() end })))
+		golapis.say(select(2, pcall(cjson.encode, { [1] = 1, [100] = 2 })))
+		golapis.say(select(2, pcall(cjson.encode, 0/0)))
+		golapis.say(select(2, pcall(cjson.encode, { [true] = 1 })))
+
+		local nested = "1"
+		for i = 1, 1001 do nested = "[" .. nested .. "]" end
+		golapis.say(select(2, pcall(cjson.decode, nested)))
+	`)
+
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	expected := []string{
+		"Expected object key string but found T_OBJ_END at character 9",
+		"Expected comma or array end but found T_END at character 6",
+		"Expected colon but found T_NUMBER at character 6",
+		"Expected the end but found invalid token at character 5",
+		"Cannot serialise function: type not supported",
+		"Cannot serialise table: excessively sparse array",
+		"Cannot serialise number: must not be NaN or Infinity",
+		"Cannot serialise boolean: table key must be a number or string",
+		"Found too many nested data structures (1001) at character 1001",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %d: %q", len(expected), len(lines), body)
+	}
+	for i, want := range expected {
+		if !strings.HasSuffix(lines[i], want) {
+			t.Errorf("line %d: expected %q, got %q", i+1, want, lines[i])
+		}
+	}
+}
+
+func TestCJSONSafe(t *testing.T) {
+	body := runCJSON(t, `
+		local cjson_safe = require "cjson.safe"
+		local value, err = cjson_safe.decode("{bad")
+		golapis.say(tostring(value), " ", err)
+		value, err = cjson_safe.encode({ f = print })
+		golapis.say(tostring(value), " ", err)
+		golapis.say(cjson_safe.decode("[1]")[1], " ", cjson_safe.encode({ 1 }))
+		golapis.say(cjson_safe.new()._NAME, " ", require("cjson") ~= cjson_safe)
+	`)
+
+	expected := "nil Expected object key string but found invalid token at character 2\n" +
+		"nil Cannot serialise function: type not supported\n" +
+		"1 [1]\n" +
+		"cjson.safe true\n"
+	if body != expected {
+		t.Errorf("expected %q, got %q", expected, body)
+	}
+}
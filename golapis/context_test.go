@@ -0,0 +1,112 @@
+package golapis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunStringContextDeadline(t *testing.T) {
+	gls, buf := newOptionsState(t, DefaultOptions())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := gls.RunStringContext(ctx, `
+		golapis.say("before")
+		golapis.sleep(5)
+		golapis.say("after")
+	`)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("abort took %v", elapsed)
+	}
+	gls.Wait()
+
+	if output := buf.String(); output != "before\n" {
+		t.Errorf("expected only output before the sleep, got %q", output)
+	}
+
+	// The state keeps working after an abort
+	if err := gls.RunString(`golapis.say("next")`); err != nil {
+		t.Fatalf("RunString: %v", err)
+	}
+	if output := buf.String(); output != "before\nnext\n" {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func TestRunStringContextCanceledBeforeStart(t *testing.T) {
+	gls, buf := newOptionsState(t, DefaultOptions())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := gls.RunStringContext(ctx, `golapis.say("ran")`); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected canceled, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected no output, got %q", buf.String())
+	}
+}
+
+func TestRunStringContextCompletes(t *testing.T) {
+	gls, buf := newOptionsState(t, DefaultOptions())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := gls.RunStringContext(ctx, `golapis.sleep(0.01) golapis.say("done")`); err != nil {
+		t.Fatalf("RunStringContext: %v", err)
+	}
+	cancel()
+	gls.Wait()
+	if output := buf.String(); output != "done\n" {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func TestRunStringContextInterruptsSocket(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn // never writes, so receive blocks
+		}
+	}()
+
+	gls, _ := newOptionsState(t, DefaultOptions())
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	err = gls.RunStringContext(ctx, fmt.Sprintf(`
+		local sock = golapis.socket.tcp()
+		assert(sock:connect("127.0.0.1", %d))
+		sock:receive("*l")
+		error("receive should not return")
+	`, port))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+	gls.Wait()
+
+	// The aborted thread's socket was closed
+	conn := <-accepted
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("expected closed connection, got %v", err)
+	}
+}
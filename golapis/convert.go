@@ -0,0 +1,180 @@
+package golapis
+
+/*
+#include "lua_helpers.h"
+*/
+import "C"
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// pushGoValue pushes a Go value onto the Lua stack. Supported values are nil,
+// booleans, numbers, strings, []byte, Null, structs (see Marshal), and maps and
+// slices of supported values. Maps must have string or numeric keys. Nothing
+// is pushed if an error is returned.
+func pushGoValue(L *C.lua_State, v any) error {
+	batch := AcquireBatch()
+	defer ReleaseBatch(batch)
+
+	if err := encodeGoValue(batch, reflect.ValueOf(v), 0); err != nil {
+		return err
+	}
+	batch.Push(L)
+	return nil
+}
+
+// encodeGoValue appends the instructions to push v to batch
+func encodeGoValue(batch *LuaBatch, v reflect.Value, depth int) error {
+	if depth > maxTableDepth {
+		return fmt.Errorf("value nesting too deep")
+	}
+	if !v.IsValid() {
+		batch.Nil()
+		return nil
+	}
+	if v.Type() == nullValueType {
+		batch.Null()
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if v.IsNil() {
+			batch.Nil()
+			return nil
+		}
+		return encodeGoValue(batch, v.Elem(), depth)
+	case reflect.Bool:
+		batch.Bool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		batch.Int64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		batch.Number(float64(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		batch.Number(v.Float())
+	case reflect.String:
+		batch.String(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			batch.String(string(v.Bytes()))
+			return nil
+		}
+		batch.TableSized(v.Len(), 0)
+		for i := 0; i < v.Len(); i++ {
+			if err := encodeGoValue(batch, v.Index(i), depth+1); err != nil {
+				return err
+			}
+			batch.SetIndex(i + 1)
+		}
+	case reflect.Map:
+		switch v.Type().Key().Kind() {
+		case reflect.String,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+		default:
+			return fmt.Errorf("unsupported map key type: %s", v.Type().Key())
+		}
+		batch.TableSized(0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := encodeGoValue(batch, iter.Key(), depth+1); err != nil {
+				return err
+			}
+			if err := encodeGoValue(batch, iter.Value(), depth+1); err != nil {
+				return err
+			}
+			batch.Set()
+		}
+	case reflect.Struct:
+		return encodeStruct(batch, v, depth)
+	default:
+		return fmt.Errorf("unsupported type: %s", v.Type())
+	}
+	return nil
+}
+
+// luaToGoValue converts the Lua value at idx to a Go value: nil, bool, int64
+// (integral numbers), float64, string, []any (array tables) or map[string]any
+// (other tables, with number keys formatted as strings). golapis.null converts
+// to nil. Functions, coroutines and other userdata are not supported.
+func luaToGoValue(L *C.lua_State, idx C.int, depth int) (any, error) {
+	if depth > maxTableDepth {
+		return nil, fmt.Errorf("table nesting too deep")
+	}
+	if idx < 0 {
+		idx = C.lua_gettop(L) + idx + 1
+	}
+
+	switch C.lua_type(L, idx) {
+	case C.LUA_TNIL:
+		return nil, nil
+	case C.LUA_TBOOLEAN:
+		return C.lua_toboolean(L, idx) != 0, nil
+	case C.LUA_TNUMBER:
+		num := float64(C.lua_tonumber(L, idx))
+		if num == math.Trunc(num) && math.Abs(num) < 1<<63 {
+			return int64(num), nil
+		}
+		return num, nil
+	case C.LUA_TSTRING:
+		return string(luaStringBytes(L, idx)), nil
+	case C.LUA_TLIGHTUSERDATA:
+		if C.lua_touserdata_wrapper(L, idx) == nil {
+			return nil, nil
+		}
+	case C.LUA_TTABLE:
+		return luaTableToGo(L, idx, depth)
+	}
+
+	typeName := C.GoString(C.lua_typename(L, C.lua_type(L, idx)))
+	return nil, fmt.Errorf("unsupported Lua type: %s", typeName)
+}
+
+// luaTableToGo converts the table at absolute index idx (see luaToGoValue)
+func luaTableToGo(L *C.lua_State, idx C.int, depth int) (any, error) {
+	if maxKey, err := validateArrayTable(L, idx); err == nil && maxKey > 0 {
+		arr := make([]any, maxKey)
+		for i := 1; i <= maxKey; i++ {
+			C.lua_rawgeti_wrapper(L, idx, C.int(i))
+			value, err := luaToGoValue(L, -1, depth+1)
+			C.lua_pop_wrapper(L, 1)
+			if err != nil {
+				return nil, err
+			}
+			arr[i-1] = value
+		}
+		return arr, nil
+	}
+
+	result := make(map[string]any)
+	C.lua_pushnil(L)
+	for C.lua_next_wrapper(L, idx) != 0 {
+		// Stack: key at -2, value at -1
+		var key string
+		switch C.lua_type(L, -2) {
+		case C.LUA_TSTRING:
+			key = string(luaStringBytes(L, -2))
+		case C.LUA_TNUMBER:
+			key = formatLuaNumber(float64(C.lua_tonumber(L, -2)))
+		case C.LUA_TBOOLEAN:
+			key = strconv.FormatBool(C.lua_toboolean(L, -2) != 0)
+		default:
+			typeName := C.GoString(C.lua_typename(L, C.lua_type(L, -2)))
+			C.lua_pop_wrapper(L, 2)
+			return nil, fmt.Errorf("unsupported table key type: %s", typeName)
+		}
+
+		value, err := luaToGoValue(L, -1, depth+1)
+		if err != nil {
+			C.lua_pop_wrapper(L, 2)
+			return nil, err
+		}
+		result[key] = value
+		C.lua_pop_wrapper(L, 1) // pop value, keep key for next iteration
+	}
+	return result, nil
+}
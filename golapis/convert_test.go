@@ -0,0 +1,184 @@
+package golapis
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// runLuaWithCtx runs code through HTTPHandler for a request prepared with
+// PrepareRequest, letting setup inject values first
+func runLuaWithCtx(t *testing.T, code string, setup func(req *GolapisRequest)) (*httptest.ResponseRecorder, *GolapisRequest) {
+	t.Helper()
+
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+
+	if err := gls.LoadEntryPoint(CodeEntryPoint{Code: code}); err != nil {
+		t.Fatalf("Failed to load entry point: %v", err)
+	}
+
+	gls.Start()
+	defer gls.Stop()
+
+	r, req := PrepareRequest(httptest.NewRequest("GET", "/", nil))
+	if setup != nil {
+		setup(req)
+	}
+
+	w := httptest.NewRecorder()
+	gls.HTTPHandler(DefaultHTTPServerConfig()).ServeHTTP(w, r)
+	gls.Wait()
+	return w, req
+}
+
+func TestPushGoValueTypes(t *testing.T) {
+	w, _ := runLuaWithCtx(t, `
+		local v = golapis.ctx.value
+		golapis.say(v.str, " ", v.int, " ", v.float, " ", tostring(v.yes), " ", v.bytes)
+		golapis.say(#v.list, " ", v.list[1], " ", v.list[3])
+		golapis.say(v.nested.inner[2], " ", v.ids[10])
+		golapis.say(tostring(golapis.ctx.missing))
+	`, func(req *GolapisRequest) {
+		err := req.SetCtx("value", map[string]any{
+			"str":    "hello",
+			"int":    42,
+			"float":  1.5,
+			"yes":    true,
+			"bytes":  []byte("raw"),
+			"list":   []string{"a", "b", "c"},
+			"nested": map[string][]int{"inner": {1, 2}},
+			"ids":    map[int]string{10: "ten"},
+		})
+		if err != nil {
+			t.Fatalf("SetCtx failed: %v", err)
+		}
+	})
+
+	expected := "hello 42 1.5 true raw\n3 a c\n2 ten\nnil\n"
+	if w.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, w.Body.String())
+	}
+}
+
+func TestSetCtxUnsupportedType(t *testing.T) {
+	req := NewGolapisRequest(httptest.NewRequest("GET", "/", nil))
+
+	for _, value := range []any{
+		func() {},
+		make(chan int),
+		map[bool]string{true: "x"},
+		[]any{struct{}{}},
+	} {
+		if err := req.SetCtx("bad", value); err == nil {
+			t.Errorf("expected error for %T", value)
+		}
+	}
+	if _, ok := req.ctxValues["bad"]; ok {
+		t.Error("rejected value was stored")
+	}
+}
+
+func TestLuaToGoValueCtxResult(t *testing.T) {
+	_, req := runLuaWithCtx(t, `
+		golapis.ctx.str = "hello"
+		golapis.ctx.int = 7
+		golapis.ctx.float = 0.25
+		golapis.ctx.flag = false
+		golapis.ctx.list = { "a", "b" }
+		golapis.ctx.map = { x = 1, [2] = "two", sub = { true } }
+		golapis.ctx.empty = {}
+		golapis.ctx.fn = function() end
+		golapis.ctx.seen = golapis.ctx.injected + 1
+	`, func(req *GolapisRequest) {
+		req.SetCtx("injected", 1)
+	})
+
+	expected := map[string]any{
+		"str":      "hello",
+		"int":      int64(7),
+		"float":    0.25,
+		"flag":     false,
+		"list":     []any{"a", "b"},
+		"map":      map[string]any{"x": int64(1), "2": "two", "sub": []any{true}},
+		"empty":    map[string]any{},
+		"injected": int64(1),
+		"seen":     int64(2),
+	}
+	for key, want := range expected {
+		got, ok := req.GetCtx(key)
+		if !ok {
+			t.Errorf("GetCtx(%q) missing", key)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("GetCtx(%q) = %#v, want %#v", key, got, want)
+		}
+	}
+	if _, ok := req.GetCtx("fn"); ok {
+		t.Error("expected function value to be omitted")
+	}
+}
+
+func TestGetCtxAfterYield(t *testing.T) {
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+
+	err := gls.LoadEntryPoint(CodeEntryPoint{Code: `
+		golapis.sleep(0.01)
+		golapis.ctx.result = "after sleep"
+	`})
+	if err != nil {
+		t.Fatalf("Failed to load entry point: %v", err)
+	}
+	gls.Start()
+	defer gls.Stop()
+
+	// GetCtx is read as soon as the handler returns, without gls.Wait()
+	r, req := PrepareRequest(httptest.NewRequest("GET", "/", nil))
+	gls.HTTPHandler(DefaultHTTPServerConfig()).ServeHTTP(httptest.NewRecorder(), r)
+	if value, ok := req.GetCtx("result"); !ok || value != "after sleep" {
+		t.Errorf("GetCtx(result) = %#v, %v", value, ok)
+	}
+	gls.Wait()
+}
+
+func TestPrepareRequestVars(t *testing.T) {
+	w, req := runLuaWithCtx(t, `
+		golapis.say(golapis.var.user_id)
+		golapis.var.user_id = "changed"
+		golapis.var.args = "page=2"
+	`, func(req *GolapisRequest) {
+		req.SetVar("user_id", "42")
+	})
+
+	if w.Body.String() != "42\n" {
+		t.Errorf("expected %q, got %q", "42\n", w.Body.String())
+	}
+	if value, ok := req.GetVar("user_id"); !ok || value != "changed" {
+		t.Errorf("GetVar(user_id) = %q, %v", value, ok)
+	}
+	if value, ok := req.GetVar("arg_page"); !ok || value != "2" {
+		t.Errorf("GetVar(arg_page) = %q, %v", value, ok)
+	}
+	if _, ok := req.GetVar("undeclared"); ok {
+		t.Error("expected undeclared variable to be unset")
+	}
+}
+
+func TestPrepareRequestReturnsExisting(t *testing.T) {
+	r, req := PrepareRequest(httptest.NewRequest("GET", "/", nil))
+	r2, req2 := PrepareRequest(r.WithContext(r.Context()))
+	if req2 != req {
+		t.Error("expected the existing GolapisRequest to be returned")
+	}
+	if r2.Context().Value(golapisRequestKey{}) != req {
+		t.Error("expected request context to carry the GolapisRequest")
+	}
+}
@@ -0,0 +1,336 @@
+package golapis
+
+/*
+#include "lua_helpers.h"
+*/
+import "C"
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// cryptoDigests maps the digest names accepted by golapis.crypto functions
+// (and resty.aes.hash) to their constructors
+var cryptoDigests = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha224": sha256.New224,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// checkStringArgs verifies that the first n arguments are strings, pushing
+// nil and an error message if not. Returns false if the check failed.
+func checkStringArgs(L *C.lua_State, name string, n int, argNames ...string) bool {
+	if int(C.lua_gettop(L)) < n {
+		C.lua_pushnil(L)
+		if n == 1 {
+			pushGoString(L, fmt.Sprintf("%s expects 1 argument", name))
+		} else {
+			pushGoString(L, fmt.Sprintf("%s expects %d arguments", name, n))
+		}
+		return false
+	}
+	for i := 1; i <= n; i++ {
+		if C.lua_isstring(L, C.int(i)) == 0 {
+			C.lua_pushnil(L)
+			if i <= len(argNames) {
+				pushGoString(L, fmt.Sprintf("%s: argument %d (%s) must be a string", name, i, argNames[i-1]))
+			} else {
+				pushGoString(L, fmt.Sprintf("%s: argument %d must be a string", name, i))
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// pushDigest hashes the string argument with newHash and pushes the binary digest
+func pushDigest(L *C.lua_State, name string, newHash func() hash.Hash) C.int {
+	if !checkStringArgs(L, name, 1) {
+		return 2
+	}
+	h := newHash()
+	h.Write(luaStringBytes(L, 1))
+	pushGoString(L, string(h.Sum(nil)))
+	return 1
+}
+
+// pushHMAC computes the HMAC of argument 2 keyed by argument 1 and pushes the binary digest
+func pushHMAC(L *C.lua_State, name string, newHash func() hash.Hash) C.int {
+	if !checkStringArgs(L, name, 2, "secret_key", "str") {
+		return 2
+	}
+	h := hmac.New(newHash, luaStringBytes(L, 1))
+	h.Write(luaStringBytes(L, 2))
+	pushGoString(L, string(h.Sum(nil)))
+	return 1
+}
+
+//export golapis_crypto_sha256_bin
+func golapis_crypto_sha256_bin(L *C.lua_State) C.int {
+	return pushDigest(L, "sha256_bin", sha256.New)
+}
+
+//export golapis_crypto_sha512_bin
+func golapis_crypto_sha512_bin(L *C.lua_State) C.int {
+	return pushDigest(L, "sha512_bin", sha512.New)
+}
+
+//export golapis_crypto_hmac_sha256
+func golapis_crypto_hmac_sha256(L *C.lua_State) C.int {
+	return pushHMAC(L, "hmac_sha256", sha256.New)
+}
+
+//export golapis_crypto_hmac_sha512
+func golapis_crypto_hmac_sha512(L *C.lua_State) C.int {
+	return pushHMAC(L, "hmac_sha512", sha512.New)
+}
+
+// golapis_crypto_digest(name, str) hashes str with any digest in cryptoDigests
+//
+//export golapis_crypto_digest
+func golapis_crypto_digest(L *C.lua_State) C.int {
+	if !checkStringArgs(L, "digest", 2, "name", "str") {
+		return 2
+	}
+	name := string(luaStringBytes(L, 1))
+	newHash, ok := cryptoDigests[name]
+	if !ok {
+		C.lua_pushnil(L)
+		pushGoString(L, "digest: unknown digest: "+name)
+		return 2
+	}
+	h := newHash()
+	h.Write(luaStringBytes(L, 2))
+	pushGoString(L, string(h.Sum(nil)))
+	return 1
+}
+
+// golapis_crypto_random_bytes(len, strong) returns len random bytes. Bytes
+// always come from the operating system's CSPRNG, so strong is accepted for
+// resty.random compatibility but has no effect.
+//
+//export golapis_crypto_random_bytes
+func golapis_crypto_random_bytes(L *C.lua_State) C.int {
+	if C.lua_gettop(L) < 1 || C.lua_isnumber(L, 1) == 0 {
+		C.lua_pushnil(L)
+		pushGoString(L, "random_bytes: length must be a number")
+		return 2
+	}
+	n := int(C.lua_tonumber(L, 1))
+	if n < 0 {
+		C.lua_pushnil(L)
+		pushGoString(L, "random_bytes: length must not be negative")
+		return 2
+	}
+
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		C.lua_pushnil(L)
+		pushGoString(L, "random_bytes: "+err.Error())
+		return 2
+	}
+	pushGoString(L, string(buf))
+	return 1
+}
+
+// evpBytesToKey derives a key and IV from a password the same way as
+// OpenSSL's EVP_BytesToKey, which resty.aes uses when no IV is given
+func evpBytesToKey(newHash func() hash.Hash, password, salt []byte, rounds, keyLen, ivLen int) ([]byte, []byte) {
+	var derived, prev []byte
+	for len(derived) < keyLen+ivLen {
+		h := newHash()
+		h.Write(prev)
+		h.Write(password)
+		h.Write(salt)
+		prev = h.Sum(nil)
+		for i := 1; i < rounds; i++ {
+			h.Reset()
+			h.Write(prev)
+			prev = h.Sum(nil)
+		}
+		derived = append(derived, prev...)
+	}
+	return derived[:keyLen], derived[keyLen : keyLen+ivLen]
+}
+
+// golapis_crypto_bytes_to_key(digest, password, salt, rounds, key_len, iv_len)
+// returns the derived key and IV. salt may be nil.
+//
+//export golapis_crypto_bytes_to_key
+func golapis_crypto_bytes_to_key(L *C.lua_State) C.int {
+	if !checkStringArgs(L, "bytes_to_key", 2, "digest", "password") {
+		return 2
+	}
+	name := string(luaStringBytes(L, 1))
+	newHash, ok := cryptoDigests[name]
+	if !ok {
+		C.lua_pushnil(L)
+		pushGoString(L, "bytes_to_key: unknown digest: "+name)
+		return 2
+	}
+	var salt []byte
+	if C.lua_isstring(L, 3) != 0 {
+		salt = luaStringBytes(L, 3)
+	}
+	rounds := 1
+	if C.lua_isnumber(L, 4) != 0 {
+		rounds = int(C.lua_tonumber(L, 4))
+	}
+	keyLen := int(C.lua_tonumber(L, 5))
+	ivLen := int(C.lua_tonumber(L, 6))
+	if rounds < 1 || keyLen < 0 || ivLen < 0 {
+		C.lua_pushnil(L)
+		pushGoString(L, "bytes_to_key: invalid rounds or length")
+		return 2
+	}
+
+	key, iv := evpBytesToKey(newHash, luaStringBytes(L, 2), salt, rounds, keyLen, ivLen)
+	pushGoString(L, string(key))
+	pushGoString(L, string(iv))
+	return 2
+}
+
+// aesCrypt encrypts or decrypts data with AES in the given mode (cbc, ecb,
+// ctr or gcm). padding enables PKCS#7 padding for cbc and ecb. For gcm, tag
+// is the authentication tag to verify when decrypting, and the returned tag
+// is set when encrypting.
+func aesCrypt(encrypt bool, mode string, key, iv, data, tag []byte, padding bool) (out []byte, outTag []byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad key length")
+	}
+	blockSize := block.BlockSize()
+
+	switch mode {
+	case "cbc", "ecb":
+		if mode == "cbc" && len(iv) != blockSize {
+			return nil, nil, fmt.Errorf("bad iv length")
+		}
+		if encrypt && padding {
+			n := blockSize - len(data)%blockSize
+			data = append(append([]byte(nil), data...), bytes.Repeat([]byte{byte(n)}, n)...)
+		}
+		if len(data)%blockSize != 0 {
+			return nil, nil, fmt.Errorf("data length is not a multiple of the block size")
+		}
+		out = make([]byte, len(data))
+		switch {
+		case mode == "ecb" && encrypt:
+			for i := 0; i < len(data); i += blockSize {
+				block.Encrypt(out[i:], data[i:])
+			}
+		case mode == "ecb":
+			for i := 0; i < len(data); i += blockSize {
+				block.Decrypt(out[i:], data[i:])
+			}
+		case encrypt:
+			cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, data)
+		default:
+			cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+		}
+		if !encrypt && padding {
+			n := 0
+			if len(out) > 0 {
+				n = int(out[len(out)-1])
+			}
+			if n == 0 || n > blockSize || n > len(out) ||
+				!bytes.Equal(out[len(out)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+				return nil, nil, fmt.Errorf("bad decrypt")
+			}
+			out = out[:len(out)-n]
+		}
+		return out, nil, nil
+	case "ctr":
+		if len(iv) != blockSize {
+			return nil, nil, fmt.Errorf("bad iv length")
+		}
+		out = make([]byte, len(data))
+		cipher.NewCTR(block, iv).XORKeyStream(out, data)
+		return out, nil, nil
+	case "gcm":
+		if len(iv) == 0 {
+			return nil, nil, fmt.Errorf("bad iv length")
+		}
+		aead, err := cipher.NewGCMWithNonceSize(block, len(iv))
+		if err != nil {
+			return nil, nil, err
+		}
+		if encrypt {
+			sealed := aead.Seal(nil, iv, data, nil)
+			split := len(sealed) - aead.Overhead()
+			return sealed[:split], sealed[split:], nil
+		}
+		if len(tag) != aead.Overhead() {
+			return nil, nil, fmt.Errorf("bad tag length")
+		}
+		out, err = aead.Open(nil, iv, append(append([]byte(nil), data...), tag...), nil)
+		if err != nil {
+			return nil, nil, errors.New("authentication failed")
+		}
+		return out, nil, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported cipher mode: %s", mode)
+}
+
+// golapis_crypto_aes_encrypt(mode, key, iv, data, padding) returns the
+// ciphertext, plus the authentication tag for gcm
+//
+//export golapis_crypto_aes_encrypt
+func golapis_crypto_aes_encrypt(L *C.lua_State) C.int {
+	if !checkStringArgs(L, "aes_encrypt", 4, "mode", "key", "iv", "data") {
+		return 2
+	}
+	padding := C.lua_type(L, 5) <= C.LUA_TNIL || C.lua_toboolean(L, 5) != 0
+
+	out, tag, err := aesCrypt(true, string(luaStringBytes(L, 1)), luaStringBytes(L, 2),
+		luaStringBytes(L, 3), luaStringBytes(L, 4), nil, padding)
+	if err != nil {
+		C.lua_pushnil(L)
+		pushGoString(L, "aes_encrypt: "+err.Error())
+		return 2
+	}
+	pushGoString(L, string(out))
+	if tag != nil {
+		pushGoString(L, string(tag))
+		return 2
+	}
+	return 1
+}
+
+// golapis_crypto_aes_decrypt(mode, key, iv, data, tag, padding) returns the
+// plaintext. tag is required for gcm and ignored otherwise.
+//
+//export golapis_crypto_aes_decrypt
+func golapis_crypto_aes_decrypt(L *C.lua_State) C.int {
+	if !checkStringArgs(L, "aes_decrypt", 4, "mode", "key", "iv", "data") {
+		return 2
+	}
+	var tag []byte
+	if C.lua_isstring(L, 5) != 0 {
+		tag = luaStringBytes(L, 5)
+	}
+	padding := C.lua_type(L, 6) <= C.LUA_TNIL || C.lua_toboolean(L, 6) != 0
+
+	out, _, err := aesCrypt(false, string(luaStringBytes(L, 1)), luaStringBytes(L, 2),
+		luaStringBytes(L, 3), luaStringBytes(L, 4), tag, padding)
+	if err != nil {
+		C.lua_pushnil(L)
+		pushGoString(L, "aes_decrypt: "+err.Error())
+		return 2
+	}
+	pushGoString(L, string(out))
+	return 1
+}
@@ -0,0 +1,124 @@
+package golapis
+
+import (
+	"strings"
+	"testing"
+)
+
+func runCryptoLines(t *testing.T, code string, expected []string) {
+	t.Helper()
+	output, err := runLuaAndCapture(t, code)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %d: %q", len(expected), len(lines), output)
+	}
+	for i, exp := range expected {
+		if lines[i] != exp {
+			t.Errorf("line %d: expected %q, got %q", i, exp, lines[i])
+		}
+	}
+}
+
+func TestCryptoHashes(t *testing.T) {
+	runCryptoLines(t, `
+		local str = require "resty.string"
+		local crypto = golapis.crypto
+		golapis.say(str.to_hex(crypto.sha256_bin("hello")))
+		golapis.say(str.to_hex(crypto.sha512_bin("hello")))
+		golapis.say(str.to_hex(crypto.hmac_sha256("key", "The quick brown fox jumps over the lazy dog")))
+		golapis.say(str.to_hex(crypto.hmac_sha512("key", "The quick brown fox jumps over the lazy dog")))
+		golapis.say(select(2, crypto.sha256_bin()))
+		golapis.say(select(2, crypto.hmac_sha256("key")))
+	`, []string{
+		"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		"9b71d224bd62f3785d96d46ad3ea3d73319bfbc2890caadae2dff72519673ca72323c3d99ba5c11d7c7acc6e14b8c5da0c4663475c2e5c3adef46f73bcdec043",
+		"f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8",
+		"b42af09057bac1e2d41708e48a902e09b5ff7f12ab428a4fe86653c73dd248fb82f948a549f7b791a5b41915ee4d1ec3935357e4e2317250d0372afa2ebeeb3a",
+		"sha256_bin expects 1 argument",
+		"hmac_sha256 expects 2 arguments",
+	})
+}
+
+func TestRestySHA256(t *testing.T) {
+	runCryptoLines(t, `
+		local resty_sha256 = require "resty.sha256"
+		local str = require "resty.string"
+		local sha256 = resty_sha256:new()
+		sha256:update("hel")
+		sha256:update("lo")
+		golapis.say(str.to_hex(sha256:final()))
+		sha256:reset()
+		golapis.say(str.to_hex(sha256:final()))
+		golapis.say(str.atoi(" 42abc"), " ", str.atoi("-7"), " ", str.atoi("x"))
+	`, []string{
+		"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"42 -7 0",
+	})
+}
+
+func TestRestyRandom(t *testing.T) {
+	runCryptoLines(t, `
+		local random = require "resty.random"
+		local a, b = random.bytes(16), random.bytes(16, true)
+		golapis.say(#a, " ", #b, " ", a ~= b)
+		golapis.say(#random.bytes(0))
+	`, []string{"16 16 true", "0"})
+}
+
+func TestRestyAES(t *testing.T) {
+	runCryptoLines(t, `
+		local aes = require "resty.aes"
+		local str = require "resty.string"
+
+		-- Key and IV derived with EVP_BytesToKey, matching openssl enc -k
+		local aes_default = aes:new("secret")
+		local encrypted = aes_default:encrypt("hello")
+		golapis.say(str.to_hex(encrypted), " ", aes_default:decrypt(encrypted))
+
+		local aes_salted = aes:new("secret", "saltsalt", aes.cipher(256), aes.hash.sha256)
+		golapis.say(str.to_hex(aes_salted:encrypt("hello")))
+
+		-- Explicit key and IV
+		local aes_iv = aes:new("12345678901234567890123456789012", nil, aes.cipher(256, "cbc"), { iv = "1234567890123456" })
+		golapis.say(str.to_hex(aes_iv:encrypt("hello")))
+
+		local aes_ecb = aes:new("1234567890123456", nil, aes.cipher(128, "ecb"), { iv = "" }, nil, nil, false)
+		golapis.say(str.to_hex(aes_ecb:encrypt("hello world!!!!!")))
+
+		golapis.say(aes_default:decrypt("0123456789abcdef"))
+		golapis.say(select(2, aes:new("secret", "short")))
+		golapis.say(select(2, aes:new("short", nil, aes.cipher(128), { iv = "1234567890123456" })))
+		golapis.say(tostring(aes.cipher(128, "xts")))
+	`, []string{
+		"7b47a4dbb11e2cddb2f3740c9e3a552b hello",
+		"d2877441c2093b7334abf8cc2ce2d299",
+		"45a3593d1f1e7e699e26dfb2945d41b9",
+		"ca0ae21e6b98760cf1d560d24a1d9987",
+		"nilEVP_DecryptFinal_ex failed",
+		"salt must be 8 characters or nil",
+		"bad key length",
+		"nil",
+	})
+}
+
+func TestRestyAESGCM(t *testing.T) {
+	runCryptoLines(t, `
+		local aes = require "resty.aes"
+		local gcm = aes:new("12345678901234567890123456789012", nil, aes.cipher(256, "gcm"), { iv = "123456789012" }, nil, 12)
+		local encrypted, tag = gcm:encrypt("secret message")
+		golapis.say(#encrypted, " ", #tag)
+		golapis.say(gcm:decrypt(encrypted, tag))
+		local tampered = string.char((string.byte(encrypted, 1) + 1) % 256) .. encrypted:sub(2)
+		golapis.say(gcm:decrypt(tampered, tag))
+		golapis.say(gcm:decrypt(encrypted))
+	`, []string{
+		"14 16",
+		"secret message",
+		"nilEVP_DecryptFinal_ex failed",
+		"nilno tag",
+	})
+}
@@ -0,0 +1,277 @@
+package golapis
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrorHandler writes the response for a request whose Lua handler raised an
+// error. It is only called while the response headers have not been sent.
+// See DevErrorHandler and ProductionErrorHandler.
+type ErrorHandler func(w http.ResponseWriter, req *GolapisRequest, err error)
+
+// ErrorPage is the response for a status code in HTTPServerConfig.ErrorPages,
+// like nginx's error_page. Set either File or Handler.
+type ErrorPage struct {
+	File    string // static file sent as the response body
+	Handler string // dotted name of a Lua function called with the status code (see Call)
+}
+
+// sourceContextLines is how many lines around the error DevErrorHandler shows
+const sourceContextLines = 5
+
+// errorReport is the data rendered by DevErrorHandler
+type errorReport struct {
+	Status    int             `json:"status"`
+	Message   string          `json:"message"`
+	Chunk     string          `json:"chunk,omitempty"`
+	Line      int             `json:"line,omitempty"`
+	Traceback string          `json:"traceback,omitempty"`
+	Frames    []LuaStackFrame `json:"frames,omitempty"`
+	Source    []sourceLine    `json:"source,omitempty"`
+	Request   requestDetails  `json:"request"`
+}
+
+// sourceLine is a line of the chunk where the error happened
+type sourceLine struct {
+	Line    int    `json:"line"`
+	Text    string `json:"text"`
+	Current bool   `json:"current,omitempty"`
+}
+
+// requestDetails describes the failed request
+type requestDetails struct {
+	ID         string              `json:"id"`
+	Method     string              `json:"method"`
+	URI        string              `json:"uri"`
+	RemoteAddr string              `json:"remote_addr"`
+	Headers    map[string][]string `json:"headers"`
+}
+
+var devErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Status}} Lua error</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+pre { background: #f4f4f4; padding: 1em; overflow-x: auto; }
+.source span { display: block; }
+.source .current { background: #ffd7d7; font-weight: bold; }
+th { text-align: left; padding-right: 1em; vertical-align: top; }
+</style>
+</head>
+<body>
+<h1>Lua error</h1>
+<pre>{{.Message}}</pre>
+{{if .Source}}<h2>{{.Chunk}}:{{.Line}}</h2>
+<pre class="source">{{range .Source}}<span{{if .Current}} class="current"{{end}}>{{printf "%4d" .Line}}  {{.Text}}</span>{{end}}</pre>
+{{end}}{{if .Traceback}}<h2>Traceback</h2>
+<pre>{{.Traceback}}</pre>
+{{end}}<h2>Request</h2>
+<table>
+<tr><th>ID</th><td>{{.Request.ID}}</td></tr>
+<tr><th>Method</th><td>{{.Request.Method}}</td></tr>
+<tr><th>URI</th><td>{{.Request.URI}}</td></tr>
+<tr><th>Remote address</th><td>{{.Request.RemoteAddr}}</td></tr>
+{{range $name, $values := .Request.Headers}}{{range $values}}<tr><th>{{$name}}</th><td>{{.}}</td></tr>
+{{end}}{{end}}</table>
+</body>
+</html>
+`))
+
+var productionErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>500 Internal Server Error</title></head>
+<body>
+<h1>Internal Server Error</h1>
+<p>The server encountered an error. Request ID: {{.}}</p>
+</body>
+</html>
+`))
+
+// DevErrorHandler is an ErrorHandler for development. It responds with the
+// error message, traceback, the source lines around the error (for file
+// chunks) and the request details, as JSON if the client accepts JSON and not
+// HTML, and as an HTML page otherwise. Do not use it in production: it exposes
+// the source and request headers.
+func DevErrorHandler(w http.ResponseWriter, req *GolapisRequest, err error) {
+	report := errorReport{
+		Status:  http.StatusInternalServerError,
+		Message: err.Error(),
+		Request: requestDetails{
+			ID:         req.RequestID(),
+			Method:     req.Request.Method,
+			URI:        req.Request.RequestURI,
+			RemoteAddr: req.Request.RemoteAddr,
+			Headers:    req.Request.Header,
+		},
+	}
+	var luaErr *LuaError
+	if errors.As(err, &luaErr) {
+		report.Message = luaErr.Message
+		report.Chunk = luaErr.Chunk
+		report.Line = luaErr.Line
+		report.Traceback = luaErr.Traceback
+		report.Frames = luaErr.Frames
+		report.Source = readSourceContext(luaErr.Chunk, luaErr.Line)
+	}
+
+	if wantsJSON(req.Request) {
+		writeJSONError(w, report.Status, report)
+		return
+	}
+	var buf bytes.Buffer
+	if err := devErrorTemplate.Execute(&buf, report); err != nil {
+		http.Error(w, report.Message, report.Status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(report.Status)
+	w.Write(buf.Bytes())
+}
+
+// ProductionErrorHandler is an ErrorHandler that logs the full error with the
+// request ID (golapis.var.request_id) and responds with a generic page that
+// only shows the ID, so errors reported by users can be found in the log.
+func ProductionErrorHandler(w http.ResponseWriter, req *GolapisRequest, err error) {
+	logRequestError(req, err)
+
+	status := http.StatusInternalServerError
+	if wantsJSON(req.Request) {
+		writeJSONError(w, status, map[string]string{
+			"error":      http.StatusText(status),
+			"request_id": req.RequestID(),
+		})
+		return
+	}
+	var buf bytes.Buffer
+	productionErrorTemplate.Execute(&buf, req.RequestID())
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// plainErrorHandler responds with the error message as plain text. It is
+// used when HTTPServerConfig.ErrorHandler is nil.
+func plainErrorHandler(w http.ResponseWriter, req *GolapisRequest, err error) {
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// logRequestError logs err for req, prefixed with the request ID
+func logRequestError(req *GolapisRequest, err error) {
+	log.Printf("[%s] %s %s: %v", req.RequestID(), req.Request.Method, req.Request.RequestURI, err)
+}
+
+// wantsJSON reports whether the client asked for JSON rather than HTML
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+func writeJSONError(w http.ResponseWriter, status int, v any) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+// readSourceContext returns the lines of the file chunk around line, or nil
+// if chunk is not a readable file (e.g. a [string "..."] chunk)
+func readSourceContext(chunk string, line int) []sourceLine {
+	if chunk == "" || line <= 0 || strings.HasPrefix(chunk, "[") || strings.HasPrefix(chunk, "...") {
+		return nil
+	}
+	data, err := os.ReadFile(chunk)
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(string(data), "\n")
+	if line > len(lines) {
+		return nil
+	}
+	first := max(line-sourceContextLines, 1)
+	last := min(line+sourceContextLines, len(lines))
+	var result []sourceLine
+	for n := first; n <= last; n++ {
+		result = append(result, sourceLine{
+			Line:    n,
+			Text:    strings.TrimRight(lines[n-1], "\r"),
+			Current: n == line,
+		})
+	}
+	return result
+}
+
+// handleRequestError writes the response for a request whose handler failed
+func (gls *GolapisLuaState) handleRequestError(w http.ResponseWriter, req *GolapisRequest, config *HTTPServerConfig, err error) {
+	if req.HeadersSent {
+		// Too late to change the response; the client gets what was written
+		logRequestError(req, err)
+		return
+	}
+	if page, ok := config.ErrorPages[http.StatusInternalServerError]; ok {
+		logRequestError(req, err)
+		gls.serveErrorPage(w, req, page, http.StatusInternalServerError)
+		return
+	}
+	handler := config.ErrorHandler
+	if handler == nil {
+		handler = plainErrorHandler
+	}
+	handler(w, req, err)
+}
+
+// serveErrorPage responds to req with page and status
+func (gls *GolapisLuaState) serveErrorPage(w http.ResponseWriter, req *GolapisRequest, page ErrorPage, status int) {
+	if page.Handler != "" {
+		// The handler starts from a clean response, like an nginx internal redirect
+		req.ResponseHeaders = make(http.Header)
+		req.ResponseStatus = status
+		resp := make(chan *StateResponse, 1)
+		gls.eventChan <- &StateEvent{
+			Type:         EventCall,
+			FuncName:     page.Handler,
+			ResumeValues: []interface{}{status},
+			OutputWriter: req.WrapResponseWriter(w),
+			Request:      req,
+			Context:      req.Request.Context(),
+			Response:     resp,
+		}
+		if result := <-resp; result.Error != nil {
+			logRequestError(req, result.Error)
+			if !req.HeadersSent {
+				http.Error(w, http.StatusText(status), status)
+			}
+			return
+		}
+		req.FlushHeaders(w)
+		return
+	}
+
+	data, err := os.ReadFile(page.File)
+	if err != nil {
+		log.Printf("error page for %d: %v", status, err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(page.File))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(data)
+}
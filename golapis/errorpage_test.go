@@ -0,0 +1,214 @@
+package golapis
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runLuaWithErrorConfig serves one request for entry through HTTPHandler
+// with config, sending the given Accept header
+func runLuaWithErrorConfig(t *testing.T, entry EntryPoint, config *HTTPServerConfig, accept string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+
+	if err := gls.LoadEntryPoint(entry); err != nil {
+		t.Fatalf("Failed to load entry point: %v", err)
+	}
+
+	gls.Start()
+	defer gls.Stop()
+
+	r := httptest.NewRequest("GET", "/items?id=1", nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	gls.HTTPHandler(config).ServeHTTP(w, r)
+	gls.Wait()
+	return w
+}
+
+// captureLog redirects the standard logger to a buffer for the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return buf
+}
+
+func TestErrorHandlerDefaultPlainText(t *testing.T) {
+	w := runLuaWithErrorConfig(t, CodeEntryPoint{Code: `error("boom")`}, nil, "")
+	if w.Code != 500 {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "boom") || !strings.Contains(body, "stack traceback:") {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestDevErrorHandlerHTML(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "app.lua")
+	code := "local x = 1\nlocal function fail()\n  error(\"<bad> input\")\nend\nfail()\n"
+	if err := os.WriteFile(script, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultHTTPServerConfig()
+	config.ErrorHandler = DevErrorHandler
+	w := runLuaWithErrorConfig(t, FileEntryPoint{Filename: script}, config, "text/html")
+
+	if w.Code != 500 {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"&lt;bad&gt; input",
+		`<span class="current">   3    error(&#34;&lt;bad&gt; input&#34;)</span>`,
+		"stack traceback:",
+		"/items?id=1",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected body to contain %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestDevErrorHandlerJSON(t *testing.T) {
+	config := DefaultHTTPServerConfig()
+	config.ErrorHandler = DevErrorHandler
+	w := runLuaWithErrorConfig(t, CodeEntryPoint{Code: "\nerror('boom')"}, config, "application/json")
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	var report errorReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, w.Body.String())
+	}
+	if report.Status != 500 || !strings.HasSuffix(report.Message, ":2: boom") || report.Line != 2 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if report.Source != nil {
+		t.Errorf("expected no source for a string chunk, got %v", report.Source)
+	}
+	if report.Request.Method != "GET" || report.Request.URI != "/items?id=1" || len(report.Request.ID) != 32 {
+		t.Errorf("unexpected request details %+v", report.Request)
+	}
+}
+
+func TestProductionErrorHandler(t *testing.T) {
+	logs := captureLog(t)
+
+	config := DefaultHTTPServerConfig()
+	config.ErrorHandler = ProductionErrorHandler
+	w := runLuaWithErrorConfig(t, CodeEntryPoint{Code: `
+		golapis.header["X-Secret"] = "1"
+		error("database password is hunter2")
+	`}, config, "")
+
+	if w.Code != 500 {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+	body := w.Body.String()
+	if strings.Contains(body, "hunter2") || w.Header().Get("X-Secret") != "" {
+		t.Errorf("response leaks the error: %q", body)
+	}
+	logged := logs.String()
+	if !strings.Contains(logged, "hunter2") || !strings.Contains(logged, "GET /items?id=1") {
+		t.Errorf("expected the error to be logged, got %q", logged)
+	}
+	start := strings.Index(logged, "[")
+	if start < 0 || len(logged) < start+33 {
+		t.Fatalf("no request ID in log %q", logged)
+	}
+	if id := logged[start+1 : start+33]; !strings.Contains(body, "Request ID: "+id) {
+		t.Errorf("expected request ID %s in body %q", id, body)
+	}
+}
+
+func TestErrorPagesStaticFile(t *testing.T) {
+	page := filepath.Join(t.TempDir(), "404.html")
+	if err := os.WriteFile(page, []byte("<h1>not here</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultHTTPServerConfig()
+	config.ErrorPages = map[int]ErrorPage{404: {File: page}}
+	w := runLuaWithErrorConfig(t, CodeEntryPoint{Code: `golapis.exit(404)`}, config, "")
+
+	if w.Code != 404 {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	if body := w.Body.String(); body != "<h1>not here</h1>" {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	// Responses with a body are left alone
+	w = runLuaWithErrorConfig(t, CodeEntryPoint{Code: `
+		golapis.status = 404
+		golapis.say("custom")
+	`}, config, "")
+	if w.Code != 404 || w.Body.String() != "custom\n" {
+		t.Errorf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestErrorPagesLuaHandler(t *testing.T) {
+	logs := captureLog(t)
+
+	config := DefaultHTTPServerConfig()
+	config.ErrorPages = map[int]ErrorPage{500: {Handler: "error_page"}}
+	w := runLuaWithErrorConfig(t, CodeEntryPoint{Code: `
+		function error_page(status)
+			golapis.header["Content-Type"] = "text/plain"
+			golapis.say("sorry ", status, " ", golapis.status, " ", golapis.var.request_uri)
+		end
+		golapis.header["X-Partial"] = "1"
+		error("boom")
+	`}, config, "")
+
+	if w.Code != 500 {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+	if body := w.Body.String(); body != "sorry 500 500 /items?id=1\n" {
+		t.Errorf("unexpected body %q", body)
+	}
+	if w.Header().Get("X-Partial") != "" || w.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("unexpected headers %v", w.Header())
+	}
+	if !strings.Contains(logs.String(), "boom") {
+		t.Errorf("expected the error to be logged, got %q", logs.String())
+	}
+}
+
+func TestReadSourceContext(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "app.lua")
+	if err := os.WriteFile(script, []byte("a\nb\nc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lines := readSourceContext(script, 1)
+	if len(lines) != 4 || !lines[0].Current || lines[1].Text != "b" || lines[3].Text != "" {
+		t.Errorf("unexpected lines %+v", lines)
+	}
+	if readSourceContext(`[string "a"]`, 1) != nil || readSourceContext(script, 10) != nil {
+		t.Error("expected no source")
+	}
+}
@@ -0,0 +1,391 @@
+package golapis
+
+/*
+#include "lua_helpers.h"
+
+extern int golapis_call_func(lua_State *L, int id);
+
+// Returned by golapis_call_func to raise the error message on the stack. Not
+// -1, which is what lua_yield returns for async functions.
+#define FUNC_RAISE_ERROR -2
+
+// Trampoline for functions registered with RegisterFunc. The function's id is
+// upvalue 1. Other results, including a yield, are returned unchanged.
+static int c_registered_func(lua_State *L) {
+    int result = golapis_call_func(L, (int)lua_tointeger(L, lua_upvalueindex(1)));
+    if (result == FUNC_RAISE_ERROR) {
+        return luaL_error(L, "%s", lua_tostring(L, -1));
+    }
+    return result;
+}
+
+static void push_registered_func(lua_State *L, int id) {
+    lua_pushinteger(L, id);
+    lua_pushcclosure(L, c_registered_func, 1);
+}
+
+// An async function resumes with true, values... or false, err. With
+// RaiseErrors it is wrapped in a Lua function that raises the error, since
+// the C function can't run again after it is resumed.
+static const char *raising_async_func_src =
+    "local raw = ...\n"
+    "local function check(ok, ...)\n"
+    "  if not ok then error((...), 0) end\n"
+    "  return ...\n"
+    "end\n"
+    "return function(...) return check(raw(...)) end\n";
+
+static int push_raising_async_func(lua_State *L, int id) {
+    if (luaL_loadstring(L, raising_async_func_src) != 0) {
+        return 0;
+    }
+    push_registered_func(L, id);
+    if (lua_pcall(L, 1, 1, 0) != 0) {
+        return 0;
+    }
+    return 1;
+}
+*/
+import "C"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// LuaArgs holds the arguments of a call from Lua, converted to Go values: nil,
+// bool, int64 (integral numbers), float64, string, []any (array tables) or
+// map[string]any (other tables). golapis.null converts to nil.
+type LuaArgs []any
+
+// LuaValues holds values returned to Lua. Supported values are nil, booleans,
+// numbers, strings, []byte, Null, structs (see Marshal), and slices and maps
+// of supported values.
+type LuaValues []any
+
+// GoFunc is a Go function callable from Lua, see RegisterFunc
+type GoFunc func(args LuaArgs) (LuaValues, error)
+
+// AsyncGoFunc is a Go function callable from Lua that runs without blocking
+// the Lua state, see RegisterAsyncFunc
+type AsyncGoFunc func(ctx context.Context, args LuaArgs) (LuaValues, error)
+
+// Get returns argument i (0-based), or nil if it wasn't passed
+func (a LuaArgs) Get(i int) any {
+	if i < 0 || i >= len(a) {
+		return nil
+	}
+	return a[i]
+}
+
+// String returns argument i if it is a string
+func (a LuaArgs) String(i int) (string, bool) {
+	s, ok := a.Get(i).(string)
+	return s, ok
+}
+
+// Number returns argument i as a float64 if it is a number
+func (a LuaArgs) Number(i int) (float64, bool) {
+	switch n := a.Get(i).(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// Int returns argument i if it is an integral number
+func (a LuaArgs) Int(i int) (int64, bool) {
+	n, ok := a.Get(i).(int64)
+	return n, ok
+}
+
+// Bool returns argument i if it is a boolean
+func (a LuaArgs) Bool(i int) (bool, bool) {
+	b, ok := a.Get(i).(bool)
+	return b, ok
+}
+
+// FuncOption configures a function registered with RegisterFunc
+type FuncOption func(*registeredFunc)
+
+// RaiseErrors makes a registered function raise its errors as Lua errors
+// instead of returning nil, err
+func RaiseErrors() FuncOption {
+	return func(f *registeredFunc) {
+		f.raise = true
+	}
+}
+
+type registeredFunc struct {
+	name  string
+	fn    GoFunc
+	async AsyncGoFunc
+	raise bool
+}
+
+// addRegisteredFunc stores f on the state and returns the id its closure
+// looks it up by
+func (gls *GolapisLuaState) addRegisteredFunc(f *registeredFunc) int {
+	gls.funcs = append(gls.funcs, f)
+	return len(gls.funcs) - 1
+}
+
+// getRegisteredFunc returns the function with the given id, or nil
+func (gls *GolapisLuaState) getRegisteredFunc(id int) *registeredFunc {
+	if id < 0 || id >= len(gls.funcs) {
+		return nil
+	}
+	return gls.funcs[id]
+}
+
+// RegisterFunc makes fn callable from Lua under name, a dotted path such as
+// "myapp.lookup" (a global table) or "golapis.lookup" (the golapis table).
+// Missing intermediate tables are created. Arguments are converted to Go
+// values (see LuaArgs) and the returned values are converted back to Lua.
+// When fn returns an error the Lua call returns nil, err, or raises it with
+// RaiseErrors. Call RegisterFunc before Start.
+func (gls *GolapisLuaState) RegisterFunc(name string, fn GoFunc, opts ...FuncOption) error {
+	if fn == nil {
+		return errors.New("RegisterFunc: fn must not be nil")
+	}
+	f := &registeredFunc{name: name, fn: fn}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return gls.registerFunc(f)
+}
+
+// RegisterAsyncFunc makes fn callable from Lua under name like RegisterFunc,
+// but fn runs on its own goroutine while the calling coroutine yields, so
+// other requests keep running. ctx is canceled when the calling request's
+// context ends (for example when the client disconnects) or when the Lua
+// thread finishes. Like golapis.sleep, async functions can only be called
+// from code running in a Lua thread.
+func (gls *GolapisLuaState) RegisterAsyncFunc(name string, fn AsyncGoFunc, opts ...FuncOption) error {
+	if fn == nil {
+		return errors.New("RegisterAsyncFunc: fn must not be nil")
+	}
+	f := &registeredFunc{name: name, async: fn}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return gls.registerFunc(f)
+}
+
+// registerFunc stores f and assigns its Lua closure to f.name
+func (gls *GolapisLuaState) registerFunc(f *registeredFunc) error {
+	parts := strings.Split(f.name, ".")
+	for _, part := range parts {
+		if part == "" {
+			return fmt.Errorf("invalid function name %q", f.name)
+		}
+	}
+
+	L := gls.luaState
+	top := C.lua_gettop(L)
+	defer C.lua_settop(L, top)
+
+	// Walk to the table that will hold the function
+	start := 0
+	if parts[0] == "golapis" && len(parts) > 1 {
+		C.lua_rawgeti_wrapper(L, C.LUA_REGISTRYINDEX, gls.golapisRef)
+		start = 1
+	} else {
+		C.lua_pushvalue(L, C.LUA_GLOBALSINDEX)
+	}
+	for _, part := range parts[start : len(parts)-1] {
+		pushGoString(L, part)
+		C.lua_rawget(L, -2)
+		switch C.lua_type(L, -1) {
+		case C.LUA_TTABLE:
+		case C.LUA_TNIL:
+			C.lua_pop_wrapper(L, 1)
+			C.lua_createtable(L, 0, 0)
+			pushGoString(L, part)
+			C.lua_pushvalue(L, -2)
+			C.lua_rawset(L, -4)
+		default:
+			return fmt.Errorf("cannot register %q: %q is not a table", f.name, part)
+		}
+		C.lua_remove(L, -2)
+	}
+
+	pushGoString(L, parts[len(parts)-1])
+	id := C.int(gls.addRegisteredFunc(f))
+	if f.async != nil && f.raise {
+		if C.push_raising_async_func(L, id) == 0 {
+			return fmt.Errorf("cannot register %q: %s", f.name, C.GoString(C.lua_tostring_wrapper(L, -1)))
+		}
+	} else {
+		C.push_registered_func(L, id)
+	}
+	C.lua_rawset(L, -3)
+	return nil
+}
+
+// luaArgs converts the arguments of the current call
+func luaArgs(L *C.lua_State, name string) (LuaArgs, error) {
+	n := int(C.lua_gettop(L))
+	args := make(LuaArgs, n)
+	for i := 0; i < n; i++ {
+		value, err := luaToGoValue(L, C.int(i+1), 0)
+		if err != nil {
+			return nil, fmt.Errorf("bad argument #%d to '%s' (%v)", i+1, name, err)
+		}
+		args[i] = value
+	}
+	return args, nil
+}
+
+// pushLuaValues pushes values, returning the number pushed. Nothing is left
+// on the stack if an error is returned.
+func pushLuaValues(L *C.lua_State, values LuaValues) (C.int, error) {
+	if C.lua_checkstack(L, C.int(len(values))) == 0 {
+		return 0, errors.New("too many return values")
+	}
+	for i, value := range values {
+		if err := pushGoValue(L, value); err != nil {
+			C.lua_pop_wrapper(L, C.int(i))
+			return 0, fmt.Errorf("bad return value #%d (%v)", i+1, err)
+		}
+	}
+	return C.int(len(values)), nil
+}
+
+// pushFuncError reports err from a registered function: nil, err, or
+// FUNC_RAISE_ERROR so the trampoline raises it
+func pushFuncError(L *C.lua_State, err error, raise bool) C.int {
+	if raise {
+		pushGoString(L, err.Error())
+		return C.FUNC_RAISE_ERROR
+	}
+	C.lua_pushnil(L)
+	pushGoString(L, err.Error())
+	return 2
+}
+
+// callGoFunc runs fn, turning a panic into an error
+func callGoFunc(fn GoFunc, args LuaArgs) (values LuaValues, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn(args)
+}
+
+// callAsyncGoFunc runs fn, turning a panic into an error
+func callAsyncGoFunc(ctx context.Context, fn AsyncGoFunc, args LuaArgs) (values LuaValues, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn(ctx, args)
+}
+
+// batchPusher pushes a value encoded ahead of time, off the Lua thread
+type batchPusher struct {
+	batch *LuaBatch
+}
+
+func (p batchPusher) PushToLua(L *C.lua_State) {
+	p.batch.Push(L)
+	ReleaseBatch(p.batch)
+}
+
+// asyncResumeValues converts the result of an async function to the values
+// its coroutine resumes with: true, values... or false, err in raise mode
+// (see push_raising_async_func), otherwise values... or nil, err
+func asyncResumeValues(f *registeredFunc, values LuaValues, err error) []interface{} {
+	var resume []interface{}
+	if err == nil {
+		resume = make([]interface{}, 0, len(values)+1)
+		if f.raise {
+			resume = append(resume, true)
+		}
+		for i, value := range values {
+			batch := AcquireBatch()
+			if encErr := encodeGoValue(batch, reflect.ValueOf(value), 0); encErr != nil {
+				ReleaseBatch(batch)
+				err = fmt.Errorf("%s: bad return value #%d (%v)", f.name, i+1, encErr)
+				break
+			}
+			resume = append(resume, batchPusher{batch})
+		}
+	}
+	if err != nil {
+		for _, v := range resume {
+			if p, ok := v.(batchPusher); ok {
+				ReleaseBatch(p.batch)
+			}
+		}
+		if f.raise {
+			return []interface{}{false, err.Error()}
+		}
+		return []interface{}{nil, err.Error()}
+	}
+	return resume
+}
+
+// callAsyncFunc starts an async function on its own goroutine and yields the
+// calling coroutine until it returns
+func callAsyncFunc(L *C.lua_State, f *registeredFunc) C.int {
+	thread := getLuaThreadFromRegistry(L)
+	if thread == nil {
+		return pushFuncError(L, fmt.Errorf("%s: could not find thread context", f.name), f.raise)
+	}
+	args, err := luaArgs(L, f.name)
+	if err != nil {
+		return pushFuncError(L, err, f.raise)
+	}
+	ctx := thread.context()
+
+	if debugEnabled {
+		debugLog("async func: co=%p calling %s", L, f.name)
+	}
+
+	go func() {
+		values, err := callAsyncGoFunc(ctx, f.async, args)
+		thread.state.eventChan <- &StateEvent{
+			Type:         EventResumeThread,
+			Thread:       thread,
+			ResumeValues: asyncResumeValues(f, values, err),
+		}
+	}()
+
+	return C.lua_yield_wrapper(L, 0)
+}
+
+//export golapis_call_func
+func golapis_call_func(L *C.lua_State, id C.int) C.int {
+	var f *registeredFunc
+	if gls := getLuaStateFromRegistry(L); gls != nil {
+		f = gls.getRegisteredFunc(int(id))
+	}
+	if f == nil {
+		pushGoString(L, "registered function not found")
+		return C.FUNC_RAISE_ERROR
+	}
+	if f.async != nil {
+		return callAsyncFunc(L, f)
+	}
+
+	args, err := luaArgs(L, f.name)
+	if err != nil {
+		return pushFuncError(L, err, f.raise)
+	}
+	values, err := callGoFunc(f.fn, args)
+	if err != nil {
+		return pushFuncError(L, err, f.raise)
+	}
+	n, err := pushLuaValues(L, values)
+	if err != nil {
+		return pushFuncError(L, fmt.Errorf("%s: %v", f.name, err), f.raise)
+	}
+	return n
+}
@@ -0,0 +1,301 @@
+package golapis
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runLuaWithFuncs runs code in a new state after setup has registered functions
+func runLuaWithFuncs(t *testing.T, setup func(gls *GolapisLuaState), code string) (string, error) {
+	t.Helper()
+
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+
+	buf := &bytes.Buffer{}
+	gls.SetOutputWriter(buf)
+	setup(gls)
+
+	gls.Start()
+	defer gls.Stop()
+
+	err := gls.RunString(code)
+	gls.Wait()
+	return buf.String(), err
+}
+
+func TestRegisterFunc(t *testing.T) {
+	output, err := runLuaWithFuncs(t, func(gls *GolapisLuaState) {
+		err := gls.RegisterFunc("myapp.users.lookup", func(args LuaArgs) (LuaValues, error) {
+			id, ok := args.Int(0)
+			if !ok {
+				return nil, errors.New("id must be an integer")
+			}
+			return LuaValues{map[string]any{"id": id, "tags": []string{"a", "b"}}, true}, nil
+		})
+		if err != nil {
+			t.Fatalf("RegisterFunc: %v", err)
+		}
+		err = gls.RegisterFunc("golapis.describe", func(args LuaArgs) (LuaValues, error) {
+			parts := make([]string, len(args))
+			for i, arg := range args {
+				switch v := arg.(type) {
+				case nil:
+					parts[i] = "nil"
+				case []any:
+					parts[i] = "array"
+				case map[string]any:
+					parts[i] = "map"
+				case string:
+					parts[i] = "string:" + v
+				case int64:
+					parts[i] = "int"
+				case float64:
+					parts[i] = "float"
+				case bool:
+					parts[i] = "bool"
+				}
+			}
+			return LuaValues{strings.Join(parts, ",")}, nil
+		})
+		if err != nil {
+			t.Fatalf("RegisterFunc: %v", err)
+		}
+	}, `
+		local user, ok = myapp.users.lookup(42)
+		golapis.say(user.id, " ", user.tags[1], user.tags[2], " ", ok)
+		golapis.say(myapp.users.lookup("x"))
+		golapis.say(golapis.describe("s", 1, 1.5, true, nil, { 1, 2 }, { a = 1 }, golapis.null))
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+
+	expected := "42 ab true\nnilid must be an integer\nstring:s,int,float,bool,nil,array,map,nil\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestRegisterFuncRaiseErrors(t *testing.T) {
+	output, err := runLuaWithFuncs(t, func(gls *GolapisLuaState) {
+		gls.RegisterFunc("strict", func(args LuaArgs) (LuaValues, error) {
+			return nil, errors.New("strict failure")
+		}, RaiseErrors())
+		gls.RegisterFunc("panics", func(args LuaArgs) (LuaValues, error) {
+			panic("boom")
+		})
+		gls.RegisterFunc("bad_return", func(args LuaArgs) (LuaValues, error) {
+			return LuaValues{"ok", make(chan int)}, nil
+		})
+	}, `
+		golapis.say(pcall(strict))
+		golapis.say(panics())
+		golapis.say(bad_return())
+		strict(print)
+	`)
+	if err == nil {
+		t.Fatal("expected error from uncaught strict call")
+	}
+	if !strings.Contains(err.Error(), "bad argument #1 to 'strict' (unsupported Lua type: function)") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	expected := "falsestrict failure\n" +
+		"nilpanic: boom\n" +
+		"nilbad_return: bad return value #2 (unsupported type: chan int)\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestRegisterFuncPerState(t *testing.T) {
+	for _, name := range []string{"first", "second"} {
+		output, err := runLuaWithFuncs(t, func(gls *GolapisLuaState) {
+			gls.RegisterFunc("whoami", func(args LuaArgs) (LuaValues, error) {
+				return LuaValues{name}, nil
+			})
+			if len(gls.funcs) != 1 {
+				t.Errorf("expected 1 function on the state, got %d", len(gls.funcs))
+			}
+		}, `golapis.say(whoami())`)
+		if err != nil {
+			t.Fatalf("Lua error: %v", err)
+		}
+		if output != name+"\n" {
+			t.Errorf("expected %q, got %q", name+"\n", output)
+		}
+	}
+}
+
+func TestRegisterFuncInvalidName(t *testing.T) {
+	gls := NewGolapisLuaState()
+	defer gls.Close()
+
+	noop := func(args LuaArgs) (LuaValues, error) { return nil, nil }
+	if err := gls.RegisterFunc("a..b", noop); err == nil {
+		t.Error("expected error for empty path segment")
+	}
+	if err := gls.RegisterFunc("string.format.x", noop); err == nil {
+		t.Error("expected error when a path segment is not a table")
+	}
+	if err := gls.RegisterFunc("ok", nil); err == nil {
+		t.Error("expected error for nil function")
+	}
+}
+
+func TestRegisterAsyncFunc(t *testing.T) {
+	output, err := runLuaWithFuncs(t, func(gls *GolapisLuaState) {
+		err := gls.RegisterAsyncFunc("db.query", func(ctx context.Context, args LuaArgs) (LuaValues, error) {
+			sql, _ := args.String(0)
+			time.Sleep(10 * time.Millisecond)
+			if sql == "" {
+				return nil, errors.New("empty query")
+			}
+			return LuaValues{[]map[string]any{{"id": 1, "sql": sql}}, 1}, nil
+		})
+		if err != nil {
+			t.Fatalf("RegisterAsyncFunc: %v", err)
+		}
+		gls.RegisterAsyncFunc("db.strict", func(ctx context.Context, args LuaArgs) (LuaValues, error) {
+			if n, _ := args.Int(0); n > 0 {
+				return LuaValues{"ok", n}, nil
+			}
+			return nil, errors.New("strict failure")
+		}, RaiseErrors())
+	}, `
+		local rows, count = db.query("select 1")
+		golapis.say(rows[1].id, " ", rows[1].sql, " ", count)
+		golapis.say(db.query(""))
+
+		local co = coroutine.create(function()
+			local rows = db.query("in coroutine")
+			coroutine.yield(rows[1].sql)
+			return "done"
+		end)
+		golapis.say(coroutine.resume(co))
+		golapis.say(coroutine.resume(co))
+
+		golapis.say(db.strict(2))
+		golapis.say(pcall(db.strict, 0))
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+
+	expected := "1 select 1 1\n" +
+		"nilempty query\n" +
+		"truein coroutine\n" +
+		"truedone\n" +
+		"ok2\n" +
+		"falsestrict failure\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestRegisterAsyncFuncYields(t *testing.T) {
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	for _, name := range []string{"fetch", "fetch_strict"} {
+		opts := []FuncOption{}
+		if name == "fetch_strict" {
+			opts = append(opts, RaiseErrors())
+		}
+		err := gls.RegisterAsyncFunc(name, func(ctx context.Context, args LuaArgs) (LuaValues, error) {
+			started <- struct{}{}
+			<-release
+			key, _ := args.String(0)
+			return LuaValues{key, 42, true}, nil
+		}, opts...)
+		if err != nil {
+			t.Fatalf("RegisterAsyncFunc: %v", err)
+		}
+	}
+
+	gls.Start()
+	defer gls.Stop()
+
+	for _, name := range []string{"fetch", "fetch_strict"} {
+		type result struct {
+			values []interface{}
+			err    error
+		}
+		done := make(chan result, 1)
+		go func() {
+			values, err := gls.Eval(context.Background(), `return `+name+`("key")`)
+			done <- result{values, err}
+		}()
+
+		<-started
+		// The calling thread has yielded, so the state runs other code
+		if _, err := gls.Eval(context.Background(), `return 1`); err != nil {
+			t.Fatalf("%s: Eval while waiting: %v", name, err)
+		}
+		release <- struct{}{}
+
+		r := <-done
+		if r.err != nil {
+			t.Fatalf("%s: Eval: %v", name, r.err)
+		}
+		expected := []interface{}{"key", int64(42), true}
+		if !reflect.DeepEqual(r.values, expected) {
+			t.Errorf("%s: expected %#v, got %#v", name, expected, r.values)
+		}
+	}
+}
+
+func TestRegisterAsyncFuncRequestAbort(t *testing.T) {
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+
+	gls.RegisterAsyncFunc("wait_forever", func(ctx context.Context, args LuaArgs) (LuaValues, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	gls.Start()
+	defer gls.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/test", nil).WithContext(ctx)
+	req := NewGolapisRequest(r)
+
+	resp := make(chan *StateResponse, 1)
+	gls.eventChan <- &StateEvent{
+		Type:         EventRunString,
+		Code:         `golapis.say(wait_forever())`,
+		OutputWriter: req.WrapResponseWriter(w),
+		Request:      req,
+		Response:     resp,
+	}
+
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if result := <-resp; result.Error != nil {
+		t.Fatalf("Lua error: %v", result.Error)
+	}
+	gls.Wait()
+
+	if body := w.Body.String(); body != "nilcontext canceled\n" {
+		t.Errorf("expected canceled result, got %q", body)
+	}
+}
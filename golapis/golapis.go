@@ -22,11 +22,80 @@ static int panic_handler(lua_State *L) {
     return 0;
 }
 
-static lua_State* new_lua_state() {
+// Optional libraries, matching the LuaLib constants
+#define GOLAPIS_LIB_IO    1
+#define GOLAPIS_LIB_OS    2
+#define GOLAPIS_LIB_FFI   4
+#define GOLAPIS_LIB_DEBUG 8
+#define GOLAPIS_LIB_JIT   16
+
+static void open_lib(lua_State *L, const char *name, lua_CFunction open) {
+    lua_pushcfunction(L, open);
+    lua_pushstring(L, name);
+    lua_call(L, 1, 0);
+}
+
+// Removes the global name and package.loaded[name]
+static void hide_lib(lua_State *L, const char *name) {
+    lua_pushnil(L);
+    lua_setglobal(L, name);
+    lua_getfield(L, LUA_REGISTRYINDEX, "_LOADED");
+    lua_pushnil(L);
+    lua_setfield(L, -2, name);
+    lua_pop(L, 1);
+}
+
+// Sets package.preload[name], or clears it when open is NULL
+static void set_preload(lua_State *L, const char *name, lua_CFunction open) {
+    lua_getglobal(L, "package");
+    lua_getfield(L, -1, "preload");
+    if (open != NULL) {
+        lua_pushcfunction(L, open);
+    } else {
+        lua_pushnil(L);
+    }
+    lua_setfield(L, -2, name);
+    lua_pop(L, 2);
+}
+
+static lua_State* new_lua_state(int libs) {
     lua_State *L = luaL_newstate();
-    if (L) {
-        lua_atpanic(L, panic_handler);
-        luaL_openlibs(L);
+    if (!L) {
+        return NULL;
+    }
+    lua_atpanic(L, panic_handler);
+
+    open_lib(L, "", luaopen_base);
+    open_lib(L, LUA_LOADLIBNAME, luaopen_package);
+    open_lib(L, LUA_TABLIBNAME, luaopen_table);
+    open_lib(L, LUA_STRLIBNAME, luaopen_string);
+    open_lib(L, LUA_MATHLIBNAME, luaopen_math);
+    open_lib(L, LUA_BITLIBNAME, luaopen_bit);
+    if (libs & GOLAPIS_LIB_IO) {
+        open_lib(L, LUA_IOLIBNAME, luaopen_io);
+    }
+    if (libs & GOLAPIS_LIB_OS) {
+        open_lib(L, LUA_OSLIBNAME, luaopen_os);
+    }
+
+    // debug and jit are always opened: error tracebacks use debug.traceback,
+    // and opening jit starts the compiler. They are hidden afterwards.
+    open_lib(L, LUA_DBLIBNAME, luaopen_debug);
+    lua_getglobal(L, LUA_DBLIBNAME);
+    lua_getfield(L, -1, "traceback");
+    lua_setfield(L, LUA_REGISTRYINDEX, GOLAPIS_TRACEBACK_KEY);
+    lua_pop(L, 1);
+    if (!(libs & GOLAPIS_LIB_DEBUG)) {
+        hide_lib(L, LUA_DBLIBNAME);
+    }
+    open_lib(L, LUA_JITLIBNAME, luaopen_jit);
+    if (!(libs & GOLAPIS_LIB_JIT)) {
+        hide_lib(L, LUA_JITLIBNAME);
+        set_preload(L, "jit.util", NULL);
+        set_preload(L, "jit.profile", NULL);
+    }
+    if (libs & GOLAPIS_LIB_FFI) {
+        set_preload(L, LUA_FFILIBNAME, luaopen_ffi);
     }
     return L;
 }
@@ -50,12 +119,12 @@ import "C"
 import (
 	"bytes"
 	"container/list"
+	"context"
 	_ "embed"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -75,12 +144,14 @@ type GolapisLuaState struct {
 	luaState      *C.lua_State
 	golapisRef    C.int // registry reference to golapis table
 	entrypointRef C.int // registry reference to loaded entrypoint function (0 = not set)
+	sandboxRef    C.int // registry reference to the sandbox environment constructor (0 = no sandbox)
 	outputBuffer  *bytes.Buffer
 	outputWriter  io.Writer
 	// Note: sends from the event loop goroutine can block if this buffer is full;
 	// use a non-blocking send with a goroutine fallback in that case.
 	eventChan chan *StateEvent // all operations go through this channel
 	running   bool             // is event loop running?
+	loopDone  chan struct{}    // closed when the event loop exits
 	threadWg  sync.WaitGroup   // tracks active threads for Wait()
 	stopping  atomic.Bool      // true when event loop is stopping
 
@@ -94,6 +165,11 @@ type GolapisLuaState struct {
 	tcpPoolsClosed bool // set during drain; rejects new inserts
 
 	httpMux *http.ServeMux // HTTP mux for internal routing (used by location.capture)
+
+	allocState unsafe.Pointer   // memory limit allocator state (nil = no limit)
+	limits     *executionLimits // instruction and time limits (nil = none)
+
+	funcs []*registeredFunc // functions from RegisterFunc, indexed by their closure's id
 }
 
 // PendingTimer represents a scheduled timer waiting to fire
@@ -123,6 +199,8 @@ const (
 	EventRunFile StateEventType = iota
 	EventRunString
 	EventRunEntryPoint // run the loaded entrypoint
+	EventCall          // call a Lua function by name
+	EventAbortThread   // a thread's context ended, abort it
 	EventResumeThread  // async operation completed
 	EventTimerFire     // timer expired, execute callback
 	EventStop          // shutdown the event loop
@@ -133,10 +211,17 @@ type StateEvent struct {
 	Type StateEventType
 
 	// For RunFile/RunString
-	Filename     string
-	Code         string
-	OutputWriter io.Writer       // output destination for this request (e.g., http.ResponseWriter)
-	Request      *GolapisRequest // Request context for this event (nil in CLI mode)
+	Filename      string
+	Code          string
+	OutputWriter  io.Writer       // output destination for this request (e.g., http.ResponseWriter)
+	Request       *GolapisRequest // Request context for this event (nil in CLI mode)
+	StreamRequest *StreamRequest  // Stream session for this event (nil outside stream mode)
+
+	// For the Context variants of the run methods, Call and Eval
+	FuncName      string          // dotted path of the function to call
+	Context       context.Context // aborts the thread when done; passed to async Go functions
+	ReturnResults bool            // convert the thread's return values for the response
+	Sandboxed     bool            // run Code in a new sandbox environment
 
 	// For ResumeThread (async completion)
 	Thread       *LuaThread
@@ -160,21 +245,12 @@ type StateResponse struct {
 
 // NewGolapisLuaState creates a new Lua state and initializes it with golapis functions
 func NewGolapisLuaState() *GolapisLuaState {
-	L := C.new_lua_state()
-	if L == nil {
-		return nil
-	}
-	gls := &GolapisLuaState{
-		luaState:      L,
-		outputBuffer:  &bytes.Buffer{},
-		outputWriter:  os.Stdout,
-		eventChan:     make(chan *StateEvent, 100), // buffered channel for events
-		pendingTimers: make(map[*PendingTimer]struct{}),
-		tcpPools:      make(map[string]*tcpPool),
-	}
-	gls.registerState()
-	gls.SetupGolapis()
-	return gls
+	return NewGolapisLuaStateWithOptions(DefaultOptions())
+}
+
+// newLuaState creates a lua_State with the always-open libraries and libs
+func newLuaState(libs LuaLib) *C.lua_State {
+	return C.new_lua_state(C.int(libs))
 }
 
 // Close closes the Lua state and frees its resources
@@ -191,10 +267,17 @@ func (gls *GolapisLuaState) Close() {
 			C.luaL_unref_wrapper(gls.luaState, C.LUA_REGISTRYINDEX, gls.entrypointRef)
 			gls.entrypointRef = 0
 		}
+		if gls.sandboxRef != 0 {
+			C.luaL_unref_wrapper(gls.luaState, C.LUA_REGISTRYINDEX, gls.sandboxRef)
+			gls.sandboxRef = 0
+		}
 		gls.unregisterState()
+		gls.funcs = nil
+		gls.restoreAllocator()
 		C.lua_close(gls.luaState)
 		C.flush_stdout() // Go exit doesn't flush C stdout buffers
 		gls.luaState = nil
+		gls.freeAllocState()
 	}
 }
 
@@ -230,6 +313,7 @@ func (gls *GolapisLuaState) Start() {
 	gls.tcpPoolsClosed = false
 	gls.tcpPoolsMu.Unlock()
 	gls.running = true
+	gls.loopDone = make(chan struct{})
 	go gls.eventLoop()
 }
 
@@ -290,47 +374,71 @@ func (gls *GolapisLuaState) Wait() {
 // RunFile sends a request to execute a Lua file.
 // The args are passed to the chunk and become available as ... in the script.
 func (gls *GolapisLuaState) RunFile(filename string, args []string) error {
-	resp := make(chan *StateResponse, 1)
+	return gls.RunFileContext(context.Background(), filename, args)
+}
 
+// RunFileContext is like RunFile, but aborts the script when ctx ends, see
+// RunStringContext
+func (gls *GolapisLuaState) RunFileContext(ctx context.Context, filename string, args []string) error {
 	// Convert args to []interface{} for ResumeValues
 	var initArgs []interface{}
 	for _, arg := range args {
 		initArgs = append(initArgs, arg)
 	}
 
-	gls.eventChan <- &StateEvent{
+	return gls.runContext(ctx, &StateEvent{
 		Type:         EventRunFile,
 		Filename:     filename,
 		ResumeValues: initArgs,
-		Response:     resp,
-	}
-	result := <-resp
-	return result.Error
+	})
 }
 
 // RunString sends a request to execute a Lua code string
 func (gls *GolapisLuaState) RunString(code string) error {
-	resp := make(chan *StateResponse, 1)
-	gls.eventChan <- &StateEvent{
-		Type:     EventRunString,
-		Code:     code,
-		Response: resp,
-	}
-	result := <-resp
-	return result.Error
+	return gls.RunStringContext(context.Background(), code)
+}
+
+// RunStringContext is like RunString, but aborts the Lua thread when ctx is
+// canceled or its deadline passes. Lua code can't be interrupted while it
+// runs, so the thread is aborted at its next yield point: pending sleeps and
+// async Go functions are abandoned, and sockets and HTTP requests made by the
+// thread are interrupted. The error is then ctx.Err().
+func (gls *GolapisLuaState) RunStringContext(ctx context.Context, code string) error {
+	return gls.runContext(ctx, &StateEvent{
+		Type: EventRunString,
+		Code: code,
+	})
 }
 
 // RunEntryPoint executes the loaded entry point with optional arguments.
 // Arguments are passed to the Lua chunk and become available as ... in the script.
 // Use LoadEntryPoint to compile the code first.
 func (gls *GolapisLuaState) RunEntryPoint(args ...interface{}) error {
-	resp := make(chan *StateResponse, 1)
-	gls.eventChan <- &StateEvent{
+	return gls.RunEntryPointContext(context.Background(), args...)
+}
+
+// RunEntryPointContext is like RunEntryPoint, but aborts the entry point when
+// ctx ends, see RunStringContext
+func (gls *GolapisLuaState) RunEntryPointContext(ctx context.Context, args ...interface{}) error {
+	return gls.runContext(ctx, &StateEvent{
 		Type:         EventRunEntryPoint,
 		ResumeValues: args,
-		Response:     resp,
+	})
+}
+
+// runContext sends event with ctx and waits for the thread it starts to finish
+func (gls *GolapisLuaState) runContext(ctx context.Context, event *StateEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	event.Context = ctx
+	event.Response = make(chan *StateResponse, 1)
+	select {
+	case gls.eventChan <- event:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	result := <-resp
+	result := <-event.Response
 	return result.Error
 }
 
@@ -351,6 +459,10 @@ func (gls *GolapisLuaState) eventLoop() {
 			resp = gls.handleRunString(event)
 		case EventRunEntryPoint:
 			resp = gls.handleRunEntryPoint(event)
+		case EventCall:
+			resp = gls.handleCall(event)
+		case EventAbortThread:
+			gls.handleAbortThread(event)
 		case EventResumeThread:
 			resp = gls.handleResumeThread(event)
 		case EventTimerFire:
@@ -365,6 +477,7 @@ func (gls *GolapisLuaState) eventLoop() {
 			}
 			gls.pendingTimers = make(map[*PendingTimer]struct{})
 			gls.timerMu.Unlock()
+			close(gls.loopDone)
 
 			if event.Response != nil {
 				event.Response <- &StateResponse{}
@@ -396,6 +509,8 @@ func (gls *GolapisLuaState) handleRunFile(event *StateEvent) *StateResponse {
 	thread.responseChan = event.Response
 	thread.outputWriter = event.OutputWriter
 	thread.setRequest(event.Request)
+	thread.stream = event.StreamRequest
+	thread.setEventOptions(event)
 
 	if err := thread.resume(event.ResumeValues); err != nil {
 		thread.close()
@@ -432,6 +547,8 @@ func (gls *GolapisLuaState) handleRunEntryPoint(event *StateEvent) *StateRespons
 	thread.responseChan = event.Response
 	thread.outputWriter = event.OutputWriter
 	thread.setRequest(event.Request)
+	thread.stream = event.StreamRequest
+	thread.setEventOptions(event)
 
 	if err := thread.resume(event.ResumeValues); err != nil {
 		thread.close()
@@ -451,7 +568,11 @@ func (gls *GolapisLuaState) handleRunEntryPoint(event *StateEvent) *StateRespons
 
 // handleRunString executes a Lua code string (internal, called by event loop)
 func (gls *GolapisLuaState) handleRunString(event *StateEvent) *StateResponse {
-	if err := gls.loadString(event.Code); err != nil {
+	load := gls.loadString
+	if event.Sandboxed {
+		load = func(code string) error { return gls.loadSandboxed(code, code) }
+	}
+	if err := load(event.Code); err != nil {
 		return &StateResponse{Error: err}
 	}
 
@@ -464,6 +585,8 @@ func (gls *GolapisLuaState) handleRunString(event *StateEvent) *StateResponse {
 	thread.responseChan = event.Response
 	thread.outputWriter = event.OutputWriter
 	thread.setRequest(event.Request)
+	thread.stream = event.StreamRequest
+	thread.setEventOptions(event)
 
 	if err := thread.resume(nil); err != nil {
 		thread.close()
@@ -491,27 +614,43 @@ func (gls *GolapisLuaState) handleResumeThread(event *StateEvent) *StateResponse
 		event.OnResume(event)
 	}
 
+	if thread.co == nil {
+		// Thread already closed while the operation was pending
+		return nil
+	}
+	if err := thread.abortErr(); err != nil {
+		// The thread's context ended while it was waiting
+		thread.abort(err)
+		return nil
+	}
+
 	if err := thread.resume(event.ResumeValues); err != nil {
 		// Send error to the original caller
-		if thread.responseChan != nil {
-			thread.responseChan <- &StateResponse{Error: err}
-		}
-		thread.close()
+		thread.finish(&StateResponse{Error: err})
 		return nil
 	}
 
 	if thread.status == ThreadDead || thread.status == ThreadExited {
 		// Thread completed or exited - send success to the original caller
-		if thread.responseChan != nil {
-			thread.responseChan <- &StateResponse{Thread: thread}
-		}
-		thread.close()
+		thread.finish(&StateResponse{Thread: thread})
 	}
 
 	// Response sent via thread.responseChan, not through event.Response
 	return nil
 }
 
+// handleAbortThread aborts a thread whose context ended while it was
+// yielded. The event is ignored if the thread finished first.
+func (gls *GolapisLuaState) handleAbortThread(event *StateEvent) {
+	thread := event.Thread
+	if thread.co == nil {
+		return
+	}
+	if err := thread.abortErr(); err != nil {
+		thread.abort(err)
+	}
+}
+
 // handleTimerFire executes a timer callback in a new thread context
 func (gls *GolapisLuaState) handleTimerFire(event *StateEvent) {
 	timer := event.Timer
@@ -562,6 +701,7 @@ func (gls *GolapisLuaState) handleTimerFire(event *StateEvent) {
 	thread.curCo = entry
 	thread.coCtxByState[co] = entry
 	luaThreadMap[co] = thread
+	thread.setEventOptions(event)
 
 	if debugEnabled {
 		debugLog("handleTimerFire: co=%p premature=%v nargs=%d", co, event.Premature, nargs)
@@ -612,7 +752,7 @@ func (gls *GolapisLuaState) loadString(code string) error {
 	if result != 0 {
 		errMsg := C.GoString(C.lua_tostring_wrapper(gls.luaState, -1))
 		C.pop_stack(gls.luaState, 1)
-		return errors.New(errMsg)
+		return newLuaSyntaxError(errMsg)
 	}
 	return nil
 }
@@ -631,7 +771,7 @@ func (gls *GolapisLuaState) loadFile(filename string) error {
 	if result != 0 {
 		errMsg := C.GoString(C.lua_tostring_wrapper(gls.luaState, -1))
 		C.pop_stack(gls.luaState, 1)
-		return errors.New(errMsg)
+		return newLuaSyntaxError(errMsg)
 	}
 	return nil
 }
@@ -12,6 +12,7 @@ import (
 	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -36,16 +37,24 @@ type FileServerMapping struct {
 
 // HTTPServerConfig holds configuration for the HTTP server
 type HTTPServerConfig struct {
-	ClientMaxBodySize int64               // max request body size in bytes (0 = unlimited)
-	NgxAlias          bool                // alias golapis table to global ngx
-	FileServers       []FileServerMapping // static file server mappings
-	ReadHeaderTimeout time.Duration       // max time to read request headers
-	ReadTimeout       time.Duration       // max time to read the full request
-	WriteTimeout      time.Duration       // max time to write the response
-	IdleTimeout       time.Duration       // max keep-alive idle time
-	ShutdownTimeout   time.Duration       // max graceful shutdown wait
-	MaxHeaderBytes    int                 // max request header size
-	TrustProxyHeaders bool                // trust X-Forwarded-For for request logs
+	ClientMaxBodySize    int64               // max request body size in bytes (0 = unlimited)
+	ClientBodyBufferSize int64               // bodies above this size are spooled to disk (0 = always in memory, the default)
+	ClientBodyTempPath   string              // directory for spooled bodies and uploads ("" = os.TempDir())
+	NgxAlias             bool                // alias golapis table to global ngx
+	FileServers          []FileServerMapping // static file server mappings
+	ReadHeaderTimeout    time.Duration       // max time to read request headers
+	ReadTimeout          time.Duration       // max time to read the full request
+	WriteTimeout         time.Duration       // max time to write the response
+	IdleTimeout          time.Duration       // max keep-alive idle time
+	ShutdownTimeout      time.Duration       // max graceful shutdown wait
+	MaxHeaderBytes       int                 // max request header size
+	ServerName           string              // value of golapis.var.server_name
+	Variables            map[string]string   // user-defined golapis.var variables and their defaults (like nginx "set")
+	AccessLogFormat      string              // access log format with $var interpolation ("" = combined format)
+	TrustProxyHeaders    bool                // trust X-Forwarded-For for request logs
+	PreserveRawHeaders   bool                // record original header blocks for golapis.req.raw_header (see RawHeaderListener)
+	ErrorHandler         ErrorHandler        // renders requests whose handler raised an error (nil = plain text message)
+	ErrorPages           map[int]ErrorPage   // responses for error statuses set without a body, like nginx error_page
 }
 
 // DefaultHTTPServerConfig returns the default HTTP server configuration.
@@ -94,8 +103,37 @@ func normalizeHTTPServerConfig(config *HTTPServerConfig) *HTTPServerConfig {
 func (gls *GolapisLuaState) HTTPHandler(config *HTTPServerConfig) http.Handler {
 	config = normalizeHTTPServerConfig(config)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		req := NewGolapisRequest(r)
+		req, prepared := r.Context().Value(golapisRequestKey{}).(*GolapisRequest)
+		if prepared {
+			req.Request = r
+		} else {
+			req = NewGolapisRequest(r)
+		}
 		req.maxBodySize = config.ClientMaxBodySize
+		req.bodyBufferSize = config.ClientBodyBufferSize
+		req.bodyTempPath = config.ClientBodyTempPath
+		req.serverName = config.ServerName
+		if conn, ok := r.Context().Value(httpConnContextKey{}).(*httpConnInfo); ok {
+			req.connID = conn.id
+			req.connRequests = atomic.AddUint64(&conn.requests, 1)
+			if conn.raw != nil && r.ProtoMajor == 1 {
+				req.rawHeaderData = conn.raw.takeHeader(r.Method + " " + r.RequestURI + " ")
+				defer conn.raw.resume()
+			}
+		}
+		req.internal, _ = r.Context().Value(internalRequestKey{}).(bool)
+		vars := newRequestVars(config.Variables)
+		for name, value := range req.vars {
+			vars[name] = value // set by middleware through PrepareRequest
+		}
+		req.vars = vars
+		if sv, ok := r.Context().Value(subrequestVarsKey{}).(*subrequestVars); ok {
+			req.applySubrequestVars(sv)
+		}
+		if record, ok := r.Context().Value(accessLogKey{}).(*accessLogRecord); ok {
+			record.req = req
+		}
+		defer req.Cleanup()
 		wrappedWriter := req.WrapResponseWriter(w)
 
 		resp := make(chan *StateResponse, 1)
@@ -103,18 +141,81 @@ func (gls *GolapisLuaState) HTTPHandler(config *HTTPServerConfig) http.Handler {
 			Type:         EventRunEntryPoint,
 			OutputWriter: wrappedWriter,
 			Request:      req,
+			Context:      r.Context(), // client disconnects abort the handler
 			Response:     resp,
 		}
 
 		result := <-resp
+		if req.Hijacked() {
+			// Lua owns the raw connection; nothing more can be written through w
+			req.CloseHijacked()
+			return
+		}
 		if result.Error != nil {
-			http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+			gls.handleRequestError(w, req, config, result.Error)
 			return
 		}
+		if req.ResponseStatus >= 400 && !req.HeadersSent {
+			if page, ok := config.ErrorPages[req.ResponseStatus]; ok {
+				gls.serveErrorPage(w, req, page, req.ResponseStatus)
+				return
+			}
+		}
 		req.FlushHeaders(w)
 	})
 }
 
+// httpConnContextKey is the context key for per-connection info
+type httpConnContextKey struct{}
+
+// httpConnInfo tracks a client connection for $connection and $connection_requests
+type httpConnInfo struct {
+	id       uint64
+	requests uint64         // accessed atomically
+	raw      *rawHeaderConn // set when the listener records raw headers
+}
+
+// internalRequestKey is the context key marking location.capture subrequests
+type internalRequestKey struct{}
+
+var httpConnIDSeq uint64
+
+// HTTPConnContext assigns a serial number to each accepted connection so
+// golapis.var.connection and connection_requests work. StartHTTPServer installs
+// it automatically; when serving HTTPHandler from your own http.Server, set it
+// as the server's ConnContext.
+func HTTPConnContext(ctx context.Context, c net.Conn) context.Context {
+	info := &httpConnInfo{id: atomic.AddUint64(&httpConnIDSeq, 1)}
+	if raw, ok := c.(*rawHeaderConn); ok {
+		info.raw = raw
+	}
+	return context.WithValue(ctx, httpConnContextKey{}, info)
+}
+
+// golapisRequestKey is the context key for a GolapisRequest created by PrepareRequest
+type golapisRequestKey struct{}
+
+// PrepareRequest creates the GolapisRequest that HTTPHandler will use for r,
+// so Go middleware can inject values with SetVar and SetCtx before calling the
+// handler with the returned request, and read them back with GetVar and GetCtx
+// after it returns. If r was already prepared, it returns the existing one.
+//
+//	r, greq := golapis.PrepareRequest(r)
+//	greq.SetVar("user_id", userID)
+//	greq.SetCtx("user", map[string]any{"id": userID, "roles": roles})
+//	next.ServeHTTP(w, r)
+//	result, _ := greq.GetCtx("result")
+func PrepareRequest(r *http.Request) (*http.Request, *GolapisRequest) {
+	if req, ok := r.Context().Value(golapisRequestKey{}).(*GolapisRequest); ok {
+		return r, req
+	}
+	req := NewGolapisRequest(r)
+	req.captureCtx = true
+	r = r.WithContext(context.WithValue(r.Context(), golapisRequestKey{}, req))
+	req.Request = r
+	return r, req
+}
+
 // StartHTTPServer starts an HTTP server that executes the given Lua script for each request
 // Uses a single shared GolapisLuaState for all requests with cooperative scheduling
 func StartHTTPServer(entry EntryPoint, port string, config *HTTPServerConfig) {
@@ -168,17 +269,26 @@ func StartHTTPServer(entry EntryPoint, port string, config *HTTPServerConfig) {
 	var requestWg sync.WaitGroup
 	server := &http.Server{
 		Addr:              ":" + port,
-		Handler:           logHTTPRequests(mux, config.TrustProxyHeaders, &requestWg),
+		Handler:           logHTTPRequestsWithFormat(mux, config.AccessLogFormat, config.TrustProxyHeaders, &requestWg),
 		ReadHeaderTimeout: config.ReadHeaderTimeout,
 		ReadTimeout:       config.ReadTimeout,
 		WriteTimeout:      config.WriteTimeout,
 		IdleTimeout:       config.IdleTimeout,
 		MaxHeaderBytes:    config.MaxHeaderBytes,
+		ConnContext:       HTTPConnContext,
 	}
 	shutdownStarted, shutdownDone := setupGracefulShutdown(server, config.ShutdownTimeout)
 
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.PreserveRawHeaders {
+		ln = RawHeaderListener(ln, config.MaxHeaderBytes)
+	}
+
 	fmt.Printf("Listening on http://localhost:%s\n", port)
-	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+	if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
 	}
 	gracefulShutdown := false
@@ -283,6 +393,12 @@ func (w *responseStatsWriter) Status() int {
 }
 
 func logHTTPRequests(next http.Handler, trustProxyHeaders bool, requestWg *sync.WaitGroup) http.Handler {
+	return logHTTPRequestsWithFormat(next, "", trustProxyHeaders, requestWg)
+}
+
+// logHTTPRequestsWithFormat logs each request using format (see formatAccessLog),
+// or the combined log format if format is empty.
+func logHTTPRequestsWithFormat(next http.Handler, format string, trustProxyHeaders bool, requestWg *sync.WaitGroup) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if requestWg != nil {
 			requestWg.Add(1)
@@ -290,8 +406,15 @@ func logHTTPRequests(next http.Handler, trustProxyHeaders bool, requestWg *sync.
 		}
 		startTime := time.Now()
 		statsWriter := newResponseStatsWriter(w)
+		if format == "" {
+			next.ServeHTTP(statsWriter, r)
+			logHTTPRequest(r, startTime, statsWriter.Status(), statsWriter.bodyBytes, trustProxyHeaders)
+			return
+		}
+
+		r, record := withAccessLogRecord(r)
 		next.ServeHTTP(statsWriter, r)
-		logHTTPRequest(r, startTime, statsWriter.Status(), statsWriter.bodyBytes, trustProxyHeaders)
+		log.Print(formatAccessLog(format, r, record.req, startTime, statsWriter.Status(), statsWriter.bodyBytes, trustProxyHeaders))
 	})
 }
 
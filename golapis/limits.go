@@ -0,0 +1,185 @@
+package golapis
+
+/*
+#include "lua_helpers.h"
+#include "../luajit/src/luajit.h"
+
+extern int golapis_limit_hook(lua_State *L);
+
+// Results of golapis_limit_hook
+#define LIMIT_OK    0
+#define LIMIT_RAISE 1 // raise the error message on top of the stack
+#define LIMIT_KILL  2 // raise it on every instruction until the thread ends
+
+static void limit_hook(lua_State *L, lua_Debug *ar);
+
+// Compiled code doesn't run count hooks, so the JIT compiler is turned off
+static void set_limit_hook(lua_State *L, int interval) {
+    luaJIT_setmode(L, 0, LUAJIT_MODE_ENGINE | LUAJIT_MODE_OFF);
+    lua_sethook(L, limit_hook, LUA_MASKCOUNT, interval);
+}
+
+static void limit_hook(lua_State *L, lua_Debug *ar) {
+    (void)ar;
+    switch (golapis_limit_hook(L)) {
+    case LIMIT_RAISE:
+        lua_error(L);
+        break;
+    case LIMIT_KILL:
+        // Yielding fails inside callbacks from C functions such as
+        // string.gsub, so the error is raised again on every instruction
+        // instead: pcall and error handlers can't make progress, and it
+        // unwinds to the top of the coroutine
+        set_limit_hook(L, 1);
+        lua_error(L);
+        break;
+    }
+}
+
+// Pushes "chunk:line:" for the running Lua function, or "" if unknown
+static void push_where(lua_State *L) {
+    luaL_where(L, 0);
+}
+*/
+import "C"
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// Errors for the execution limits in Options. Threads that exceed a limit
+// fail with an error that matches one of these with errors.Is.
+var (
+	ErrInstructionLimit = errors.New("instruction limit exceeded")
+	ErrResumeTimeLimit  = errors.New("resume time limit exceeded")
+	ErrRunTimeLimit     = errors.New("run time limit exceeded")
+)
+
+// limitHookInterval is the number of instructions between limit checks
+const limitHookInterval = 1000
+
+// limitKillGrace is the number of further checks a thread gets to unwind
+// after a limit error is raised before it is killed
+const limitKillGrace = 10
+
+// executionLimits holds the limits from Options
+type executionLimits struct {
+	maxInstructions int64
+	maxResumeTime   time.Duration
+	maxRunTime      time.Duration
+	interval        int64 // instructions between hook calls
+}
+
+// setupLimits installs the count hook that enforces the limits in opts
+func (gls *GolapisLuaState) setupLimits(opts Options) {
+	if opts.MaxInstructions <= 0 && opts.MaxResumeTime <= 0 && opts.MaxRunTime <= 0 {
+		return
+	}
+	interval := int64(limitHookInterval)
+	if opts.MaxInstructions > 0 && opts.MaxInstructions < interval {
+		interval = opts.MaxInstructions
+	}
+	gls.limits = &executionLimits{
+		maxInstructions: opts.MaxInstructions,
+		maxResumeTime:   opts.MaxResumeTime,
+		maxRunTime:      opts.MaxRunTime,
+		interval:        interval,
+	}
+	C.set_limit_hook(gls.luaState, C.int(interval))
+}
+
+//export golapis_limit_hook
+func golapis_limit_hook(L *C.lua_State) C.int {
+	thread := getLuaThreadFromRegistry(L)
+	if thread == nil || thread.state.limits == nil {
+		return C.LIMIT_OK // not running in a thread, e.g. state setup
+	}
+	return thread.checkLimits(L)
+}
+
+// checkLimits is called by the count hook while the thread runs. The first
+// time a limit is exceeded it raises a Lua error, which pcall can catch. If
+// the thread is still running limitKillGrace checks later, it is killed: the
+// error is raised on every instruction until the thread ends.
+func (t *LuaThread) checkLimits(L *C.lua_State) C.int {
+	limits := t.state.limits
+	t.instructions += limits.interval
+
+	if t.limitKilled {
+		pushGoString(L, t.limitWhere+"killed: "+t.limitErr.Error())
+		return C.LIMIT_KILL
+	}
+	if t.limitErr != nil {
+		t.limitGrace--
+		if t.limitGrace > 0 {
+			return C.LIMIT_OK
+		}
+		t.limitKilled = true
+		log.Printf("%skilled %s: %v", t.limitWhere, t.describe(), t.limitErr)
+		pushGoString(L, t.limitWhere+"killed: "+t.limitErr.Error())
+		return C.LIMIT_KILL
+	}
+
+	var err error
+	switch {
+	case limits.maxInstructions > 0 && t.instructions > limits.maxInstructions:
+		err = ErrInstructionLimit
+	case limits.maxResumeTime > 0 && time.Since(t.resumeStart) > limits.maxResumeTime:
+		err = ErrResumeTimeLimit
+	default:
+		// Ends code that never yields when MaxRunTime passes or the
+		// caller's context is canceled
+		err = t.abortErr()
+	}
+	if err == nil {
+		return C.LIMIT_OK
+	}
+
+	C.push_where(L)
+	t.limitWhere = C.GoString(C.lua_tostring_wrapper(L, -1))
+	C.lua_pop_wrapper(L, 1)
+	t.limitErr = err
+	t.limitGrace = limitKillGrace
+	log.Printf("%s%v in %s", t.limitWhere, err, t.describe())
+
+	pushGoString(L, t.limitWhere+err.Error())
+	return C.LIMIT_RAISE
+}
+
+// resetLimits starts the per-resume limits before the thread is resumed
+func (t *LuaThread) resetLimits() {
+	if t.state.limits == nil {
+		return
+	}
+	t.resumeStart = time.Now()
+	t.limitErr = nil
+	t.limitKilled = false
+}
+
+// endKill restores the normal hook interval after a killed thread has
+// unwound. The hook is shared by every thread in the state.
+func (t *LuaThread) endKill() {
+	C.set_limit_hook(t.state.luaState, C.int(t.state.limits.interval))
+}
+
+// limitCause returns the limit error behind a Lua error message raised by
+// checkLimits, or nil
+func (t *LuaThread) limitCause(message string) error {
+	if t.limitErr != nil && strings.HasSuffix(message, t.limitErr.Error()) {
+		return t.limitErr
+	}
+	return nil
+}
+
+// describe returns what the thread is running, for log messages
+func (t *LuaThread) describe() string {
+	if t.request != nil && t.request.Request != nil {
+		return "request " + t.request.Request.Method + " " + t.request.Request.RequestURI
+	}
+	if t.stream != nil {
+		return "stream session"
+	}
+	return "thread"
+}
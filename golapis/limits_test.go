@@ -0,0 +1,145 @@
+package golapis
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstructionLimit(t *testing.T) {
+	gls, buf := newOptionsState(t, Options{Libs: AllLibs, MaxInstructions: 100000})
+
+	err := gls.RunString("local n = 0\nwhile true do n = n + 1 end")
+	if !errors.Is(err, ErrInstructionLimit) {
+		t.Fatalf("expected instruction limit error, got %v", err)
+	}
+	var luaErr *LuaError
+	if !errors.As(err, &luaErr) || luaErr.Line != 2 {
+		t.Errorf("expected error on line 2, got %v", err)
+	}
+
+	// The limit is per thread, and the state keeps working
+	if err := gls.RunString(`for i = 1, 1000 do end golapis.say("ok")`); err != nil {
+		t.Fatalf("RunString: %v", err)
+	}
+	if output := buf.String(); output != "ok\n" {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func TestInstructionLimitCatchable(t *testing.T) {
+	gls, buf := newOptionsState(t, Options{Libs: AllLibs, MaxInstructions: 100000})
+
+	err := gls.RunString(`
+		local ok, err = pcall(function() while true do end end)
+		golapis.say(ok, " ", err:match("instruction limit exceeded") ~= nil)
+	`)
+	if err != nil {
+		t.Fatalf("RunString: %v", err)
+	}
+	if output := buf.String(); output != "false true\n" {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func TestInstructionLimitKillsThread(t *testing.T) {
+	logs := captureLog(t)
+	gls, _ := newOptionsState(t, Options{Libs: AllLibs, MaxInstructions: 100000})
+
+	err := gls.RunString(`
+		while true do
+			pcall(function() while true do end end)
+		end
+	`)
+	if !errors.Is(err, ErrInstructionLimit) || !strings.Contains(err.Error(), "killed") {
+		t.Fatalf("expected killed thread, got %v", err)
+	}
+	if !strings.Contains(logs.String(), "killed thread: instruction limit exceeded") {
+		t.Errorf("expected kill to be logged, got %q", logs.String())
+	}
+}
+
+func TestInstructionLimitKillsCCallback(t *testing.T) {
+	gls, buf := newOptionsState(t, Options{Libs: AllLibs, MaxInstructions: 100000})
+
+	// The hook runs inside callbacks from C functions, where it can't yield
+	for _, code := range []string{
+		`while true do pcall(string.gsub, ("a"):rep(1e6), "a", function() end) end`,
+		`local t = {} for i = 1, 1000 do t[i] = i end
+		while true do pcall(table.sort, t, function(a, b) return a > b end) end`,
+	} {
+		err := gls.RunString(code)
+		if !errors.Is(err, ErrInstructionLimit) || !strings.Contains(err.Error(), "killed") {
+			t.Fatalf("expected killed thread, got %v", err)
+		}
+	}
+
+	// The hook goes back to the normal interval for the next thread
+	if err := gls.RunString(`for i = 1, 1000 do end golapis.say("ok")`); err != nil {
+		t.Fatalf("RunString: %v", err)
+	}
+	if output := buf.String(); output != "ok\n" {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func TestResumeTimeLimit(t *testing.T) {
+	gls, _ := newOptionsState(t, Options{Libs: AllLibs, MaxResumeTime: 50 * time.Millisecond})
+
+	start := time.Now()
+	err := gls.RunString(`while true do end`)
+	if !errors.Is(err, ErrResumeTimeLimit) {
+		t.Fatalf("expected resume time limit error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("limit took %v", elapsed)
+	}
+
+	// Each resume gets the full budget
+	if err := gls.RunString(`for i = 1, 3 do golapis.sleep(0.03) end`); err != nil {
+		t.Errorf("RunString: %v", err)
+	}
+}
+
+func TestRunTimeLimit(t *testing.T) {
+	gls, _ := newOptionsState(t, Options{Libs: AllLibs, MaxRunTime: 50 * time.Millisecond})
+
+	// Waiting threads are aborted
+	if err := gls.RunString(`golapis.sleep(5)`); !errors.Is(err, ErrRunTimeLimit) {
+		t.Errorf("expected run time limit error, got %v", err)
+	}
+	gls.Wait()
+
+	// Running threads get an error
+	if err := gls.RunString(`golapis.sleep(0.01) while true do end`); !errors.Is(err, ErrRunTimeLimit) {
+		t.Errorf("expected run time limit error, got %v", err)
+	}
+}
+
+func TestInstructionLimitHTTP(t *testing.T) {
+	logs := captureLog(t)
+
+	gls := NewGolapisLuaStateWithOptions(Options{Libs: AllLibs, MaxInstructions: 100000})
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+	if err := gls.LoadEntryPoint(CodeEntryPoint{Code: "golapis.status = 200\nwhile true do end"}); err != nil {
+		t.Fatalf("Failed to load entry point: %v", err)
+	}
+	gls.Start()
+	defer gls.Stop()
+
+	w := httptest.NewRecorder()
+	gls.HTTPHandler(nil).ServeHTTP(w, httptest.NewRequest("GET", "/loop", nil))
+	gls.Wait()
+
+	if w.Code != 500 {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+	if logged := logs.String(); !strings.Contains(logged, `:2: instruction limit exceeded in request GET /loop`) {
+		t.Errorf("expected the script and line to be logged, got %q", logged)
+	}
+}
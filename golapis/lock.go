@@ -0,0 +1,264 @@
+package golapis
+
+/*
+#include "lua_helpers.h"
+*/
+import "C"
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// heldLock is an entry in the process-wide lock table
+type heldLock struct {
+	token    int64
+	expires  time.Time
+	released chan struct{} // closed when the lock is released or taken over after expiry
+}
+
+// lockTable holds named locks shared by every GolapisLuaState in the
+// process. It backs golapis.lock and the resty.lock module.
+type lockTable struct {
+	mu       sync.Mutex
+	locks    map[string]*heldLock
+	tokenSeq int64
+}
+
+var processLocks = &lockTable{locks: make(map[string]*heldLock)}
+
+func (t *lockTable) nextToken() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokenSeq++
+	return t.tokenSeq
+}
+
+// tryAcquire takes the lock for token if it is free or its holder's lock has
+// expired. Otherwise it returns the current holder so the caller can wait.
+func (t *lockTable) tryAcquire(key string, token int64, exptime time.Duration) (bool, *heldLock) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if held := t.locks[key]; held != nil {
+		if now.Before(held.expires) {
+			return false, held
+		}
+		close(held.released)
+	}
+	t.locks[key] = &heldLock{token: token, expires: now.Add(exptime), released: make(chan struct{})}
+	return true, nil
+}
+
+// release frees the lock if token still holds it
+func (t *lockTable) release(key string, token int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	held := t.locks[key]
+	if held == nil || held.token != token {
+		return false
+	}
+	if !time.Now().Before(held.expires) {
+		// Already expired: another waiter may take it over at any time
+		delete(t.locks, key)
+		close(held.released)
+		return false
+	}
+	delete(t.locks, key)
+	close(held.released)
+	return true
+}
+
+// expire resets the expiry of a lock held by token
+func (t *lockTable) expire(key string, token int64, exptime time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	held := t.locks[key]
+	if held == nil || held.token != token || !time.Now().Before(held.expires) {
+		return false
+	}
+	held.expires = time.Now().Add(exptime)
+	return true
+}
+
+// lockWaitOptions mirrors resty.lock's waiting options. Waiters wake as soon
+// as the holder releases the lock; step, ratio and maxStep set how often they
+// also re-check for a lock that has expired without being released.
+type lockWaitOptions struct {
+	exptime time.Duration
+	timeout time.Duration
+	step    time.Duration
+	ratio   float64
+	maxStep time.Duration
+}
+
+// acquire blocks until the lock is taken, the timeout passes or ctx ends. It
+// returns the time spent waiting.
+func (t *lockTable) acquire(ctx context.Context, key string, token int64, opts lockWaitOptions) (time.Duration, bool) {
+	start := time.Now()
+	deadline := start.Add(opts.timeout)
+	step := opts.step
+
+	for {
+		if ctx.Err() != nil {
+			return time.Since(start), false
+		}
+		ok, held := t.tryAcquire(key, token, opts.exptime)
+		if ok {
+			return time.Since(start), true
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return time.Since(start), false
+		}
+		wait := step
+		if untilExpiry := time.Until(held.expires); untilExpiry < wait {
+			wait = untilExpiry
+		}
+		if remaining < wait {
+			wait = remaining
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-held.released:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+
+		step = time.Duration(float64(step) * opts.ratio)
+		if step > opts.maxStep {
+			step = opts.maxStep
+		}
+	}
+}
+
+// luaSeconds reads an optional number of seconds at idx
+func luaSeconds(L *C.lua_State, idx C.int, def float64) time.Duration {
+	seconds := def
+	if C.lua_isnumber(L, idx) != 0 {
+		seconds = float64(C.lua_tonumber(L, idx))
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// golapis_lock_acquire(key, exptime, timeout, step, ratio, max_step) takes the
+// named process-wide lock, yielding to the event loop while it waits. Returns
+// token, elapsed on success or nil, "timeout".
+//
+//export golapis_lock_acquire
+func golapis_lock_acquire(L *C.lua_State) C.int {
+	if C.lua_type(L, 1) != C.LUA_TSTRING {
+		C.lua_pushnil(L)
+		pushGoString(L, "lock.acquire: key must be a string")
+		return 2
+	}
+	key := string(luaStringBytes(L, 1))
+
+	opts := lockWaitOptions{
+		exptime: luaSeconds(L, 2, 30),
+		timeout: luaSeconds(L, 3, 5),
+		step:    luaSeconds(L, 4, 0.001),
+		ratio:   2,
+		maxStep: luaSeconds(L, 6, 0.5),
+	}
+	if C.lua_isnumber(L, 5) != 0 {
+		opts.ratio = float64(C.lua_tonumber(L, 5))
+	}
+	if opts.exptime <= 0 || opts.step <= 0 || opts.ratio < 1 || opts.maxStep <= 0 {
+		C.lua_pushnil(L)
+		pushGoString(L, "lock.acquire: invalid options")
+		return 2
+	}
+
+	token := processLocks.nextToken()
+	if ok, _ := processLocks.tryAcquire(key, token, opts.exptime); ok {
+		C.lua_pushinteger(L, C.lua_Integer(token))
+		C.lua_pushnumber(L, 0)
+		return 2
+	}
+	if opts.timeout <= 0 {
+		C.lua_pushnil(L)
+		pushGoString(L, "timeout")
+		return 2
+	}
+
+	thread := getLuaThreadFromRegistry(L)
+	if thread == nil {
+		C.lua_pushnil(L)
+		pushGoString(L, "lock.acquire: could not find thread context")
+		return 2
+	}
+
+	if debugEnabled {
+		debugLog("lock.acquire: co=%p waiting for %q", L, key)
+	}
+
+	// Waiting stops when the thread is aborted or closed, so a dead thread
+	// never ends up holding the lock
+	ctx := thread.context()
+	go func() {
+		elapsed, ok := processLocks.acquire(ctx, key, token, opts)
+		values := []interface{}{nil, "timeout"}
+		if ok {
+			values = []interface{}{token, elapsed.Seconds()}
+		}
+		thread.state.eventChan <- &StateEvent{
+			Type:         EventResumeThread,
+			Thread:       thread,
+			ResumeValues: values,
+			OnResume: func(event *StateEvent) {
+				// The thread ended after the lock was taken: nothing will unlock it
+				if ok && (thread.co == nil || thread.abortErr() != nil) {
+					processLocks.release(key, token)
+				}
+			},
+		}
+	}()
+
+	return C.lua_yield_wrapper(L, 0)
+}
+
+// golapis_lock_release(key, token) releases a lock taken with acquire.
+// Returns true, or nil, "unlocked" if token no longer holds it.
+//
+//export golapis_lock_release
+func golapis_lock_release(L *C.lua_State) C.int {
+	if C.lua_type(L, 1) != C.LUA_TSTRING || C.lua_isnumber(L, 2) == 0 {
+		C.lua_pushnil(L)
+		pushGoString(L, "lock.release expects key and token")
+		return 2
+	}
+	if !processLocks.release(string(luaStringBytes(L, 1)), int64(C.lua_tonumber(L, 2))) {
+		C.lua_pushnil(L)
+		pushGoString(L, "unlocked")
+		return 2
+	}
+	C.lua_pushboolean(L, 1)
+	return 1
+}
+
+// golapis_lock_expire(key, token, exptime) resets a held lock's expiry.
+// Returns true, or nil, "unlocked" if token no longer holds it.
+//
+//export golapis_lock_expire
+func golapis_lock_expire(L *C.lua_State) C.int {
+	if C.lua_type(L, 1) != C.LUA_TSTRING || C.lua_isnumber(L, 2) == 0 {
+		C.lua_pushnil(L)
+		pushGoString(L, "lock.expire expects key and token")
+		return 2
+	}
+	exptime := luaSeconds(L, 3, 30)
+	if !processLocks.expire(string(luaStringBytes(L, 1)), int64(C.lua_tonumber(L, 2)), exptime) {
+		C.lua_pushnil(L)
+		pushGoString(L, "unlocked")
+		return 2
+	}
+	C.lua_pushboolean(L, 1)
+	return 1
+}
@@ -0,0 +1,184 @@
+package golapis
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockTable(t *testing.T) {
+	locks := &lockTable{locks: make(map[string]*heldLock)}
+	opts := lockWaitOptions{
+		exptime: time.Second,
+		timeout: 20 * time.Millisecond,
+		step:    time.Millisecond,
+		ratio:   2,
+		maxStep: 5 * time.Millisecond,
+	}
+
+	if _, ok := locks.acquire(context.Background(), "key", 1, opts); !ok {
+		t.Fatal("expected to acquire a free lock")
+	}
+	if elapsed, ok := locks.acquire(context.Background(), "key", 2, opts); ok || elapsed < opts.timeout {
+		t.Fatalf("expected timeout while lock is held, got ok=%v elapsed=%v", ok, elapsed)
+	}
+
+	// A waiter is woken as soon as the holder releases
+	done := make(chan bool)
+	go func() {
+		_, ok := locks.acquire(context.Background(), "key", 3, lockWaitOptions{
+			exptime: time.Second, timeout: time.Second, step: time.Second, ratio: 2, maxStep: time.Second,
+		})
+		done <- ok
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if !locks.release("key", 1) {
+		t.Fatal("expected release by holder to succeed")
+	}
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatal("expected waiter to acquire released lock")
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("waiter was not woken by release")
+	}
+	if locks.release("key", 1) {
+		t.Error("expected release by previous holder to fail")
+	}
+
+	// An expired lock can be taken over
+	if !locks.expire("key", 3, 5*time.Millisecond) {
+		t.Fatal("expected expire by holder to succeed")
+	}
+	if _, ok := locks.acquire(context.Background(), "key", 4, opts); !ok {
+		t.Fatal("expected to take over an expired lock")
+	}
+	if locks.expire("key", 3, time.Second) {
+		t.Error("expected expire by previous holder to fail")
+	}
+}
+
+func TestLockAcrossStates(t *testing.T) {
+	locker := NewGolapisLuaState()
+	if locker == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer locker.Close()
+	locker.Start()
+	defer locker.Stop()
+
+	if err := locker.RunString(`
+		local lock = require("resty.lock"):new("shared", { exptime = 0.1 })
+		assert(lock:lock("cross-state"))
+	`); err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+	locker.Wait()
+
+	// The lock expires after 100ms, so a waiter in another state gets it
+	output, err := runLuaAndCapture(t, `
+		local lock = require("resty.lock"):new("shared", { timeout = 1 })
+		local elapsed, err = lock:lock("cross-state")
+		golapis.say(elapsed > 0.05, " ", tostring(err))
+		golapis.say(lock:unlock())
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+	if output != "true nil\n1\n" {
+		t.Errorf("unexpected output: %q", output)
+	}
+}
+
+func TestRestyLock(t *testing.T) {
+	output, err := runLuaAndCapture(t, `
+		local resty_lock = require "resty.lock"
+		local lock = resty_lock:new("my_locks")
+		golapis.say(lock:lock("key"))
+		golapis.say(lock:lock("key"))
+
+		golapis.timer.at(0, function()
+			local other = resty_lock:new("my_locks", { timeout = 1 })
+			local elapsed, err = other:lock("key")
+			golapis.say("waiter: ", elapsed >= 0.02, " ", tostring(err))
+			other:unlock()
+		end)
+
+		local quick = resty_lock:new("my_locks", { timeout = 0 })
+		golapis.say(quick:lock("key"))
+		local other_dict = resty_lock:new("other_dict")
+		golapis.say(other_dict:lock("key"))
+		other_dict:unlock()
+
+		golapis.sleep(0.05)
+		golapis.say(lock:expire(10))
+		golapis.say(lock:unlock())
+		golapis.say(lock:unlock())
+		golapis.say(select(2, resty_lock:new(nil)))
+		golapis.sleep(0.05)
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+
+	expected := "0\n" +
+		"nillocked\n" +
+		"niltimeout\n" +
+		"0\n" +
+		"true\n" +
+		"1\n" +
+		"nilunlocked\n" +
+		"dictionary not found\n" +
+		"waiter: true nil\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestLockAbortedWaiter(t *testing.T) {
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+	buf := &bytes.Buffer{}
+	gls.SetOutputWriter(buf)
+	gls.Start()
+	defer gls.Stop()
+
+	if err := gls.RunString(`
+		holder = require("resty.lock"):new("shared")
+		assert(holder:lock("aborted-waiter"))
+	`); err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := gls.RunStringContext(ctx, `
+		local lock = require("resty.lock"):new("shared", { timeout = 5 })
+		lock:lock("aborted-waiter")
+	`)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected waiter to be aborted, got %v", err)
+	}
+
+	// The aborted waiter must not take the lock once the holder releases it
+	err = gls.RunString(`
+		holder:unlock()
+		local lock = require("resty.lock"):new("shared", { timeout = 1 })
+		local elapsed, err = lock:lock("aborted-waiter")
+		golapis.say(elapsed, " ", tostring(err))
+		lock:unlock()
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+	gls.Wait()
+	if output := buf.String(); output != "0 nil\n" {
+		t.Errorf("expected the lock to be free, got %q", output)
+	}
+}
@@ -0,0 +1,447 @@
+package golapis
+
+/*
+#include "lua_helpers.h"
+
+extern int golapis_lrucache_new(lua_State *L);
+extern int golapis_lrucache_get(lua_State *L);
+extern int golapis_lrucache_set(lua_State *L);
+extern int golapis_lrucache_delete(lua_State *L);
+extern int golapis_lrucache_flush_all(lua_State *L);
+extern int golapis_lrucache_count(lua_State *L);
+extern int golapis_lrucache_capacity(lua_State *L);
+extern int golapis_lrucache_get_keys(lua_State *L);
+extern int golapis_lrucache_gc(lua_State *L);
+
+// Wrappers raise the error message left on the stack when the Go function returns -1
+#define LRUCACHE_WRAPPER(name) \
+    static int c_lrucache_##name(lua_State *L) { \
+        int result = golapis_lrucache_##name(L); \
+        if (result < 0) { \
+            return luaL_error(L, "%s", lua_tostring(L, -1)); \
+        } \
+        return result; \
+    }
+
+LRUCACHE_WRAPPER(get)
+LRUCACHE_WRAPPER(set)
+LRUCACHE_WRAPPER(delete)
+LRUCACHE_WRAPPER(flush_all)
+LRUCACHE_WRAPPER(count)
+LRUCACHE_WRAPPER(capacity)
+LRUCACHE_WRAPPER(get_keys)
+
+// lrucache_testudata returns the cache userdata at idx, or NULL if the value
+// isn't one (unlike luaL_checkudata it never raises)
+static void *lrucache_testudata(lua_State *L, int idx) {
+    void *p = lua_touserdata(L, idx);
+    if (p == NULL || !lua_getmetatable(L, idx)) {
+        return NULL;
+    }
+    luaL_getmetatable(L, "golapis.lrucache");
+    int ok = lua_rawequal(L, -1, -2);
+    lua_pop(L, 2);
+    return ok ? p : NULL;
+}
+
+static int c_lrucache_new(lua_State *L) {
+    return golapis_lrucache_new(L);
+}
+
+static int c_lrucache_gc(lua_State *L) {
+    return golapis_lrucache_gc(L);
+}
+
+// Initialize the LRU cache metatable in the registry (call once during setup)
+static void init_lrucache_metatable(lua_State *L) {
+    luaL_newmetatable(L, "golapis.lrucache");
+
+    // Create methods table for __index
+    lua_newtable(L);
+    lua_pushcfunction(L, c_lrucache_get);
+    lua_setfield(L, -2, "get");
+    lua_pushcfunction(L, c_lrucache_set);
+    lua_setfield(L, -2, "set");
+    lua_pushcfunction(L, c_lrucache_delete);
+    lua_setfield(L, -2, "delete");
+    lua_pushcfunction(L, c_lrucache_flush_all);
+    lua_setfield(L, -2, "flush_all");
+    lua_pushcfunction(L, c_lrucache_count);
+    lua_setfield(L, -2, "count");
+    lua_pushcfunction(L, c_lrucache_capacity);
+    lua_setfield(L, -2, "capacity");
+    lua_pushcfunction(L, c_lrucache_get_keys);
+    lua_setfield(L, -2, "get_keys");
+    lua_setfield(L, -2, "__index");  // metatable.__index = methods table
+
+    // GC metamethod releases the cached values
+    lua_pushcfunction(L, c_lrucache_gc);
+    lua_setfield(L, -2, "__gc");
+
+    lua_pop(L, 1);  // Pop metatable (stored in registry)
+}
+
+static int c_lrucache_loader(lua_State *L) {
+    lua_newtable(L);
+    lua_pushcfunction(L, c_lrucache_new);
+    lua_setfield(L, -2, "new");
+    lua_pushstring(L, "0.13");
+    lua_setfield(L, -2, "_VERSION");
+    return 1;
+}
+
+// setup_lrucache registers resty.lrucache and its resty.lrucache.pureffi
+// alias in package.preload
+static void setup_lrucache(lua_State *L) {
+    init_lrucache_metatable(L);
+
+    lua_getglobal(L, "package");
+    if (!lua_istable(L, -1)) {
+        lua_pop(L, 1);
+        return;
+    }
+    lua_getfield(L, -1, "preload");
+    if (!lua_istable(L, -1)) {
+        lua_pop(L, 2);
+        return;
+    }
+    lua_pushcfunction(L, c_lrucache_loader);
+    lua_setfield(L, -2, "resty.lrucache");
+    lua_pushcfunction(L, c_lrucache_loader);
+    lua_setfield(L, -2, "resty.lrucache.pureffi");
+    lua_pop(L, 2);
+}
+*/
+import "C"
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// LRUCache is a per-state cache compatible with lua-resty-lrucache. Values
+// are kept as Lua registry references so any Lua value can be cached
+// without serialization. Keys may be strings, numbers or booleans.
+type LRUCache struct {
+	size  int
+	items map[any]*list.Element
+	order *list.List // front is most recently used
+}
+
+type lruEntry struct {
+	key    any
+	ref    C.int
+	expire time.Time // zero means no expiry
+	flags  int64
+}
+
+// LRU cache registry - maps cache ID to Go object
+var (
+	lruCacheMap           = make(map[uint64]*LRUCache)
+	lruCacheMu            sync.Mutex
+	lruCacheIDSeq         uint64
+	cStrLRUCacheMetatable = C.CString("golapis.lrucache") // allocated once, never freed
+)
+
+func registerLRUCache(cache *LRUCache) uint64 {
+	lruCacheMu.Lock()
+	defer lruCacheMu.Unlock()
+	lruCacheIDSeq++
+	lruCacheMap[lruCacheIDSeq] = cache
+	return lruCacheIDSeq
+}
+
+func unregisterLRUCache(id uint64) {
+	lruCacheMu.Lock()
+	defer lruCacheMu.Unlock()
+	delete(lruCacheMap, id)
+}
+
+// setupLRUCache registers the built-in resty.lrucache module
+func (gls *GolapisLuaState) setupLRUCache() {
+	C.setup_lrucache(gls.luaState)
+}
+
+// getLRUCacheFromUserdata extracts the LRUCache from the userdata at idx,
+// pushing an error message if it isn't one
+func getLRUCacheFromUserdata(L *C.lua_State, idx C.int, method string) (*LRUCache, uint64) {
+	ptr := C.lrucache_testudata(L, idx)
+	if ptr == nil {
+		pushGoString(L, fmt.Sprintf("bad argument #1 to '%s' (lrucache expected, use cache:%s())", method, method))
+		return nil, 0
+	}
+	id := *(*uint64)(ptr)
+	lruCacheMu.Lock()
+	defer lruCacheMu.Unlock()
+	cache := lruCacheMap[id]
+	if cache == nil {
+		pushGoString(L, fmt.Sprintf("%s: cache has been released", method))
+	}
+	return cache, id
+}
+
+// lruCacheKey converts the Lua value at idx to a cache key
+func lruCacheKey(L *C.lua_State, idx C.int, method string) (any, bool) {
+	switch C.lua_type(L, idx) {
+	case C.LUA_TSTRING:
+		return string(luaStringBytes(L, idx)), true
+	case C.LUA_TNUMBER:
+		return float64(C.lua_tonumber(L, idx)), true
+	case C.LUA_TBOOLEAN:
+		return C.lua_toboolean(L, idx) != 0, true
+	}
+	typeName := C.GoString(C.lua_typename(L, C.lua_type(L, idx)))
+	pushGoString(L, fmt.Sprintf("bad argument #2 to '%s' (string, number or boolean key expected, got %s)", method, typeName))
+	return nil, false
+}
+
+func pushLRUCacheKey(L *C.lua_State, key any) {
+	switch k := key.(type) {
+	case string:
+		pushGoString(L, k)
+	case float64:
+		C.lua_pushnumber(L, C.lua_Number(k))
+	case bool:
+		if k {
+			C.lua_pushboolean(L, 1)
+		} else {
+			C.lua_pushboolean(L, 0)
+		}
+	}
+}
+
+// remove drops an entry and releases its value reference
+func (c *LRUCache) remove(L *C.lua_State, elem *list.Element) {
+	entry := elem.Value.(*lruEntry)
+	C.luaL_unref(L, C.LUA_REGISTRYINDEX, entry.ref)
+	delete(c.items, entry.key)
+	c.order.Remove(elem)
+}
+
+func (c *LRUCache) flush(L *C.lua_State) {
+	for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+		C.luaL_unref(L, C.LUA_REGISTRYINDEX, elem.Value.(*lruEntry).ref)
+	}
+	c.items = make(map[any]*list.Element)
+	c.order.Init()
+}
+
+// golapis_lrucache_new(size) returns a new cache holding at most size items
+//
+//export golapis_lrucache_new
+func golapis_lrucache_new(L *C.lua_State) C.int {
+	if C.lua_isnumber(L, 1) == 0 {
+		C.lua_pushnil(L)
+		pushGoString(L, "size must be a number")
+		return 2
+	}
+	size := int(C.lua_tonumber(L, 1))
+	if size < 1 {
+		C.lua_pushnil(L)
+		pushGoString(L, "size too small")
+		return 2
+	}
+
+	cache := &LRUCache{size: size, items: make(map[any]*list.Element), order: list.New()}
+	id := registerLRUCache(cache)
+
+	ptr := C.lua_newuserdata(L, C.size_t(unsafe.Sizeof(uint64(0))))
+	*(*uint64)(ptr) = id
+	C.luaL_getmetatable_wrapper(L, cStrLRUCacheMetatable)
+	C.lua_setmetatable(L, -2)
+	return 1
+}
+
+// golapis_lrucache_get(cache, key) returns value, nil, flags for a live
+// entry, or nil, stale_value, flags for an expired one (which is removed)
+//
+//export golapis_lrucache_get
+func golapis_lrucache_get(L *C.lua_State) C.int {
+	cache, _ := getLRUCacheFromUserdata(L, 1, "get")
+	if cache == nil {
+		return -1
+	}
+	key, ok := lruCacheKey(L, 2, "get")
+	if !ok {
+		return -1
+	}
+
+	elem := cache.items[key]
+	if elem == nil {
+		C.lua_pushnil(L)
+		return 1
+	}
+	entry := elem.Value.(*lruEntry)
+
+	if !entry.expire.IsZero() && time.Now().After(entry.expire) {
+		C.lua_pushnil(L)
+		C.lua_rawgeti_wrapper(L, C.LUA_REGISTRYINDEX, entry.ref)
+		C.lua_pushnumber(L, C.lua_Number(entry.flags))
+		cache.remove(L, elem)
+		return 3
+	}
+
+	cache.order.MoveToFront(elem)
+	C.lua_rawgeti_wrapper(L, C.LUA_REGISTRYINDEX, entry.ref)
+	C.lua_pushnil(L)
+	C.lua_pushnumber(L, C.lua_Number(entry.flags))
+	return 3
+}
+
+// golapis_lrucache_set(cache, key, value, ttl, flags) stores value, evicting
+// the least recently used entry when full. ttl is in seconds; nil means the
+// entry never expires.
+//
+//export golapis_lrucache_set
+func golapis_lrucache_set(L *C.lua_State) C.int {
+	cache, _ := getLRUCacheFromUserdata(L, 1, "set")
+	if cache == nil {
+		return -1
+	}
+	key, ok := lruCacheKey(L, 2, "set")
+	if !ok {
+		return -1
+	}
+
+	var expire time.Time
+	if C.lua_type(L, 4) > C.LUA_TNIL {
+		if C.lua_isnumber(L, 4) == 0 {
+			pushGoString(L, "bad argument #4 to 'set' (number expected for ttl)")
+			return -1
+		}
+		ttl := float64(C.lua_tonumber(L, 4))
+		expire = time.Now().Add(time.Duration(ttl * float64(time.Second)))
+	}
+	var flags int64
+	if C.lua_isnumber(L, 5) != 0 {
+		flags = int64(C.lua_tonumber(L, 5))
+	}
+
+	C.lua_settop(L, 3)
+	ref := C.luaL_ref(L, C.LUA_REGISTRYINDEX) // pops the value
+
+	if elem := cache.items[key]; elem != nil {
+		entry := elem.Value.(*lruEntry)
+		C.luaL_unref(L, C.LUA_REGISTRYINDEX, entry.ref)
+		entry.ref, entry.expire, entry.flags = ref, expire, flags
+		cache.order.MoveToFront(elem)
+		return 0
+	}
+
+	if cache.order.Len() >= cache.size {
+		cache.remove(L, cache.order.Back())
+	}
+	entry := &lruEntry{key: key, ref: ref, expire: expire, flags: flags}
+	cache.items[key] = cache.order.PushFront(entry)
+	return 0
+}
+
+//export golapis_lrucache_delete
+func golapis_lrucache_delete(L *C.lua_State) C.int {
+	cache, _ := getLRUCacheFromUserdata(L, 1, "delete")
+	if cache == nil {
+		return -1
+	}
+	key, ok := lruCacheKey(L, 2, "delete")
+	if !ok {
+		return -1
+	}
+
+	elem := cache.items[key]
+	if elem == nil {
+		C.lua_pushboolean(L, 0)
+		return 1
+	}
+	cache.remove(L, elem)
+	C.lua_pushboolean(L, 1)
+	return 1
+}
+
+//export golapis_lrucache_flush_all
+func golapis_lrucache_flush_all(L *C.lua_State) C.int {
+	cache, _ := getLRUCacheFromUserdata(L, 1, "flush_all")
+	if cache == nil {
+		return -1
+	}
+	cache.flush(L)
+	return 0
+}
+
+//export golapis_lrucache_count
+func golapis_lrucache_count(L *C.lua_State) C.int {
+	cache, _ := getLRUCacheFromUserdata(L, 1, "count")
+	if cache == nil {
+		return -1
+	}
+	C.lua_pushinteger(L, C.lua_Integer(cache.order.Len()))
+	return 1
+}
+
+//export golapis_lrucache_capacity
+func golapis_lrucache_capacity(L *C.lua_State) C.int {
+	cache, _ := getLRUCacheFromUserdata(L, 1, "capacity")
+	if cache == nil {
+		return -1
+	}
+	C.lua_pushinteger(L, C.lua_Integer(cache.size))
+	return 1
+}
+
+// golapis_lrucache_get_keys(cache, max_count, res) returns the keys from
+// most to least recently used. max_count of 0 or nil means all keys. If res
+// is given it is filled in place and entries past the last key are cleared.
+//
+//export golapis_lrucache_get_keys
+func golapis_lrucache_get_keys(L *C.lua_State) C.int {
+	cache, _ := getLRUCacheFromUserdata(L, 1, "get_keys")
+	if cache == nil {
+		return -1
+	}
+	maxCount := 0
+	if C.lua_isnumber(L, 2) != 0 {
+		maxCount = int(C.lua_tonumber(L, 2))
+	}
+	if maxCount <= 0 || maxCount > cache.order.Len() {
+		maxCount = cache.order.Len()
+	}
+
+	if C.lua_type(L, 3) == C.LUA_TTABLE {
+		C.lua_settop(L, 3)
+	} else {
+		C.lua_settop(L, 2)
+		C.lua_createtable(L, C.int(maxCount), 0)
+	}
+	res := C.lua_gettop(L)
+
+	i := 0
+	for elem := cache.order.Front(); elem != nil && i < maxCount; elem = elem.Next() {
+		i++
+		pushLRUCacheKey(L, elem.Value.(*lruEntry).key)
+		C.lua_rawseti(L, res, C.int(i))
+	}
+	// Clear leftovers in a reused result table
+	for n := int(C.lua_objlen(L, res)); n > i; n-- {
+		C.lua_pushnil(L)
+		C.lua_rawseti(L, res, C.int(n))
+	}
+	return 1
+}
+
+//export golapis_lrucache_gc
+func golapis_lrucache_gc(L *C.lua_State) C.int {
+	ptr := C.lua_touserdata_wrapper(L, 1)
+	if ptr == nil {
+		return 0
+	}
+	id := *(*uint64)(ptr)
+	lruCacheMu.Lock()
+	cache := lruCacheMap[id]
+	lruCacheMu.Unlock()
+	if cache != nil {
+		cache.flush(L)
+		unregisterLRUCache(id)
+	}
+	return 0
+}
@@ -0,0 +1,85 @@
+package golapis
+
+import (
+	"testing"
+)
+
+func TestLRUCacheBasic(t *testing.T) {
+	output, err := runLuaAndCapture(t, `
+		local lrucache = require "resty.lrucache"
+		local cache = assert(lrucache.new(2))
+		local tbl = { name = "cached" }
+		cache:set("dog", 32)
+		cache:set("cat", tbl, nil, 7)
+		golapis.say(cache:get("dog"), " ", cache:get("cat") == tbl, " ", select(3, cache:get("cat")))
+		golapis.say(cache:count(), " ", cache:capacity())
+
+		-- dog was used least recently, so it is evicted
+		cache:get("cat")
+		cache:set(10, "ten")
+		golapis.say(tostring(cache:get("dog")), " ", cache:get(10), " ", tostring(cache:get("10")))
+
+		local keys = cache:get_keys()
+		golapis.say(#keys, " ", keys[1], " ", keys[2])
+		golapis.say(#cache:get_keys(1))
+
+		golapis.say(cache:delete("cat"), " ", cache:delete("cat"), " ", cache:count())
+		cache:flush_all()
+		golapis.say(cache:count(), " ", tostring(cache:get(10)))
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+
+	expected := "32 true 7\n2 2\nnil ten nil\n2 10 cat\n1\ntrue false 1\n0 nil\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestLRUCacheTTL(t *testing.T) {
+	output, err := runLuaAndCapture(t, `
+		local lrucache = require "resty.lrucache.pureffi"
+		local cache = lrucache.new(10)
+		cache:set("short", "value", 0.01, 3)
+		cache:set("long", "value", 10)
+		golapis.say(cache:get("short"))
+		golapis.sleep(0.05)
+		local value, stale, flags = cache:get("short")
+		golapis.say(tostring(value), " ", stale, " ", flags)
+		golapis.say(tostring(cache:get("short")), " ", cache:get("long"), " ", cache:count())
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+
+	expected := "valuenil3\nnil value 3\nnil value 1\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestLRUCacheErrors(t *testing.T) {
+	output, err := runLuaAndCapture(t, `
+		local lrucache = require "resty.lrucache"
+		golapis.say(select(2, lrucache.new(0)))
+		local cache = lrucache.new(1)
+		golapis.say(select(2, pcall(cache.get, cache, {})))
+		golapis.say(select(2, pcall(cache.get, "nope", "key")))
+		local keys = { "a", "b", "c" }
+		cache:set("x", 1)
+		cache:get_keys(0, keys)
+		golapis.say(#keys, " ", keys[1])
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+
+	expected := "size too small\n" +
+		"bad argument #2 to 'get' (string, number or boolean key expected, got table)\n" +
+		"bad argument #1 to 'get' (lrucache expected, use cache:get())\n" +
+		"1 x\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
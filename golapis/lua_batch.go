@@ -35,6 +35,8 @@ const (
 	batchOpSetFI  = 0x0C
 	batchOpSetI   = 0x0D
 	batchOpPop    = 0x0E
+	batchOpNull   = 0x0F
+	batchOpSetMT  = 0x10
 )
 
 // LuaBatch encodes a sequence of Lua stack operations into a byte buffer
@@ -229,6 +231,20 @@ func (b *LuaBatch) Pop(n int) *LuaBatch {
 	return b
 }
 
+// Null pushes golapis.null (a NULL lightuserdata) onto the Lua stack.
+func (b *LuaBatch) Null() *LuaBatch {
+	b.buf = append(b.buf, batchOpNull)
+	return b
+}
+
+// SetMetatableRef sets the metatable of the table at -1 to the value stored
+// in the Lua registry under ref.
+func (b *LuaBatch) SetMetatableRef(ref int) *LuaBatch {
+	b.buf = append(b.buf, batchOpSetMT)
+	b.appendU32(uint32(ref))
+	return b
+}
+
 // -- Convenience methods --
 
 // StringField pushes a string value and sets it as a named field (inline field name).
@@ -259,6 +275,12 @@ func (b *LuaBatch) Push(L *C.lua_State) {
 	}
 }
 
+// PushToLua implements LuaPusher, so a batch (such as one from Marshal) can be
+// used in StateEvent.ResumeValues.
+func (b *LuaBatch) PushToLua(L *C.lua_State) {
+	b.Push(L)
+}
+
 // PushUnsafe executes all encoded instructions on a Lua state provided as an
 // unsafe.Pointer. This allows external packages (e.g. benchmarks with their own
 // CGO lua_State) to use LuaBatch without depending on golapis's internal C types.
@@ -204,6 +204,18 @@ func TestBatchBuilderEncoding(t *testing.T) {
 	if len(b.buf) != 9 {
 		t.Errorf("expected 9 bytes for STRI 'test', got %d", len(b.buf))
 	}
+
+	b.Reset()
+	b.Null()
+	if b.buf[0] != batchOpNull || len(b.buf) != 1 {
+		t.Errorf("expected 1 byte NULL opcode, got % x", b.buf)
+	}
+
+	b.Reset()
+	b.SetMetatableRef(7)
+	if b.buf[0] != batchOpSetMT || len(b.buf) != 5 { // 1 opcode + 4 byte ref
+		t.Errorf("expected 5 byte SETMT instruction, got % x", b.buf)
+	}
 }
 
 func TestBatchPoolReuse(t *testing.T) {
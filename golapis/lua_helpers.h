@@ -109,32 +109,32 @@ static int luaL_error_str(lua_State *L, const char *msg) {
     return luaL_error(L, "%s", msg);
 }
 
-// Get traceback from a coroutine error
-// L is the main state, co is the coroutine with error message on top of stack
-// Pushes traceback string onto L's stack (caller must pop)
-static void lua_push_traceback(lua_State *L, lua_State *co) {
-    const char *msg = lua_tostring(co, -1);
-    lua_getglobal(L, "debug");
-    if (!lua_istable(L, -1)) {
-        lua_pop(L, 1);
-        lua_pushstring(L, msg ? msg : "");
-        return;
-    }
-    lua_getfield(L, -1, "traceback");
+// Registry key of debug.traceback, saved when the state is created so
+// tracebacks work when the debug library is not exposed to Lua code
+#define GOLAPIS_TRACEBACK_KEY "golapis.traceback"
+
+// Pushes debug.traceback(co, msg, 0) onto L's stack (caller must pop). L is
+// the main state and co the coroutine; msg may be NULL for the stack trace
+// alone. Falls back to msg if the traceback can't be built.
+static void lua_push_traceback(lua_State *L, lua_State *co, const char *msg) {
+    lua_getfield(L, LUA_REGISTRYINDEX, GOLAPIS_TRACEBACK_KEY);
     if (!lua_isfunction(L, -1)) {
-        lua_pop(L, 2);
+        lua_pop(L, 1);
         lua_pushstring(L, msg ? msg : "");
         return;
     }
     lua_pushthread(co);
     lua_xmove(co, L, 1);        // move coroutine to main state
-    lua_pushstring(L, msg);
+    if (msg) {
+        lua_pushstring(L, msg);
+    } else {
+        lua_pushnil(L);
+    }
     lua_pushinteger(L, 0);      // level
-    if (lua_pcall(L, 3, 1, 0) != LUA_OK) {
+    if (lua_pcall(L, 3, 1, 0) != LUA_OK || !lua_isstring(L, -1)) {
         lua_pop(L, 1);
         lua_pushstring(L, msg ? msg : "");
     }
-    lua_remove(L, -2);          // remove debug table, keep traceback
 }
 
 // Batch push bytecode interpreter
@@ -156,6 +156,8 @@ static void lua_push_traceback(lua_State *L, lua_State *co) {
 #define BATCH_OP_SETFI  0x0C
 #define BATCH_OP_SETI   0x0D
 #define BATCH_OP_POP    0x0E
+#define BATCH_OP_NULL   0x0F
+#define BATCH_OP_SETMT  0x10
 
 static inline uint32_t read_u32(const unsigned char *p) {
     return (uint32_t)p[0] | ((uint32_t)p[1] << 8) |
@@ -271,6 +273,19 @@ static int lua_batch_push(lua_State *L,
             lua_pop(L, (int)count);
             break;
         }
+        case BATCH_OP_NULL:
+            // golapis.null sentinel
+            lua_pushlightuserdata(L, NULL);
+            break;
+        case BATCH_OP_SETMT: {
+            // Set the metatable of the table at -1 from a registry reference
+            if (pos + 4 > instr_len) return -1;
+            int ref = (int)read_u32(instr + pos);
+            pos += 4;
+            lua_rawgeti(L, LUA_REGISTRYINDEX, ref);
+            lua_setmetatable(L, -2);
+            break;
+        }
         default:
             return -1; // unknown opcode
         }
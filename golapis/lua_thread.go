@@ -5,10 +5,11 @@ package golapis
 */
 import "C"
 import (
-	"errors"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 	"unsafe"
 )
 
@@ -108,6 +109,7 @@ type LuaThread struct {
 	responseChan chan *StateResponse // channel to send final response when thread completes
 	outputWriter io.Writer           // per-request output destination (e.g., http.ResponseWriter)
 	request      *GolapisRequest     // Request context (nil in CLI mode)
+	stream       *StreamRequest      // Stream session context (nil outside stream mode)
 
 	curCo        *coCtx
 	entryCo      *coCtx
@@ -117,6 +119,28 @@ type LuaThread struct {
 	// Exit state (set by golapis.exit())
 	exited   bool // true if golapis.exit() was called
 	exitCode int  // HTTP status code from exit()
+
+	// Context passed to async Go functions, created on first use
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Context from the event that started the thread; the thread is aborted
+	// when it ends (see abort)
+	abortCtx       context.Context
+	stopAbortWatch func() bool
+
+	// Return values of the entry function, for Call and Eval
+	collectResults bool
+	results        []interface{}
+	resultsErr     error
+
+	// Execution limit state (see checkLimits)
+	instructions int64     // instructions run so far, counted per hook interval
+	resumeStart  time.Time // when the current resume started
+	limitErr     error     // limit error raised in the current resume
+	limitWhere   string    // "chunk:line:" that was running when it was raised
+	limitGrace   int       // checks left before the thread is killed
+	limitKilled  bool      // the hook raises on every instruction to kill the thread
 }
 
 // newThread creates a new LuaThread from the function currently on top of the stack (internal)
@@ -259,6 +283,7 @@ func (t *LuaThread) resumeInternal(values []interface{}, initialArgCount int) er
 		return fmt.Errorf("cannot resume closed thread")
 	}
 
+	t.resetLimits()
 	pendingArgCount := initialArgCount
 	for {
 		coctx := t.curCo
@@ -324,7 +349,10 @@ func (t *LuaThread) resumeInternal(values []interface{}, initialArgCount int) er
 				case LuaPusher:
 					val.PushToLua(coctx.co)
 				default:
-					C.lua_pushnil(coctx.co) // unsupported type, push nil
+					// Structs, slices and other maps go through Marshal's encoder
+					if err := pushGoValue(coctx.co, val); err != nil {
+						C.lua_pushnil(coctx.co) // unsupported type, push nil
+					}
 				}
 				nret++
 			}
@@ -342,6 +370,9 @@ func (t *LuaThread) resumeInternal(values []interface{}, initialArgCount int) er
 			coctx.status = coDead
 			if coctx.parent == nil {
 				t.status = ThreadDead
+				if t.collectResults {
+					t.saveResults(coctx.co)
+				}
 				return nil
 			}
 
@@ -418,14 +449,19 @@ func (t *LuaThread) resumeInternal(values []interface{}, initialArgCount int) er
 				return nil
 			}
 		default:
-			traceback := t.getTraceback(coctx.co)
 			coctx.status = coDead
 			parent := coctx.parent
 			if parent == nil {
 				t.status = ThreadDead
-				return errors.New(traceback)
+				luaErr := t.newLuaError(coctx.co)
+				luaErr.Cause = t.limitCause(luaErr.Message)
+				if t.limitKilled {
+					t.endKill()
+				}
+				return luaErr
 			}
 
+			traceback := t.getTraceback(coctx.co)
 			pushGoString(parent.co, traceback)
 			C.lua_pushboolean(parent.co, 0)
 			C.lua_insert_wrapper(parent.co, 1)
@@ -439,10 +475,11 @@ func (t *LuaThread) resumeInternal(values []interface{}, initialArgCount int) er
 	}
 }
 
-// getTraceback calls debug.traceback(co, msg, 0) to get a full stack trace
+// getTraceback calls debug.traceback(co, msg, 0) with the error message on
+// top of co's stack to get a full stack trace
 func (t *LuaThread) getTraceback(co *C.lua_State) string {
 	L := t.state.luaState
-	C.lua_push_traceback(L, co)
+	C.lua_push_traceback(L, co, C.lua_tostring_wrapper(co, -1))
 	traceback := C.GoString(C.lua_tostring_wrapper(L, -1))
 	C.lua_pop_wrapper(L, 1)
 	return traceback
@@ -455,6 +492,141 @@ func (t *LuaThread) setRequest(request *GolapisRequest) {
 		r := request.Request
 		debugLog("thread.setRequest: co=%p %s %s", t.co, r.Method, r.URL.Path)
 	}
+	if request != nil && len(request.ctxValues) > 0 {
+		t.loadCtxValues(request.ctxValues)
+	}
+}
+
+// loadCtxValues copies values injected with GolapisRequest.SetCtx into the
+// thread's context table
+func (t *LuaThread) loadCtxValues(values map[string]any) {
+	L := t.state.luaState
+	C.lua_rawgeti_wrapper(L, C.LUA_REGISTRYINDEX, t.ctxRef)
+	for key, value := range values {
+		if err := pushGoValue(L, value); err != nil {
+			// SetCtx validated the value, but maps and slices may have changed since
+			if debugEnabled {
+				debugLog("thread.loadCtxValues: co=%p skipping %q: %v", t.co, key, err)
+			}
+			continue
+		}
+		ckey := C.CString(key)
+		C.lua_setfield_wrapper(L, -2, ckey)
+		C.free(unsafe.Pointer(ckey))
+	}
+	C.lua_pop_wrapper(L, 1) // pop context table
+}
+
+// saveCtxResult converts the thread's context table to Go for GolapisRequest.GetCtx
+func (t *LuaThread) saveCtxResult() {
+	L := t.state.luaState
+	result := make(map[string]any)
+	C.lua_rawgeti_wrapper(L, C.LUA_REGISTRYINDEX, t.ctxRef)
+	C.lua_pushnil(L)
+	for C.lua_next_wrapper(L, -2) != 0 {
+		// Stack: ctx, key, value
+		if C.lua_type(L, -2) == C.LUA_TSTRING {
+			if value, err := luaToGoValue(L, -1, 0); err == nil {
+				result[string(luaStringBytes(L, -2))] = value
+			}
+		}
+		C.lua_pop_wrapper(L, 1) // pop value, keep key for next iteration
+	}
+	C.lua_pop_wrapper(L, 1) // pop context table
+	t.request.ctxResult = result
+}
+
+// context returns a context that is canceled when the thread closes or its
+// HTTP request's context ends
+func (t *LuaThread) context() context.Context {
+	if t.ctx == nil {
+		parent := context.Background()
+		if t.request != nil && t.request.Request != nil {
+			parent = t.request.Request.Context()
+		}
+		t.ctx, t.cancel = context.WithCancel(parent)
+	}
+	return t.ctx
+}
+
+// setEventOptions applies the context and Call options of the event that
+// started the thread
+func (t *LuaThread) setEventOptions(event *StateEvent) {
+	t.collectResults = event.ReturnResults
+	ctx := event.Context
+	limits := t.state.limits
+	if limits != nil && limits.maxRunTime > 0 {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		var stopRunTime context.CancelFunc
+		ctx, stopRunTime = context.WithTimeoutCause(ctx, limits.maxRunTime, ErrRunTimeLimit)
+		var cancel context.CancelFunc
+		t.ctx, cancel = context.WithCancel(ctx)
+		t.cancel = func() {
+			cancel()
+			stopRunTime()
+		}
+	} else if ctx != nil {
+		t.ctx, t.cancel = context.WithCancel(ctx)
+	} else {
+		return
+	}
+	if ctx.Done() == nil {
+		return // never canceled
+	}
+	t.abortCtx = ctx
+	// The event loop may have stopped by the time ctx ends; a thread that
+	// already finished ignores the event
+	loopDone := t.state.loopDone
+	t.stopAbortWatch = context.AfterFunc(ctx, func() {
+		select {
+		case t.state.eventChan <- &StateEvent{Type: EventAbortThread, Thread: t}:
+		case <-loopDone:
+		}
+	})
+}
+
+// abortErr returns the error the thread should be aborted with, if its
+// context has ended
+func (t *LuaThread) abortErr() error {
+	if t.abortCtx == nil || t.abortCtx.Err() == nil {
+		return nil
+	}
+	return context.Cause(t.abortCtx)
+}
+
+// aborted returns a channel that is closed when the thread's context ends,
+// or nil if it has none. Async operations can stop waiting on it, since the
+// thread is aborted instead of resumed.
+func (t *LuaThread) aborted() <-chan struct{} {
+	if t.abortCtx == nil {
+		return nil
+	}
+	return t.abortCtx.Done()
+}
+
+// abort ends a yielded thread whose context ended: sockets it owns are
+// closed, interrupting pending operations, and err is sent to the caller.
+// Operations still in flight resume a closed thread and are dropped.
+func (t *LuaThread) abort(err error) {
+	if debugEnabled {
+		debugLog("thread.abort: co=%p err=%v", t.co, err)
+	}
+	closeThreadTCPSockets(t)
+	closeThreadUDPSockets(t)
+	t.finish(&StateResponse{Error: err})
+}
+
+// finish closes a thread that was resumed by the event loop and then sends
+// resp to the original caller, so golapis.ctx is saved for GetCtx before the
+// caller sees the response
+func (t *LuaThread) finish(resp *StateResponse) {
+	responseChan := t.responseChan
+	t.close()
+	if responseChan != nil {
+		responseChan <- resp
+	}
 }
 
 // close cleans up the thread resources (internal)
@@ -479,10 +651,19 @@ func (t *LuaThread) close() {
 		}
 
 		// Release the context table reference
+		if t.ctxRef != 0 && t.request != nil && t.request.captureCtx {
+			t.saveCtxResult()
+		}
 		if t.ctxRef != 0 {
 			C.luaL_unref_wrapper(t.state.luaState, C.LUA_REGISTRYINDEX, t.ctxRef)
 			t.ctxRef = 0
 		}
+		if t.stopAbortWatch != nil {
+			t.stopAbortWatch()
+		}
+		if t.cancel != nil {
+			t.cancel()
+		}
 		t.co = nil
 		t.state.threadWg.Done()
 	}
@@ -0,0 +1,135 @@
+package golapis
+
+/*
+#include "lua_helpers.h"
+
+// Fills in the frame at level of co's stack. Returns 0 past the last frame.
+static int get_stack_frame(lua_State *co, int level, lua_Debug *ar) {
+    if (!lua_getstack(co, level, ar)) {
+        return 0;
+    }
+    return lua_getinfo(co, "Sln", ar);
+}
+*/
+import "C"
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LuaError is returned for errors raised by Lua code, and for Lua syntax
+// errors. Use errors.As to get at it from the error returned by RunString,
+// Call and the other run methods.
+type LuaError struct {
+	Message   string          // error message; for non-string values, a description of the value
+	Value     any             // the raised value converted to Go (see LuaArgs), e.g. a map for error({code=...})
+	Chunk     string          // chunk where the error happened, e.g. "app.lua" or [string "..."]
+	Line      int             // line in Chunk, or 0 if unknown
+	Traceback string          // "stack traceback:" text from debug.traceback, empty for syntax errors
+	Frames    []LuaStackFrame // parsed stack, innermost first
+	Cause     error           // Go error behind the Lua error, e.g. ErrInstructionLimit, or nil
+}
+
+// LuaStackFrame is one level of a Lua stack trace
+type LuaStackFrame struct {
+	Source   string // chunk name, e.g. "app.lua", [string "..."] or [C]
+	Line     int    // current line, or 0 for C functions
+	Function string // function name if known
+	What     string // "Lua", "C", "main" or "tail"
+}
+
+// Error returns the message followed by the traceback, matching the text of
+// debug.traceback(co, message)
+func (e *LuaError) Error() string {
+	if e.Traceback == "" {
+		return e.Message
+	}
+	return e.Message + "\n" + e.Traceback
+}
+
+// Unwrap returns Cause, so errors.Is(err, ErrInstructionLimit) works
+func (e *LuaError) Unwrap() error {
+	return e.Cause
+}
+
+// newLuaError builds a LuaError for the error value on top of the dead
+// coroutine co
+func (t *LuaThread) newLuaError(co *C.lua_State) *LuaError {
+	L := t.state.luaState
+	e := &LuaError{}
+
+	if value, err := luaToGoValue(co, -1, 0); err == nil {
+		e.Value = value
+	}
+	switch C.lua_type(co, -1) {
+	case C.LUA_TSTRING, C.LUA_TNUMBER:
+		e.Message = string(luaStringBytes(co, -1))
+	default:
+		typeName := C.GoString(C.lua_typename(co, C.lua_type(co, -1)))
+		e.Message = fmt.Sprintf("(error object is a %s value)", typeName)
+	}
+
+	C.lua_push_traceback(L, co, nil)
+	e.Traceback = C.GoString(C.lua_tostring_wrapper(L, -1))
+	C.lua_pop_wrapper(L, 1)
+
+	var ar C.lua_Debug
+	for level := 0; C.get_stack_frame(co, C.int(level), &ar) != 0; level++ {
+		frame := LuaStackFrame{
+			Source: C.GoString(&ar.short_src[0]),
+			What:   C.GoString(ar.what),
+		}
+		if ar.currentline > 0 {
+			frame.Line = int(ar.currentline)
+		}
+		if ar.name != nil {
+			frame.Function = C.GoString(ar.name)
+		}
+		e.Frames = append(e.Frames, frame)
+
+		// The error happened in the innermost Lua function
+		if e.Chunk == "" && frame.Line > 0 {
+			e.Chunk, e.Line = frame.Source, frame.Line
+		}
+	}
+	if e.Chunk == "" {
+		e.Chunk, e.Line = parseErrorPosition(e.Message)
+	}
+	return e
+}
+
+// errorPositionPattern matches the "chunk:line:" prefix Lua adds to messages
+var errorPositionPattern = regexp.MustCompile(`^(.+?):(\d+): `)
+
+// parseErrorPosition extracts the chunk and line from a message such as
+// `[string "..."]:3: unexpected symbol near ')'`
+func parseErrorPosition(message string) (string, int) {
+	if strings.HasPrefix(message, "[string \"") {
+		// The chunk name may itself contain ":" so skip past it
+		if end := strings.Index(message, "\"]:"); end >= 0 {
+			chunk := message[:end+2]
+			if rest, ok := strings.CutPrefix(message[end+2:], ":"); ok {
+				if lineStr, _, ok := strings.Cut(rest, ":"); ok {
+					if line, err := strconv.Atoi(lineStr); err == nil {
+						return chunk, line
+					}
+				}
+			}
+		}
+		return "", 0
+	}
+	m := errorPositionPattern.FindStringSubmatch(message)
+	if m == nil {
+		return "", 0
+	}
+	line, _ := strconv.Atoi(m[2])
+	return m[1], line
+}
+
+// newLuaSyntaxError builds a LuaError for a message from luaL_load*
+func newLuaSyntaxError(message string) *LuaError {
+	chunk, line := parseErrorPosition(message)
+	return &LuaError{Message: message, Value: message, Chunk: chunk, Line: line}
+}
@@ -0,0 +1,110 @@
+package golapis
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLuaErrorRuntime(t *testing.T) {
+	_, err := runLuaAndCapture(t, `
+local function inner()
+  error("boom")
+end
+local function outer()
+  inner()
+end
+outer()
+`)
+	var luaErr *LuaError
+	if !errors.As(err, &luaErr) {
+		t.Fatalf("expected *LuaError, got %T: %v", err, err)
+	}
+
+	if !strings.HasSuffix(luaErr.Message, ":3: boom") {
+		t.Errorf("unexpected message %q", luaErr.Message)
+	}
+	if luaErr.Value != luaErr.Message {
+		t.Errorf("expected Value to be the message, got %#v", luaErr.Value)
+	}
+	if !strings.HasPrefix(luaErr.Chunk, `[string "`) || luaErr.Line != 3 {
+		t.Errorf("unexpected location %s:%d", luaErr.Chunk, luaErr.Line)
+	}
+	if !strings.HasPrefix(luaErr.Traceback, "stack traceback:") {
+		t.Errorf("unexpected traceback %q", luaErr.Traceback)
+	}
+	if err.Error() != luaErr.Message+"\n"+luaErr.Traceback {
+		t.Errorf("unexpected Error() %q", err.Error())
+	}
+
+	var lines []int
+	var names []string
+	for _, frame := range luaErr.Frames {
+		if frame.What == "C" {
+			continue
+		}
+		lines = append(lines, frame.Line)
+		names = append(names, frame.Function)
+	}
+	if !reflect.DeepEqual(lines[:3], []int{3, 6, 8}) {
+		t.Errorf("unexpected frame lines %v", lines)
+	}
+	if names[0] != "inner" || names[1] != "outer" {
+		t.Errorf("unexpected frame names %v", names)
+	}
+}
+
+func TestLuaErrorTableValue(t *testing.T) {
+	gls := newCallState(t)
+
+	_, err := gls.Eval(context.Background(), `error({ code = 404, reason = "missing" })`)
+	var luaErr *LuaError
+	if !errors.As(err, &luaErr) {
+		t.Fatalf("expected *LuaError, got %T: %v", err, err)
+	}
+	expected := map[string]any{"code": int64(404), "reason": "missing"}
+	if !reflect.DeepEqual(luaErr.Value, expected) {
+		t.Errorf("expected %#v, got %#v", expected, luaErr.Value)
+	}
+	if luaErr.Message != "(error object is a table value)" {
+		t.Errorf("unexpected message %q", luaErr.Message)
+	}
+	if luaErr.Line != 1 {
+		t.Errorf("expected line 1, got %d", luaErr.Line)
+	}
+}
+
+func TestLuaErrorSyntax(t *testing.T) {
+	_, err := runLuaAndCapture(t, "local x = 1\nlocal y = (")
+	var luaErr *LuaError
+	if !errors.As(err, &luaErr) {
+		t.Fatalf("expected *LuaError, got %T: %v", err, err)
+	}
+	if luaErr.Line != 2 || !strings.HasPrefix(luaErr.Chunk, `[string "local x = 1..."]`) {
+		t.Errorf("unexpected location %s:%d", luaErr.Chunk, luaErr.Line)
+	}
+	if luaErr.Traceback != "" || err.Error() != luaErr.Message {
+		t.Errorf("syntax errors have no traceback, got %q", err.Error())
+	}
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	tests := []struct {
+		message string
+		chunk   string
+		line    int
+	}{
+		{"app.lua:12: attempt to call a nil value", "app.lua", 12},
+		{`[string "a:1: b"]:7: oops`, `[string "a:1: b"]`, 7},
+		{"no position here", "", 0},
+		{"cannot open missing.lua", "", 0},
+	}
+	for _, tt := range tests {
+		chunk, line := parseErrorPosition(tt.message)
+		if chunk != tt.chunk || line != tt.line {
+			t.Errorf("parseErrorPosition(%q) = %q, %d; want %q, %d", tt.message, chunk, line, tt.chunk, tt.line)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package golapis
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// NullValue is the type of Null
+type NullValue struct{}
+
+// Null marshals to golapis.null. Unlike nil, it keeps its slot in an array
+// table and survives as a table value.
+var Null NullValue
+
+var nullValueType = reflect.TypeOf(Null)
+
+// Marshal encodes v into a new LuaBatch that pushes it as a single Lua value.
+// Structs become tables keyed by field name, or by the name in a
+// `lua:"name,omitempty"` tag; a tag of "-" skips the field, omitempty skips
+// zero values, and embedded structs without a tag are flattened. Otherwise v
+// is converted like a LuaValues entry. The batch implements LuaPusher, so it
+// can be used in StateEvent.ResumeValues.
+func Marshal(v any) (*LuaBatch, error) {
+	batch := NewLuaBatch()
+	if err := encodeGoValue(batch, reflect.ValueOf(v), 0); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// Unmarshal stores a value converted from Lua (an entry of LuaArgs, or a
+// value from GetCtx) in the value pointed to by dst. Tables decode into
+// structs using the same field names as Marshal, and into maps, slices and
+// arrays. Numbers decode into any integer type if they are integral and in
+// range, and into floats. nil and golapis.null leave pointers, slices, maps
+// and interfaces nil.
+func Unmarshal(value any, dst any) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("Unmarshal: dst must be a non-nil pointer, got %T", dst)
+	}
+	return decodeGoValue(value, rv.Elem(), "value")
+}
+
+// Unmarshal decodes argument i into dst, see Unmarshal
+func (a LuaArgs) Unmarshal(i int, dst any) error {
+	if err := Unmarshal(a.Get(i), dst); err != nil {
+		return fmt.Errorf("bad argument #%d: %v", i+1, err)
+	}
+	return nil
+}
+
+// luaField is a struct field as seen from Lua
+type luaField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var luaFieldCache sync.Map // reflect.Type -> []luaField
+
+// structLuaFields returns the fields of struct type t that Marshal encodes
+func structLuaFields(t reflect.Type) []luaField {
+	if cached, ok := luaFieldCache.Load(t); ok {
+		return cached.([]luaField)
+	}
+	fields := collectLuaFields(t, nil, nil)
+	luaFieldCache.Store(t, fields)
+	return fields
+}
+
+func collectLuaFields(t reflect.Type, index []int, visited []reflect.Type) []luaField {
+	for _, seen := range visited {
+		if seen == t {
+			return nil
+		}
+	}
+	visited = append(visited, t)
+
+	var fields []luaField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("lua")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		fieldIndex := append(append([]int(nil), index...), i)
+
+		if sf.Anonymous && name == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields = append(fields, collectLuaFields(ft, fieldIndex, visited)...)
+				continue
+			}
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, luaField{
+			name:      name,
+			index:     fieldIndex,
+			omitEmpty: opts == "omitempty",
+		})
+	}
+	return fields
+}
+
+// encodeStruct appends the instructions to push struct v as a table
+func encodeStruct(batch *LuaBatch, v reflect.Value, depth int) error {
+	fields := structLuaFields(v.Type())
+	batch.TableSized(0, len(fields))
+	for _, field := range fields {
+		fv, err := v.FieldByIndexErr(field.index)
+		if err != nil {
+			continue // field of a nil embedded pointer
+		}
+		if field.omitEmpty && fv.IsZero() {
+			continue
+		}
+		if err := encodeGoValue(batch, fv, depth+1); err != nil {
+			return fmt.Errorf("field %s: %w", field.name, err)
+		}
+		batch.SetField(field.name)
+	}
+	return nil
+}
+
+// luaValueTypeName describes a value converted from Lua for error messages
+func luaValueTypeName(value any) string {
+	switch value.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case int64, float64:
+		return "number"
+	case string:
+		return "string"
+	case []any, map[string]any:
+		return "table"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// decodeGoValue stores value (see luaToGoValue) in dst. path names the value
+// in error messages.
+func decodeGoValue(value any, dst reflect.Value, path string) error {
+	mismatch := func() error {
+		return fmt.Errorf("%s: cannot unmarshal %s into %s", path, luaValueTypeName(value), dst.Type())
+	}
+
+	if value == nil {
+		switch dst.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Map:
+			dst.SetZero()
+			return nil
+		}
+		return mismatch()
+	}
+
+	switch dst.Kind() {
+	case reflect.Pointer:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return decodeGoValue(value, dst.Elem(), path)
+	case reflect.Interface:
+		if dst.NumMethod() != 0 {
+			return mismatch()
+		}
+		dst.Set(reflect.ValueOf(value))
+		return nil
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return mismatch()
+		}
+		dst.SetBool(b)
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return mismatch()
+		}
+		dst.SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := value.(int64)
+		if !ok {
+			if _, isFloat := value.(float64); isFloat {
+				return fmt.Errorf("%s: number %s is not an integer", path, formatLuaNumber(value.(float64)))
+			}
+			return mismatch()
+		}
+		if dst.OverflowInt(n) {
+			return fmt.Errorf("%s: number %d overflows %s", path, n, dst.Type())
+		}
+		dst.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := value.(int64)
+		if !ok {
+			if _, isFloat := value.(float64); isFloat {
+				return fmt.Errorf("%s: number %s is not an integer", path, formatLuaNumber(value.(float64)))
+			}
+			return mismatch()
+		}
+		if n < 0 || dst.OverflowUint(uint64(n)) {
+			return fmt.Errorf("%s: number %d overflows %s", path, n, dst.Type())
+		}
+		dst.SetUint(uint64(n))
+	case reflect.Float32, reflect.Float64:
+		switch n := value.(type) {
+		case int64:
+			dst.SetFloat(float64(n))
+		case float64:
+			if dst.Kind() == reflect.Float32 && !math.IsInf(n, 0) && dst.OverflowFloat(n) {
+				return fmt.Errorf("%s: number %s overflows %s", path, formatLuaNumber(n), dst.Type())
+			}
+			dst.SetFloat(n)
+		default:
+			return mismatch()
+		}
+	case reflect.Slice:
+		if s, ok := value.(string); ok && dst.Type().Elem().Kind() == reflect.Uint8 {
+			dst.SetBytes([]byte(s))
+			return nil
+		}
+		items, ok := luaArrayItems(value)
+		if !ok {
+			return mismatch()
+		}
+		slice := reflect.MakeSlice(dst.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := decodeGoValue(item, slice.Index(i), path+"["+strconv.Itoa(i+1)+"]"); err != nil {
+				return err
+			}
+		}
+		dst.Set(slice)
+	case reflect.Array:
+		items, ok := luaArrayItems(value)
+		if !ok {
+			return mismatch()
+		}
+		if len(items) > dst.Len() {
+			return fmt.Errorf("%s: table has %d items, more than %s", path, len(items), dst.Type())
+		}
+		dst.SetZero()
+		for i, item := range items {
+			if err := decodeGoValue(item, dst.Index(i), path+"["+strconv.Itoa(i+1)+"]"); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		return decodeMap(value, dst, path)
+	case reflect.Struct:
+		table, ok := value.(map[string]any)
+		if !ok {
+			if items, isArray := value.([]any); !isArray || len(items) > 0 {
+				return mismatch()
+			}
+		}
+		return decodeStruct(table, dst, path)
+	default:
+		return fmt.Errorf("%s: unsupported type %s", path, dst.Type())
+	}
+	return nil
+}
+
+// luaArrayItems returns the items of an array table. An empty table converts
+// to an empty map, so it is accepted as an empty array.
+func luaArrayItems(value any) ([]any, bool) {
+	switch v := value.(type) {
+	case []any:
+		return v, true
+	case map[string]any:
+		if len(v) == 0 {
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+// decodeMap stores a table in map dst. Keys are converted from strings (or
+// from array indexes) to the map's key type.
+func decodeMap(value any, dst reflect.Value, path string) error {
+	t := dst.Type()
+	m := reflect.MakeMap(t)
+	set := func(key string, item any) error {
+		kv := reflect.New(t.Key()).Elem()
+		switch t.Key().Kind() {
+		case reflect.String:
+			kv.SetString(key)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n, err := strconv.ParseInt(key, 10, 64)
+			if err != nil || kv.OverflowInt(n) {
+				return fmt.Errorf("%s: cannot unmarshal key %q into %s", path, key, t.Key())
+			}
+			kv.SetInt(n)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n, err := strconv.ParseUint(key, 10, 64)
+			if err != nil || kv.OverflowUint(n) {
+				return fmt.Errorf("%s: cannot unmarshal key %q into %s", path, key, t.Key())
+			}
+			kv.SetUint(n)
+		case reflect.Float32, reflect.Float64:
+			n, err := strconv.ParseFloat(key, 64)
+			if err != nil {
+				return fmt.Errorf("%s: cannot unmarshal key %q into %s", path, key, t.Key())
+			}
+			kv.SetFloat(n)
+		default:
+			return fmt.Errorf("%s: unsupported map key type %s", path, t.Key())
+		}
+		ev := reflect.New(t.Elem()).Elem()
+		if err := decodeGoValue(item, ev, path+"."+key); err != nil {
+			return err
+		}
+		m.SetMapIndex(kv, ev)
+		return nil
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			if err := set(key, item); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for i, item := range v {
+			if err := set(strconv.Itoa(i+1), item); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%s: cannot unmarshal %s into %s", path, luaValueTypeName(value), t)
+	}
+	dst.Set(m)
+	return nil
+}
+
+// decodeStruct stores table in struct dst. Keys without a matching field are
+// ignored. Keys match field names exactly, or failing that case-insensitively.
+func decodeStruct(table map[string]any, dst reflect.Value, path string) error {
+	for _, field := range structLuaFields(dst.Type()) {
+		item, ok := table[field.name]
+		if !ok {
+			for key, v := range table {
+				if strings.EqualFold(key, field.name) {
+					item, ok = v, true
+					break
+				}
+			}
+		}
+		if !ok {
+			continue
+		}
+		fv, err := dst.FieldByIndexErr(field.index)
+		if err != nil {
+			// Allocate nil embedded pointers on the way to the field
+			fv = dst
+			for _, i := range field.index {
+				if fv.Kind() == reflect.Pointer {
+					if fv.IsNil() {
+						if !fv.CanSet() {
+							return fmt.Errorf("%s: cannot set embedded pointer to unexported struct", path)
+						}
+						fv.Set(reflect.New(fv.Type().Elem()))
+					}
+					fv = fv.Elem()
+				}
+				fv = fv.Field(i)
+			}
+		}
+		if err := decodeGoValue(item, fv, path+"."+field.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
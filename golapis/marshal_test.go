@@ -0,0 +1,159 @@
+package golapis
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type marshalAddress struct {
+	City string `lua:"city"`
+	Zip  string `lua:"zip,omitempty"`
+}
+
+type marshalBase struct {
+	ID int64 `lua:"id"`
+}
+
+type marshalUser struct {
+	marshalBase
+	Name     string          `lua:"name"`
+	Email    string          `lua:"email,omitempty"`
+	Age      uint8           `lua:"age"`
+	Score    float32         `lua:"score"`
+	Roles    []string        `lua:"roles"`
+	Address  *marshalAddress `lua:"address,omitempty"`
+	Limits   map[string]int  `lua:"limits,omitempty"`
+	Extra    any             `lua:"extra"`
+	Password string          `lua:"-"`
+	Labels   map[int]string  `lua:"labels,omitempty"`
+	internal string
+}
+
+func TestMarshalStructFromFunc(t *testing.T) {
+	output, err := runLuaWithFuncs(t, func(gls *GolapisLuaState) {
+		gls.RegisterFunc("users.save", func(args LuaArgs) (LuaValues, error) {
+			var user marshalUser
+			if err := args.Unmarshal(0, &user); err != nil {
+				return nil, err
+			}
+			user.ID++
+			user.Roles = append(user.Roles, "saved")
+			user.Password = "secret"
+			return LuaValues{user}, nil
+		})
+	}, `
+		local user = users.save({
+			id = 41, name = "leafo", age = 30, score = 1.5,
+			roles = { "admin" },
+			address = { city = "SF" },
+			extra = { 1, 2 },
+			labels = { "one", "two" },
+			unknown = true,
+		})
+		golapis.say(user.id, " ", user.name, " ", user.age, " ", user.score)
+		golapis.say(table.concat(user.roles, ","), " ", user.address.city, " ", tostring(user.address.zip))
+		golapis.say(tostring(user.email), " ", tostring(user.Password), " ", tostring(user.limits))
+		golapis.say(#user.extra, " ", user.labels[2])
+
+		golapis.say(users.save({ age = 300 }))
+		golapis.say(users.save({ roles = "admin" }))
+		golapis.say(users.save({ id = 1.5 }))
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+
+	expected := "42 leafo 30 1.5\n" +
+		"admin,saved SF nil\n" +
+		"nil nil nil\n" +
+		"2 two\n" +
+		"nilbad argument #1: value.age: number 300 overflows uint8\n" +
+		"nilbad argument #1: value.roles: cannot unmarshal string into []string\n" +
+		"nilbad argument #1: value.id: number 1.5 is not an integer\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestMarshalNull(t *testing.T) {
+	w, _ := runLuaWithCtx(t, `
+		local v = golapis.ctx.value
+		golapis.say(#v.list, " ", v.list[2] == golapis.null, " ", v.null == golapis.null)
+	`, func(req *GolapisRequest) {
+		err := req.SetCtx("value", map[string]any{
+			"list": []any{1, Null, 3},
+			"null": Null,
+		})
+		if err != nil {
+			t.Fatalf("SetCtx failed: %v", err)
+		}
+	})
+
+	expected := "3 true true\n"
+	if w.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, w.Body.String())
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	if _, err := Marshal(struct{ C chan int }{}); err == nil || !strings.Contains(err.Error(), "field C") {
+		t.Errorf("expected field error, got %v", err)
+	}
+	if _, err := Marshal(marshalUser{Name: "x"}); err != nil {
+		t.Errorf("Marshal: %v", err)
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	var n int
+	if err := Unmarshal(int64(5), &n); err != nil || n != 5 {
+		t.Errorf("int: got %d, %v", n, err)
+	}
+
+	var f float64
+	if err := Unmarshal(int64(5), &f); err != nil || f != 5 {
+		t.Errorf("float: got %v, %v", f, err)
+	}
+
+	var ids map[int]bool
+	if err := Unmarshal([]any{true, false}, &ids); err != nil || !reflect.DeepEqual(ids, map[int]bool{1: true, 2: false}) {
+		t.Errorf("map from array: got %v, %v", ids, err)
+	}
+
+	var arr [2]string
+	if err := Unmarshal([]any{"a", "b", "c"}, &arr); err == nil {
+		t.Error("expected error for too many array items")
+	}
+
+	var list []int
+	if err := Unmarshal(map[string]any{}, &list); err != nil || list == nil || len(list) != 0 {
+		t.Errorf("empty table: got %#v, %v", list, err)
+	}
+
+	ptr := &marshalAddress{}
+	if err := Unmarshal(nil, &ptr); err != nil || ptr != nil {
+		t.Errorf("nil pointer: got %v, %v", ptr, err)
+	}
+
+	var raw []byte
+	if err := Unmarshal("bytes", &raw); err != nil || string(raw) != "bytes" {
+		t.Errorf("bytes: got %q, %v", raw, err)
+	}
+
+	var addr marshalAddress
+	if err := Unmarshal(map[string]any{"CITY": "SF"}, &addr); err != nil || addr.City != "SF" {
+		t.Errorf("case-insensitive field: got %+v, %v", addr, err)
+	}
+
+	var e error
+	if err := Unmarshal("x", &e); err == nil {
+		t.Error("expected error for non-empty interface")
+	}
+	if err := Unmarshal("x", addr); err == nil {
+		t.Error("expected error for non-pointer dst")
+	}
+	if err := Unmarshal(true, &n); err == nil || err.Error() != "value: cannot unmarshal boolean into int" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
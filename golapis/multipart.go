@@ -0,0 +1,229 @@
+package golapis
+
+/*
+#include "lua_helpers.h"
+*/
+import "C"
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+)
+
+// UploadedFile describes a file part of a multipart/form-data request body.
+// The contents are written to a temp file that is removed at request end.
+type UploadedFile struct {
+	Name        string // form field name
+	Filename    string // client supplied filename
+	ContentType string // part Content-Type ("" if not given)
+	Size        int64  // size in bytes
+	Path        string // temp file holding the contents
+}
+
+// multipartBoundary returns the boundary if the request is multipart/form-data
+func (r *GolapisRequest) multipartBoundary() (string, bool) {
+	mediaType, params, err := mime.ParseMediaType(r.Request.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return "", false
+	}
+	boundary := params["boundary"]
+	return boundary, boundary != ""
+}
+
+// IsMultipart returns true if the request body is multipart/form-data
+func (r *GolapisRequest) IsMultipart() bool {
+	_, ok := r.multipartBoundary()
+	return ok
+}
+
+// parseMultipart parses the cached multipart body once, collecting plain
+// fields and writing file parts to temp files. ReadBody must be called first.
+func (r *GolapisRequest) parseMultipart() error {
+	if r.multipartParsed {
+		return r.multipartErr
+	}
+	r.multipartParsed = true
+
+	boundary, ok := r.multipartBoundary()
+	if !ok {
+		r.multipartErr = errors.New("not a multipart body")
+		return r.multipartErr
+	}
+
+	body, err := r.bodyReader()
+	if err != nil {
+		r.multipartErr = err
+		return err
+	}
+	defer body.Close()
+
+	mr := multipart.NewReader(body, boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			r.multipartErr = err
+			return err
+		}
+
+		name := part.FormName()
+		if part.FileName() == "" {
+			value, err := io.ReadAll(part)
+			part.Close()
+			if err != nil {
+				r.multipartErr = err
+				return err
+			}
+			if name != "" {
+				r.multipartFields = append(r.multipartFields, queryArg{key: name, value: string(value)})
+			}
+			continue
+		}
+
+		upload, err := r.saveUpload(name, part)
+		part.Close()
+		if err != nil {
+			r.multipartErr = err
+			return err
+		}
+		r.uploads = append(r.uploads, upload)
+	}
+	return nil
+}
+
+// saveUpload writes a file part to a temp file
+func (r *GolapisRequest) saveUpload(name string, part *multipart.Part) (*UploadedFile, error) {
+	f, err := r.createTempFile("golapis-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size, err := io.Copy(f, part)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UploadedFile{
+		Name:        name,
+		Filename:    part.FileName(),
+		ContentType: part.Header.Get("Content-Type"),
+		Size:        size,
+		Path:        f.Name(),
+	}, nil
+}
+
+// multipartFormFields returns the non-file fields of a multipart body
+func (r *GolapisRequest) multipartFormFields() ([]queryArg, error) {
+	if err := r.parseMultipart(); err != nil {
+		return nil, err
+	}
+	return r.multipartFields, nil
+}
+
+// Uploads returns the file parts of a multipart body. ReadBody must be called first.
+func (r *GolapisRequest) Uploads() ([]*UploadedFile, error) {
+	if err := r.parseMultipart(); err != nil {
+		return nil, err
+	}
+	return r.uploads, nil
+}
+
+// readPostArgs returns the form fields of the cached body: multipart fields
+// for multipart/form-data, otherwise the body parsed as urlencoded.
+func (r *GolapisRequest) readPostArgs(maxArgs int) ([]queryArg, bool, error) {
+	if r.IsMultipart() {
+		fields, err := r.multipartFormFields()
+		if err != nil {
+			return nil, false, err
+		}
+		if maxArgs > 0 && len(fields) > maxArgs {
+			return fields[:maxArgs], true, nil
+		}
+		return fields, false, nil
+	}
+
+	if r.bodyFile == "" {
+		if r.bodyData == nil {
+			return nil, false, nil
+		}
+		args, truncated := parseQueryString(string(r.bodyData), maxArgs)
+		return args, truncated, nil
+	}
+
+	body, err := r.bodyReader()
+	if err != nil {
+		return nil, false, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, false, err
+	}
+	args, truncated := parseQueryString(string(data), maxArgs)
+	return args, truncated, nil
+}
+
+//export golapis_req_get_uploads
+func golapis_req_get_uploads(L *C.lua_State) C.int {
+	thread := getLuaThreadFromRegistry(L)
+	if thread == nil || thread.request == nil {
+		C.lua_pushnil(L)
+		pushGoString(L, "no request found")
+		return 2
+	}
+
+	if !thread.request.BodyWasRead() {
+		C.lua_pushnil(L)
+		pushGoString(L, "request body not read")
+		return 2
+	}
+
+	if !thread.request.IsMultipart() {
+		C.lua_newtable_wrapper(L)
+		return 1
+	}
+
+	uploads, err := thread.request.Uploads()
+	if err != nil {
+		C.lua_pushnil(L)
+		pushGoString(L, err.Error())
+		return 2
+	}
+
+	b := AcquireBatch()
+	defer ReleaseBatch(b)
+
+	b.TableSized(len(uploads), 0)
+	for i, upload := range uploads {
+		b.TableSized(0, 5)
+		b.StringField("name", upload.Name)
+		b.StringField("filename", upload.Filename)
+		b.StringField("content_type", upload.ContentType)
+		b.Int64(upload.Size).SetFieldInline("size")
+		b.StringField("path", upload.Path)
+		b.SetIndex(i + 1)
+	}
+	b.Push(L)
+	return 1
+}
+
+//export golapis_req_get_body_file
+func golapis_req_get_body_file(L *C.lua_State) C.int {
+	thread := getLuaThreadFromRegistry(L)
+	if thread == nil || thread.request == nil || !thread.request.BodyWasRead() {
+		C.lua_pushnil(L)
+		return 1
+	}
+
+	path := thread.request.BodyFile()
+	if path == "" {
+		C.lua_pushnil(L)
+		return 1
+	}
+	pushGoString(L, path)
+	return 1
+}
@@ -0,0 +1,239 @@
+package golapis
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// runLuaWithRequestBody runs code against a POST request with the given body
+// and content type, spooling bodies larger than bufferSize to disk. Temp files
+// are left in place so tests can inspect them; call req.Cleanup() afterwards.
+func runLuaWithRequestBody(t *testing.T, contentType string, body []byte, bufferSize int64, code string) (*httptest.ResponseRecorder, *GolapisRequest, error) {
+	t.Helper()
+
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+
+	gls.Start()
+	defer gls.Stop()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+
+	req := NewGolapisRequest(r)
+	req.bodyBufferSize = bufferSize
+	req.bodyTempPath = t.TempDir()
+	wrappedWriter := req.WrapResponseWriter(w)
+
+	resp := make(chan *StateResponse, 1)
+	gls.eventChan <- &StateEvent{
+		Type:         EventRunString,
+		Code:         code,
+		OutputWriter: wrappedWriter,
+		Request:      req,
+		Response:     resp,
+	}
+
+	result := <-resp
+	gls.Wait()
+	req.FlushHeaders(w)
+
+	return w, req, result.Error
+}
+
+func buildMultipartBody(t *testing.T) (string, []byte) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("title", "My photo")
+	mw.WriteField("tag", "a")
+	mw.WriteField("tag", "b")
+	fw, err := mw.CreateFormFile("image", "cat.png")
+	if err != nil {
+		t.Fatalf("CreateFormFile failed: %v", err)
+	}
+	fw.Write([]byte("PNGDATA-0123456789"))
+	mw.Close()
+	return mw.FormDataContentType(), buf.Bytes()
+}
+
+func TestMultipartPostArgs(t *testing.T) {
+	contentType, body := buildMultipartBody(t)
+	w, req, err := runLuaWithRequestBody(t, contentType, body, 0, `
+		golapis.req.read_body()
+		local args = assert(golapis.req.get_post_args())
+		golapis.say("title: ", args.title)
+		golapis.say("tags: ", table.concat(args.tag, ","))
+		golapis.say("image: ", tostring(args.image))
+	`)
+	defer req.Cleanup()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "title: My photo\ntags: a,b\nimage: nil\n"
+	if w.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, w.Body.String())
+	}
+}
+
+func TestMultipartUploads(t *testing.T) {
+	contentType, body := buildMultipartBody(t)
+	w, req, err := runLuaWithRequestBody(t, contentType, body, 0, `
+		golapis.req.read_body()
+		local uploads = assert(golapis.req.get_uploads())
+		golapis.say(#uploads)
+		local f = uploads[1]
+		golapis.say(f.name, " ", f.filename, " ", f.content_type, " ", f.size)
+		local fh = assert(io.open(f.path, "rb"))
+		golapis.say(fh:read("*a"))
+		fh:close()
+		golapis.print(f.path)
+	`)
+	if err != nil {
+		req.Cleanup()
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lines := strings.Split(w.Body.String(), "\n")
+	if len(lines) != 4 {
+		req.Cleanup()
+		t.Fatalf("unexpected output: %q", w.Body.String())
+	}
+	if lines[0] != "1" {
+		t.Errorf("expected 1 upload, got %q", lines[0])
+	}
+	if lines[1] != "image cat.png application/octet-stream 18" {
+		t.Errorf("unexpected upload info: %q", lines[1])
+	}
+	if lines[2] != "PNGDATA-0123456789" {
+		t.Errorf("unexpected upload contents: %q", lines[2])
+	}
+
+	path := lines[3]
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected upload temp file to exist before cleanup: %v", err)
+	}
+	req.Cleanup()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected upload temp file to be removed, got %v", err)
+	}
+}
+
+func TestMultipartSpooledBody(t *testing.T) {
+	contentType, body := buildMultipartBody(t)
+	w, req, err := runLuaWithRequestBody(t, contentType, body, 16, `
+		golapis.req.read_body()
+		golapis.say("data: ", tostring(golapis.req.get_body_data()))
+		golapis.say("file: ", tostring(golapis.req.get_body_file() ~= nil))
+		local args = assert(golapis.req.get_post_args())
+		golapis.say("title: ", args.title)
+		local uploads = assert(golapis.req.get_uploads())
+		golapis.say("upload: ", uploads[1].filename)
+	`)
+	defer req.Cleanup()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "data: nil\nfile: true\ntitle: My photo\nupload: cat.png\n"
+	if w.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, w.Body.String())
+	}
+}
+
+func TestBodyFileSpooling(t *testing.T) {
+	body := []byte(strings.Repeat("x", 100))
+	w, req, err := runLuaWithRequestBody(t, "application/octet-stream", body, 10, `
+		golapis.req.read_body()
+		local path = assert(golapis.req.get_body_file())
+		local fh = assert(io.open(path, "rb"))
+		golapis.say(#fh:read("*a"))
+		fh:close()
+	`)
+	if err != nil {
+		req.Cleanup()
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if w.Body.String() != "100\n" {
+		t.Errorf("expected %q, got %q", "100\n", w.Body.String())
+	}
+
+	path := req.BodyFile()
+	if path == "" {
+		t.Fatal("expected body file to be set")
+	}
+	req.Cleanup()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected body temp file to be removed, got %v", err)
+	}
+}
+
+func TestBodyFileNotSpooled(t *testing.T) {
+	w, req, err := runLuaWithRequestBody(t, "application/x-www-form-urlencoded", []byte("a=1&b=2"), 1024, `
+		golapis.req.read_body()
+		golapis.say(tostring(golapis.req.get_body_file()))
+		golapis.say(golapis.req.get_body_data())
+		golapis.say(#golapis.req.get_uploads())
+	`)
+	defer req.Cleanup()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if w.Body.String() != "nil\na=1&b=2\n0\n" {
+		t.Errorf("unexpected output: %q", w.Body.String())
+	}
+}
+
+func TestSpooledUrlencodedPostArgs(t *testing.T) {
+	w, req, err := runLuaWithRequestBody(t, "application/x-www-form-urlencoded", []byte("name=leafo&lang=lua"), 4, `
+		golapis.req.read_body()
+		local args = golapis.req.get_post_args()
+		golapis.say(args.name, " ", args.lang)
+	`)
+	defer req.Cleanup()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if w.Body.String() != "leafo lua\n" {
+		t.Errorf("unexpected output: %q", w.Body.String())
+	}
+}
+
+func TestLargeBodyInMemoryByDefault(t *testing.T) {
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+
+	err := gls.LoadEntryPoint(CodeEntryPoint{Code: `
+		golapis.req.read_body()
+		local data = golapis.req.get_body_data()
+		golapis.say(#data, " ", tostring(golapis.req.get_body_file()), " ", #golapis.var.request_body)
+	`})
+	if err != nil {
+		t.Fatalf("Failed to load entry point: %v", err)
+	}
+	gls.Start()
+	defer gls.Stop()
+
+	body := strings.Repeat("x", 32*1024)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	gls.HTTPHandler(DefaultHTTPServerConfig()).ServeHTTP(w, r)
+	gls.Wait()
+
+	if w.Body.String() != "32768 nil 32768\n" {
+		t.Errorf("unexpected output: %q", w.Body.String())
+	}
+}
@@ -0,0 +1,193 @@
+package golapis
+
+/*
+#include "lua_helpers.h"
+
+// Allocator wrapper that tracks the Lua heap size and enforces a limit.
+// Allocated with malloc because the allocator holds on to it.
+typedef struct {
+    lua_Alloc allocf;
+    void *ud;
+    size_t used;
+    size_t limit;
+} limited_alloc_state;
+
+static void *limited_alloc(void *ud, void *ptr, size_t osize, size_t nsize) {
+    limited_alloc_state *s = (limited_alloc_state *)ud;
+    // Only growth is refused: Lua assumes shrinking and freeing succeed
+    if (nsize > osize && s->used + (nsize - osize) > s->limit) {
+        return NULL;
+    }
+    void *p = s->allocf(s->ud, ptr, osize, nsize);
+    if (p != NULL || nsize == 0) {
+        s->used = s->used - osize + nsize;
+    }
+    return p;
+}
+
+static limited_alloc_state *set_memory_limit(lua_State *L, size_t limit) {
+    limited_alloc_state *s = malloc(sizeof(limited_alloc_state));
+    if (s == NULL) {
+        return NULL;
+    }
+    s->allocf = lua_getallocf(L, &s->ud);
+    s->used = (size_t)lua_gc(L, LUA_GCCOUNT, 0) * 1024 + (size_t)lua_gc(L, LUA_GCCOUNTB, 0);
+    s->limit = limit;
+    lua_setallocf(L, limited_alloc, s);
+    return s;
+}
+
+// LuaJIT only destroys its allocator arena in lua_close when its own
+// allocator is installed, so the original one is put back first
+static void restore_allocator(lua_State *L, limited_alloc_state *s) {
+    lua_setallocf(L, s->allocf, s->ud);
+}
+
+static void set_package_field(lua_State *L, const char *field, const char *value) {
+    lua_getglobal(L, "package");
+    lua_pushstring(L, value);
+    lua_setfield(L, -2, field);
+    lua_pop(L, 1);
+}
+*/
+import "C"
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+	"unsafe"
+)
+
+// DefaultEventBuffer is the default size of a state's event channel
+const DefaultEventBuffer = 100
+
+// LuaLib is a set of optional standard libraries. The base, package, string,
+// table, math, bit and coroutine libraries are always open.
+type LuaLib int
+
+const (
+	LibIO    LuaLib = 1 << iota // io
+	LibOS                       // os
+	LibFFI                      // ffi, loaded with require("ffi")
+	LibDebug                    // debug
+	LibJIT                      // jit; the JIT compiler runs either way
+
+	AllLibs = LibIO | LibOS | LibFFI | LibDebug | LibJIT
+)
+
+// Options configures a state created with NewGolapisLuaStateWithOptions
+type Options struct {
+	Libs         LuaLib         // optional standard libraries to open
+	PackagePath  string         // package.path ("" = LuaJIT default)
+	PackageCPath string         // package.cpath ("" = LuaJIT default)
+	EventBuffer  int            // event channel size (0 = DefaultEventBuffer)
+	NgxAlias     bool           // alias golapis table to global ngx
+	OutputWriter io.Writer      // output of golapis.print and golapis.say outside requests (nil = os.Stdout)
+	MemoryLimit  int64          // max Lua heap size of the whole state in bytes (0 = unlimited)
+	Sandbox      *SandboxConfig // sandbox profile for untrusted code (nil = none, see SandboxedEntryPoint)
+
+	// Execution limits for each thread (request, timer, Call, ...). See
+	// NewGolapisLuaStateWithOptions.
+	MaxInstructions int64         // Lua instructions a thread may run (0 = unlimited)
+	MaxResumeTime   time.Duration // max time Lua code may run without yielding (0 = unlimited)
+	MaxRunTime      time.Duration // max time from start to finish, including waits (0 = unlimited)
+}
+
+// DefaultOptions returns the options NewGolapisLuaState uses: every standard
+// library, LuaJIT's package paths and output to stdout.
+func DefaultOptions() Options {
+	return Options{Libs: AllLibs}
+}
+
+// NewGolapisLuaStateWithOptions creates a new Lua state configured by opts and
+// initializes it with golapis functions. It returns nil if the state could not
+// be created.
+//
+// When the Lua heap would grow past MemoryLimit, the allocation fails and Lua
+// raises a "not enough memory" error in the running code. The limit covers
+// memory allocated by Lua only, not Go memory used for requests.
+//
+// MaxInstructions and MaxResumeTime are checked every 1000 instructions by a
+// count hook, which keeps code like `while true do end` from blocking the
+// event loop. The first time a limit is exceeded, the running code gets a
+// Lua error that pcall can catch. If the thread is still running shortly
+// after, it is killed and the caller gets the error (a 500 for HTTP
+// requests). Both are logged with the script and line that was running.
+// Count hooks don't run in compiled code, so setting any limit turns off the
+// JIT compiler. MaxRunTime also aborts threads waiting on sleeps and sockets,
+// like a context deadline (see RunStringContext).
+func NewGolapisLuaStateWithOptions(opts Options) *GolapisLuaState {
+	L := newLuaState(opts.Libs)
+	if L == nil {
+		return nil
+	}
+	if opts.PackagePath != "" {
+		setPackageField(L, "path", opts.PackagePath)
+	}
+	if opts.PackageCPath != "" {
+		setPackageField(L, "cpath", opts.PackageCPath)
+	}
+
+	eventBuffer := opts.EventBuffer
+	if eventBuffer <= 0 {
+		eventBuffer = DefaultEventBuffer
+	}
+	var outputWriter io.Writer = os.Stdout
+	if opts.OutputWriter != nil {
+		outputWriter = opts.OutputWriter
+	}
+
+	gls := &GolapisLuaState{
+		luaState:      L,
+		outputBuffer:  &bytes.Buffer{},
+		outputWriter:  outputWriter,
+		eventChan:     make(chan *StateEvent, eventBuffer),
+		pendingTimers: make(map[*PendingTimer]struct{}),
+		tcpPools:      make(map[string]*tcpPool),
+	}
+	gls.registerState()
+	gls.SetupGolapis()
+	if opts.NgxAlias {
+		gls.SetupNgxAlias()
+	}
+	if opts.Sandbox != nil {
+		if err := gls.setupSandbox(opts.Sandbox); err != nil {
+			gls.Close()
+			return nil
+		}
+	}
+	gls.setupLimits(opts)
+	if opts.MemoryLimit > 0 {
+		// Installed last so the golapis setup never fails for lack of memory
+		gls.allocState = unsafe.Pointer(C.set_memory_limit(L, C.size_t(opts.MemoryLimit)))
+		if gls.allocState == nil {
+			gls.Close()
+			return nil
+		}
+	}
+	return gls
+}
+
+func setPackageField(L *C.lua_State, field, value string) {
+	cfield := C.CString(field)
+	defer C.free(unsafe.Pointer(cfield))
+	cvalue := C.CString(value)
+	defer C.free(unsafe.Pointer(cvalue))
+	C.set_package_field(L, cfield, cvalue)
+}
+
+// restoreAllocator removes the memory limit allocator before lua_close
+func (gls *GolapisLuaState) restoreAllocator() {
+	if gls.allocState != nil {
+		C.restore_allocator(gls.luaState, (*C.limited_alloc_state)(gls.allocState))
+	}
+}
+
+// freeAllocState releases the memory limit allocator state after lua_close
+func (gls *GolapisLuaState) freeAllocState() {
+	if gls.allocState != nil {
+		C.free(gls.allocState)
+		gls.allocState = nil
+	}
+}
@@ -0,0 +1,120 @@
+package golapis
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// newOptionsState creates and starts a state with opts, writing output to
+// the returned buffer
+func newOptionsState(t *testing.T, opts Options) (*GolapisLuaState, *bytes.Buffer) {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	opts.OutputWriter = buf
+	gls := NewGolapisLuaStateWithOptions(opts)
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	t.Cleanup(gls.Close)
+	gls.Start()
+	t.Cleanup(gls.Stop)
+	return gls, buf
+}
+
+func TestOptionsDefaultLibs(t *testing.T) {
+	gls, buf := newOptionsState(t, DefaultOptions())
+	err := gls.RunString(`
+		golapis.say(type(io), " ", type(os), " ", type(debug), " ", type(jit))
+		golapis.say(type(require("ffi")), " ", type(require("jit.util")))
+	`)
+	if err != nil {
+		t.Fatalf("RunString: %v", err)
+	}
+	if output := buf.String(); output != "table table table table\ntable table\n" {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func TestOptionsNoOptionalLibs(t *testing.T) {
+	gls, buf := newOptionsState(t, Options{})
+	err := gls.RunString(`
+		golapis.say(type(io), " ", type(os), " ", type(debug), " ", type(jit))
+		golapis.say(type(string), " ", type(table), " ", type(bit), " ", type(coroutine))
+		golapis.say((pcall(require, "ffi")), " ", (pcall(require, "jit")), " ", (pcall(require, "debug")))
+		golapis.say(type(require("cjson")))
+	`)
+	if err != nil {
+		t.Fatalf("RunString: %v", err)
+	}
+	expected := "nil nil nil nil\ntable table table table\nfalse false false\ntable\n"
+	if output := buf.String(); output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+
+	// Tracebacks work without the debug library
+	err = gls.RunString(`local function f() error("boom") end f()`)
+	var luaErr *LuaError
+	if !errors.As(err, &luaErr) || !strings.HasPrefix(luaErr.Traceback, "stack traceback:") {
+		t.Errorf("expected a traceback, got %v", err)
+	}
+}
+
+func TestOptionsSelectedLibs(t *testing.T) {
+	gls, buf := newOptionsState(t, Options{Libs: LibOS | LibFFI})
+	err := gls.RunString(`
+		golapis.say(type(io), " ", type(os), " ", type(require("ffi")), " ", type(debug))
+	`)
+	if err != nil {
+		t.Fatalf("RunString: %v", err)
+	}
+	if output := buf.String(); output != "nil table table nil\n" {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func TestOptionsPackagePathAndAlias(t *testing.T) {
+	gls, buf := newOptionsState(t, Options{
+		PackagePath:  "/srv/app/?.lua",
+		PackageCPath: "/srv/app/?.so",
+		NgxAlias:     true,
+		EventBuffer:  5,
+	})
+	err := gls.RunString(`
+		golapis.say(package.path, " ", package.cpath, " ", ngx == golapis)
+	`)
+	if err != nil {
+		t.Fatalf("RunString: %v", err)
+	}
+	if output := buf.String(); output != "/srv/app/?.lua /srv/app/?.so true\n" {
+		t.Errorf("unexpected output %q", output)
+	}
+	if cap(gls.eventChan) != 5 {
+		t.Errorf("expected event buffer of 5, got %d", cap(gls.eventChan))
+	}
+}
+
+func TestOptionsMemoryLimit(t *testing.T) {
+	gls, buf := newOptionsState(t, Options{MemoryLimit: 8 << 20})
+
+	err := gls.RunString(`
+		local t = {}
+		for i = 1, 1e7 do
+			t[i] = string.rep("x", 64) .. i
+		end
+	`)
+	if err == nil || !strings.Contains(err.Error(), "not enough memory") {
+		t.Fatalf("expected out of memory error, got %v", err)
+	}
+
+	// Memory is reclaimed and the state keeps working
+	gls.ForceLuaGC()
+	if err := gls.RunString(`golapis.say(#string.rep("y", 1024))`); err != nil {
+		t.Fatalf("RunString after limit: %v", err)
+	}
+	if output := buf.String(); output != "1024\n" {
+		t.Errorf("unexpected output %q", output)
+	}
+}
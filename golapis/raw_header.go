@@ -0,0 +1,254 @@
+package golapis
+
+/*
+#include "lua_helpers.h"
+*/
+import "C"
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// rawHeaderConn records bytes read from an HTTP/1.x connection so the original
+// request header block, with its header order and casing, can be recovered
+// after Go's parser has canonicalized it. Recording pauses while a request is
+// being handled so request bodies are not buffered.
+type rawHeaderConn struct {
+	net.Conn
+	mu        sync.Mutex
+	buf       []byte
+	limit     int  // max bytes kept; older bytes are dropped
+	recording bool // false while a request is being handled
+}
+
+// RawHeaderListener wraps ln so HTTPHandler can recover each request's original
+// header block for golapis.req.raw_header and get_raw_headers. maxHeaderBytes
+// bounds the bytes kept per connection (0 = http.DefaultMaxHeaderBytes). It
+// only applies to plain HTTP/1.x connections and requires HTTPConnContext as
+// the server's ConnContext. StartHTTPServer uses it when PreserveRawHeaders is set.
+func RawHeaderListener(ln net.Listener, maxHeaderBytes int) net.Listener {
+	if maxHeaderBytes <= 0 {
+		maxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+	return &rawHeaderListener{Listener: ln, limit: maxHeaderBytes + 4096}
+}
+
+type rawHeaderListener struct {
+	net.Listener
+	limit int
+}
+
+func (l *rawHeaderListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &rawHeaderConn{Conn: conn, limit: l.limit, recording: true}, nil
+}
+
+func (c *rawHeaderConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.mu.Lock()
+		if c.recording {
+			c.buf = append(c.buf, b[:n]...)
+			if over := len(c.buf) - c.limit; over > 0 {
+				c.buf = append(c.buf[:0], c.buf[over:]...)
+			}
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// takeHeader returns the recorded header block that starts with requestLine,
+// including the request line and the terminating blank line, and pauses
+// recording until resume is called. Returns nil if it wasn't recorded (for
+// example when the client pipelined requests).
+func (c *rawHeaderConn) takeHeader(requestLine string) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.recording = false
+
+	// Search from the end: earlier matches may belong to requests served by
+	// other handlers on the same connection. Prefer a match at the start of a
+	// line; otherwise take the last one, which may follow an unread request body.
+	start := -1
+	for limit := len(c.buf); limit > 0; {
+		i := bytes.LastIndex(c.buf[:limit], []byte(requestLine))
+		if i < 0 {
+			break
+		}
+		if start < 0 {
+			start = i
+		}
+		if i == 0 || c.buf[i-1] == '\n' {
+			start = i
+			break
+		}
+		limit = i
+	}
+
+	var header []byte
+	if start >= 0 {
+		if end := headerBlockEnd(c.buf[start:]); end > 0 {
+			header = append([]byte(nil), c.buf[start:start+end]...)
+		}
+	}
+	c.buf = c.buf[:0]
+	return header
+}
+
+// resume restarts recording once a request has been handled
+func (c *rawHeaderConn) resume() {
+	c.mu.Lock()
+	c.recording = true
+	c.mu.Unlock()
+}
+
+// headerBlockEnd returns the length of the header block at the start of data,
+// including the blank line that ends it, or 0 if it is incomplete
+func headerBlockEnd(data []byte) int {
+	for i := 0; i < len(data); i++ {
+		if data[i] != '\n' {
+			continue
+		}
+		if i+1 < len(data) && data[i+1] == '\n' {
+			return i + 2
+		}
+		if i+2 < len(data) && data[i+1] == '\r' && data[i+2] == '\n' {
+			return i + 3
+		}
+	}
+	return 0
+}
+
+// errRawHeaderNotRecorded is returned by raw_header and get_raw_headers when
+// the original header block wasn't recorded (see RawHeaderListener)
+const errRawHeaderNotRecorded = "not recorded"
+
+// rawHeaderFields splits a header block into name/value pairs in their
+// original order, skipping the request line
+func rawHeaderFields(block []byte) [][2]string {
+	lines := strings.Split(string(block), "\n")
+	var fields [][2]string
+	for _, line := range lines[1:] {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields = append(fields, [2]string{name, strings.Trim(value, " \t")})
+	}
+	return fields
+}
+
+//export golapis_req_get_method
+func golapis_req_get_method(L *C.lua_State) C.int {
+	thread := getLuaThreadFromRegistry(L)
+	if thread == nil || thread.request == nil {
+		C.lua_pushnil(L)
+		return 1
+	}
+	pushGoString(L, thread.request.Request.Method)
+	return 1
+}
+
+//export golapis_req_http_version
+func golapis_req_http_version(L *C.lua_State) C.int {
+	thread := getLuaThreadFromRegistry(L)
+	if thread == nil || thread.request == nil {
+		C.lua_pushnil(L)
+		return 1
+	}
+	r := thread.request.Request
+	C.lua_pushnumber(L, C.lua_Number(float64(r.ProtoMajor)+float64(r.ProtoMinor)/10))
+	return 1
+}
+
+//export golapis_req_raw_header
+func golapis_req_raw_header(L *C.lua_State) C.int {
+	noRequestLine := C.lua_gettop(L) >= 1 && C.lua_toboolean(L, 1) != 0
+
+	thread := getLuaThreadFromRegistry(L)
+	if thread == nil || thread.request == nil {
+		C.lua_pushnil(L)
+		pushGoString(L, "no request found")
+		return 2
+	}
+
+	block := thread.request.rawHeaderData
+	if block == nil {
+		C.lua_pushnil(L)
+		pushGoString(L, errRawHeaderNotRecorded)
+		return 2
+	}
+	if noRequestLine {
+		if i := bytes.IndexByte(block, '\n'); i >= 0 {
+			block = block[i+1:]
+		}
+	}
+	pushGoString(L, string(block))
+	return 1
+}
+
+//export golapis_req_get_raw_headers
+func golapis_req_get_raw_headers(L *C.lua_State) C.int {
+	// 0 means unlimited
+	maxHeaders := 100
+	if C.lua_gettop(L) >= 1 && C.lua_isnumber(L, 1) != 0 {
+		maxHeaders = int(C.lua_tonumber(L, 1))
+	}
+
+	thread := getLuaThreadFromRegistry(L)
+	if thread == nil || thread.request == nil {
+		C.lua_newtable_wrapper(L)
+		return 1
+	}
+	if thread.request.rawHeaderData == nil {
+		C.lua_pushnil(L)
+		pushGoString(L, errRawHeaderNotRecorded)
+		return 2
+	}
+
+	fields := rawHeaderFields(thread.request.rawHeaderData)
+	truncated := false
+	if maxHeaders > 0 && len(fields) > maxHeaders {
+		fields = fields[:maxHeaders]
+		truncated = true
+	}
+
+	batch := AcquireBatch()
+	defer ReleaseBatch(batch)
+	batch.TableSized(len(fields), 0)
+	for i, field := range fields {
+		batch.TableSized(2, 0).
+			String(field[0]).SetIndex(1).
+			String(field[1]).SetIndex(2).
+			SetIndex(i + 1)
+	}
+	batch.Push(L)
+
+	if truncated {
+		pushGoString(L, "truncated")
+		return 2
+	}
+	return 1
+}
+
+//export golapis_req_is_internal
+func golapis_req_is_internal(L *C.lua_State) C.int {
+	thread := getLuaThreadFromRegistry(L)
+	if thread != nil && thread.request != nil && thread.request.internal {
+		C.lua_pushboolean(L, 1)
+	} else {
+		C.lua_pushboolean(L, 0)
+	}
+	return 1
+}
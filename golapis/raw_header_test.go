@@ -0,0 +1,159 @@
+package golapis
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReqMethodAndVersion(t *testing.T) {
+	w, _, err := runLuaWithHTTP(t, `
+		golapis.say(golapis.req.get_method(), " ", golapis.req.http_version())
+		golapis.say(tostring(golapis.req.is_internal()))
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+
+	expected := "GET 1.1\nfalse\n"
+	if w.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, w.Body.String())
+	}
+}
+
+func TestReqIsInternalSubrequest(t *testing.T) {
+	w, err := runLuaEntryPointHTTP(t, "/outer", `
+		if golapis.var.uri == "/inner" then
+			golapis.print(tostring(golapis.req.is_internal()))
+			return
+		end
+		local res = golapis.location.capture("/inner")
+		golapis.print(tostring(golapis.req.is_internal()), " ", res.body)
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+
+	if w.Body.String() != "false true" {
+		t.Errorf("expected %q, got %q", "false true", w.Body.String())
+	}
+}
+
+func TestReqRawHeaderNotRecorded(t *testing.T) {
+	w, _, err := runLuaWithHTTP(t, `
+		golapis.print(golapis.req.raw_header())
+		golapis.print("|", golapis.req.get_raw_headers())
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+
+	// httptest requests don't go through a RawHeaderListener
+	expected := "nilnot recorded|nilnot recorded"
+	if w.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, w.Body.String())
+	}
+}
+
+func sendRawRequests(t *testing.T, code string, requests ...string) []string {
+	t.Helper()
+
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+
+	if err := gls.LoadEntryPoint(CodeEntryPoint{Code: code}); err != nil {
+		t.Fatalf("Failed to load entry point: %v", err)
+	}
+
+	gls.Start()
+	defer gls.Stop()
+
+	server := httptest.NewUnstartedServer(gls.HTTPHandler(DefaultHTTPServerConfig()))
+	server.Listener = RawHeaderListener(server.Listener, 0)
+	server.Config.ConnContext = HTTPConnContext
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	var bodies []string
+	for _, request := range requests {
+		if _, err := conn.Write([]byte(request)); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		bodies = append(bodies, string(body))
+	}
+	return bodies
+}
+
+func TestReqRawHeaderPreserved(t *testing.T) {
+	first := "POST /sign?x=1 HTTP/1.1\r\nhost: example.com\r\nX-Sig-B: 2\r\nx-sig-a:  1\r\nContent-Length: 4\r\n\r\n"
+	second := "GET /sign HTTP/1.1\r\nHost: example.com\r\nX-Lower-case: yes\r\n\r\n"
+
+	bodies := sendRawRequests(t, `
+		golapis.print(golapis.req.raw_header(), "|", golapis.req.raw_header(true), "|")
+		for _, h in ipairs(golapis.req.get_raw_headers()) do
+			golapis.print(h[1], "=", h[2], ";")
+		end
+	`, first+"body", second)
+
+	expected := []string{
+		first + "|" + strings.SplitN(first, "\r\n", 2)[1] + "|host=example.com;X-Sig-B=2;x-sig-a=1;Content-Length=4;",
+		second + "|" + strings.SplitN(second, "\r\n", 2)[1] + "|Host=example.com;X-Lower-case=yes;",
+	}
+	for i := range expected {
+		if bodies[i] != expected[i] {
+			t.Errorf("request %d: expected %q, got %q", i, expected[i], bodies[i])
+		}
+	}
+}
+
+func TestReqGetRawHeadersTruncated(t *testing.T) {
+	bodies := sendRawRequests(t, `
+		local headers, err = golapis.req.get_raw_headers(2)
+		golapis.print(#headers, " ", headers[2][1], " ", err)
+	`, "GET / HTTP/1.1\r\nHost: a\r\nB: 1\r\nC: 2\r\n\r\n")
+
+	if bodies[0] != "2 B truncated" {
+		t.Errorf("expected %q, got %q", "2 B truncated", bodies[0])
+	}
+}
+
+func TestRawHeaderConnTakeHeader(t *testing.T) {
+	c := &rawHeaderConn{recording: true, limit: 1024}
+	c.buf = []byte("GET / HTTP/1.1\r\nA: old\r\n\r\nGET / HTTP/1.1\r\nA: new\r\n\r\nbody")
+
+	header := c.takeHeader("GET / HTTP/1.1")
+	if string(header) != "GET / HTTP/1.1\r\nA: new\r\n\r\n" {
+		t.Errorf("unexpected header %q", header)
+	}
+	if c.recording || len(c.buf) != 0 {
+		t.Error("expected recording to pause and buffer to be cleared")
+	}
+
+	c.resume()
+	c.buf = []byte("GET / HTTP/1.1\r\nIncomplete: yes\r\n")
+	if header := c.takeHeader("GET / HTTP/1.1"); header != nil {
+		t.Errorf("expected nil for incomplete header, got %q", header)
+	}
+}
@@ -0,0 +1,308 @@
+package golapis
+
+/*
+#include "lua_helpers.h"
+*/
+import "C"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// errReadOnlySocket is returned when writing to the request body socket
+var errReadOnlySocket = errors.New("read-only socket")
+
+// requestBodyConn adapts an HTTP request body stream to net.Conn so it can
+// back a read-only downstream TCPSocket (golapis.req.socket()).
+type requestBodyConn struct {
+	body       io.ReadCloser
+	controller *http.ResponseController // used for read deadlines (nil if unavailable)
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (c *requestBodyConn) Read(b []byte) (int, error) {
+	n, err := c.body.Read(b)
+	if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		// Unwrap so the socket layer reports "timeout"
+		return n, os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *requestBodyConn) Write(b []byte) (int, error) {
+	return 0, errReadOnlySocket
+}
+
+func (c *requestBodyConn) Close() error {
+	return c.body.Close()
+}
+
+func (c *requestBodyConn) LocalAddr() net.Addr  { return c.localAddr }
+func (c *requestBodyConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *requestBodyConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *requestBodyConn) SetReadDeadline(t time.Time) error {
+	if c.controller == nil {
+		return http.ErrNotSupported
+	}
+	return c.controller.SetReadDeadline(t)
+}
+
+func (c *requestBodyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// requestAddr is a net.Addr for an HTTP request's textual remote address
+type requestAddr string
+
+func (a requestAddr) Network() string { return "tcp" }
+func (a requestAddr) String() string  { return string(a) }
+
+// requestHasBody reports whether the request carries a body to stream
+func requestHasBody(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return false
+	}
+	return r.ContentLength != 0 || len(r.TransferEncoding) > 0
+}
+
+//export golapis_req_socket
+func golapis_req_socket(L *C.lua_State) C.int {
+	thread := getLuaThreadFromRegistry(L)
+	if thread != nil && thread.stream != nil {
+		return pushStreamReqSocket(L, thread)
+	}
+	if thread == nil || thread.request == nil {
+		C.lua_pushnil(L)
+		pushGoString(L, "no downstream connection")
+		return 2
+	}
+
+	raw := C.lua_gettop(L) >= 1 && C.lua_toboolean(L, 1) != 0
+	if raw {
+		return pushRawReqSocket(L, thread)
+	}
+	return pushBodyReqSocket(L, thread)
+}
+
+// pushStreamReqSocket pushes the socket for a stream or UDP session
+func pushStreamReqSocket(L *C.lua_State, thread *LuaThread) C.int {
+	stream := thread.stream
+	if stream.socketTaken {
+		C.lua_pushnil(L)
+		pushGoString(L, "duplicate call")
+		return 2
+	}
+	stream.socketTaken = true
+
+	if stream.Protocol == "UDP" {
+		sock := &UDPSocket{
+			conn:        stream.Conn,
+			connected:   true,
+			downstream:  true,
+			ownerThread: thread,
+		}
+		if stream.LocalAddr() != nil && stream.LocalAddr().Network() == "unixgram" {
+			sock.isUnix = true
+		}
+		id := pushUDPSocket(L, sock)
+
+		if debugEnabled {
+			debugLog("req.socket: udp id=%d co=%p remote=%v", id, L, stream.RemoteAddr())
+		}
+		return 1
+	}
+
+	sock := &TCPSocket{
+		conn:        stream.Conn,
+		connected:   true,
+		downstream:  true,
+		ownerThread: thread,
+	}
+	if stream.LocalAddr() != nil && stream.LocalAddr().Network() == "unix" {
+		sock.isUnix = true
+	}
+	id := pushTCPSocket(L, sock)
+
+	if debugEnabled {
+		debugLog("req.socket: id=%d co=%p remote=%v", id, L, stream.RemoteAddr())
+	}
+	return 1
+}
+
+// pushBodyReqSocket pushes a read-only socket over the HTTP request body stream
+func pushBodyReqSocket(L *C.lua_State, thread *LuaThread) C.int {
+	req := thread.request
+	if req.socketTaken {
+		C.lua_pushnil(L)
+		pushGoString(L, "duplicate call")
+		return 2
+	}
+	if req.BodyWasRead() {
+		C.lua_pushnil(L)
+		pushGoString(L, "request body already exists")
+		return 2
+	}
+	if !requestHasBody(req.Request) {
+		C.lua_pushnil(L)
+		pushGoString(L, "no body")
+		return 2
+	}
+
+	req.socketTaken = true
+	req.bodyStreamed = true
+
+	conn := &requestBodyConn{
+		body:       req.Request.Body,
+		remoteAddr: requestAddr(req.Request.RemoteAddr),
+	}
+	if req.responseWriter != nil {
+		conn.controller = http.NewResponseController(req.responseWriter)
+	}
+	if addr, ok := req.Request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.localAddr = addr
+	}
+
+	sock := &TCPSocket{
+		conn:        conn,
+		connected:   true,
+		downstream:  true,
+		ownerThread: thread,
+	}
+	id := pushTCPSocket(L, sock)
+
+	if debugEnabled {
+		debugLog("req.socket: body id=%d co=%p", id, L)
+	}
+	return 1
+}
+
+// pushRawReqSocket hijacks the HTTP connection and pushes a full-duplex socket for it.
+// Pending response headers are written to the connection first, without chunked
+// encoding. If headers were already sent with chunked encoding the hijack is
+// refused, since raw writes would break the framing.
+func pushRawReqSocket(L *C.lua_State, thread *LuaThread) C.int {
+	req := thread.request
+	if req.socketTaken {
+		C.lua_pushnil(L)
+		pushGoString(L, "duplicate call")
+		return 2
+	}
+	if req.responseWriter == nil {
+		C.lua_pushnil(L)
+		pushGoString(L, "raw request socket not supported")
+		return 2
+	}
+
+	controller := http.NewResponseController(req.responseWriter)
+	if req.HeadersSent {
+		if responseIsChunked(req.Request, req.ResponseStatus, req.responseWriter.Header()) {
+			C.lua_pushnil(L)
+			pushGoString(L, "response header already sent with chunked encoding")
+			return 2
+		}
+		if err := controller.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			C.lua_pushnil(L)
+			pushGoString(L, err.Error())
+			return 2
+		}
+	}
+
+	conn, brw, err := controller.Hijack()
+	if err != nil {
+		C.lua_pushnil(L)
+		if errors.Is(err, http.ErrNotSupported) {
+			pushGoString(L, "raw request socket not supported")
+		} else {
+			pushGoString(L, err.Error())
+		}
+		return 2
+	}
+
+	req.socketTaken = true
+	req.hijackedConn = conn
+	if !req.HeadersSent {
+		if err := req.writeRawResponseHeader(conn); err != nil {
+			conn.Close()
+			C.lua_pushnil(L)
+			pushGoString(L, err.Error())
+			return 2
+		}
+	}
+	// Headers can no longer be sent through the ResponseWriter
+	req.HeadersSent = true
+	// Further golapis.say/print output goes straight to the connection
+	thread.outputWriter = conn
+
+	sock := &TCPSocket{
+		conn:        conn,
+		connected:   true,
+		downstream:  true,
+		ownerThread: thread,
+	}
+	// Bytes the HTTP server already read past the request headers
+	if n := brw.Reader.Buffered(); n > 0 {
+		buffered, _ := brw.Reader.Peek(n)
+		sock.readBuf = append([]byte(nil), buffered...)
+	}
+	id := pushTCPSocket(L, sock)
+
+	if debugEnabled {
+		debugLog("req.socket: raw id=%d co=%p remote=%s", id, L, req.Request.RemoteAddr)
+	}
+	return 1
+}
+
+// responseIsChunked reports whether net/http frames a response with
+// Transfer-Encoding: chunked: HTTP/1.1 responses with a body and no
+// Content-Length
+func responseIsChunked(r *http.Request, status int, header http.Header) bool {
+	if !r.ProtoAtLeast(1, 1) || !bodyAllowedForStatus(status) {
+		return false
+	}
+	return header.Get("Content-Length") == ""
+}
+
+// bodyAllowedForStatus reports whether a response with status may have a body
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// writeRawResponseHeader writes the pending status line and headers to a
+// hijacked connection. Without a Content-Length the body is delimited by
+// closing the connection, so Connection: close is added.
+func (r *GolapisRequest) writeRawResponseHeader(w io.Writer) error {
+	status := r.ResponseStatus
+	if status == 0 {
+		status = http.StatusOK
+	}
+	header := r.ResponseHeaders.Clone()
+	if header.Get("Date") == "" {
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	if bodyAllowedForStatus(status) && header.Get("Content-Length") == "" {
+		header.Set("Connection", "close")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/%d.%d %d %s\r\n", r.Request.ProtoMajor, r.Request.ProtoMinor, status, http.StatusText(status))
+	header.Write(&buf)
+	buf.WriteString("\r\n")
+	r.headerBytesSent = int64(buf.Len())
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,251 @@
+package golapis
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReqSocketBodyReceive(t *testing.T) {
+	w, err := runLuaWithHTTPBody(t, "line one\nline two\nrest", `
+		local sock = assert(golapis.req.socket())
+		local line1 = assert(sock:receive())
+		local chunk = assert(sock:receive(4))
+		local rest, err, partial = sock:receive("*a")
+		golapis.say(line1, "|", chunk, "|", rest)
+	`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := w.Body.String(); got != "line one|line| two\nrest\n" {
+		t.Errorf("unexpected body: %q", got)
+	}
+}
+
+func TestReqSocketBodyReceiveany(t *testing.T) {
+	w, err := runLuaWithHTTPBody(t, "abcdef", `
+		local sock = assert(golapis.req.socket())
+		local parts = {}
+		while true do
+			local data, err = sock:receiveany(4)
+			if not data then
+				table.insert(parts, err)
+				break
+			end
+			table.insert(parts, data)
+		end
+		golapis.say(table.concat(parts, ","))
+	`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := w.Body.String(); got != "abcd,ef,closed\n" {
+		t.Errorf("unexpected body: %q", got)
+	}
+}
+
+func TestReqSocketBodyErrors(t *testing.T) {
+	w, err := runLuaWithHTTPBody(t, "data", `
+		local sock = assert(golapis.req.socket())
+		local dup, err = golapis.req.socket()
+		golapis.say("dup: ", tostring(dup), " ", err)
+		local ok, err = sock:send("x")
+		golapis.say("send: ", tostring(ok), " ", err)
+		local ok, err = golapis.req.read_body()
+		golapis.say("read_body: ", tostring(ok), " ", err)
+	`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, want := range []string{
+		"dup: nil duplicate call",
+		"send: nil read-only socket",
+		"read_body: nil request body consumed by req.socket",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("expected body to contain %q, got %q", want, w.Body.String())
+		}
+	}
+}
+
+func TestReqSocketBodyAlreadyRead(t *testing.T) {
+	w, err := runLuaWithHTTPBody(t, "data", `
+		golapis.req.read_body()
+		local sock, err = golapis.req.socket()
+		golapis.say(tostring(sock), " ", err)
+	`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := w.Body.String(); got != "nil request body already exists\n" {
+		t.Errorf("unexpected body: %q", got)
+	}
+}
+
+func TestReqSocketNoBody(t *testing.T) {
+	w, _, err := runLuaWithHTTP(t, `
+		local sock, err = golapis.req.socket()
+		golapis.say(tostring(sock), " ", err)
+	`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := w.Body.String(); got != "nil no body\n" {
+		t.Errorf("unexpected body: %q", got)
+	}
+}
+
+func TestReqSocketRawNotSupported(t *testing.T) {
+	// httptest.ResponseRecorder cannot be hijacked
+	w, _, err := runLuaWithHTTP(t, `
+		local sock, err = golapis.req.socket(true)
+		golapis.say(tostring(sock), " ", err)
+	`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := w.Body.String(); got != "nil raw request socket not supported\n" {
+		t.Errorf("unexpected body: %q", got)
+	}
+}
+
+func TestReqSocketRawHijack(t *testing.T) {
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+
+	err := gls.LoadEntryPoint(CodeEntryPoint{Code: `
+		golapis.status = 101
+		golapis.header["Upgrade"] = "echo"
+		golapis.header["Connection"] = "Upgrade"
+		local sock = assert(golapis.req.socket(true))
+		while true do
+			local line = sock:receive()
+			if not line or line == "quit" then break end
+			sock:send("echo: " .. line .. "\n")
+		end
+	`})
+	if err != nil {
+		t.Fatalf("Failed to load entry point: %v", err)
+	}
+
+	gls.Start()
+	defer gls.Stop()
+
+	server := httptest.NewServer(gls.HTTPHandler(nil))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The first line after the headers arrives in the same packet, so it is
+	// already buffered by the HTTP server when the connection is hijacked
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\nhello\n")
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("expected 101 with Upgrade header, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil || line != "echo: hello\n" {
+		t.Fatalf("expected %q, got %q (%v)", "echo: hello\n", line, err)
+	}
+
+	io.WriteString(conn, "world\n")
+	line, err = r.ReadString('\n')
+	if err != nil || line != "echo: world\n" {
+		t.Fatalf("expected %q, got %q (%v)", "echo: world\n", line, err)
+	}
+
+	io.WriteString(conn, "quit\n")
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("expected connection to be closed, got %v", err)
+	}
+}
+
+// runRawSocketServer serves code with a real HTTP server so the connection can be hijacked
+func runRawSocketServer(t *testing.T, code string) *httptest.Server {
+	t.Helper()
+
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	t.Cleanup(gls.Close)
+	if err := gls.LoadEntryPoint(CodeEntryPoint{Code: code}); err != nil {
+		t.Fatalf("Failed to load entry point: %v", err)
+	}
+	gls.Start()
+	t.Cleanup(gls.Stop)
+
+	server := httptest.NewServer(gls.HTTPHandler(nil))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestReqSocketRawSendsPendingHeaders(t *testing.T) {
+	server := runRawSocketServer(t, `
+		golapis.status = 201
+		golapis.header["X-Test"] = "yes"
+		local sock = assert(golapis.req.socket(true))
+		sock:send("raw body")
+	`)
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("X-Test") != "yes" {
+		t.Errorf("expected 201 with X-Test header, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if len(resp.TransferEncoding) != 0 || !resp.Close {
+		t.Errorf("expected a close-delimited body, got %v close=%v", resp.TransferEncoding, resp.Close)
+	}
+	if string(body) != "raw body" {
+		t.Errorf("unexpected body: %q", body)
+	}
+}
+
+func TestReqSocketRawAfterChunkedHeaders(t *testing.T) {
+	server := runRawSocketServer(t, `
+		golapis.say("start")
+		local sock, err = golapis.req.socket(true)
+		golapis.say(tostring(sock), " ", err)
+	`)
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read body: %v", err)
+	}
+	if string(body) != "start\nnil response header already sent with chunked encoding\n" {
+		t.Errorf("unexpected body: %q", body)
+	}
+}
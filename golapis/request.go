@@ -1,15 +1,24 @@
 package golapis
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"os"
 	"time"
 )
 
 // ErrBodyTooLarge is returned when the request body exceeds the maximum size
 var ErrBodyTooLarge = errors.New("request body too large")
 
+// ErrBodyStreamed is returned by ReadBody after the body was handed to golapis.req.socket()
+var ErrBodyStreamed = errors.New("request body consumed by req.socket")
+
 // GolapisRequest wraps an HTTP request and holds request processing state
 type GolapisRequest struct {
 	Request         *http.Request // The underlying HTTP request
@@ -23,8 +32,48 @@ type GolapisRequest struct {
 	bodyData []byte // Cached body content
 	bodyErr  error  // Error from reading body (if any)
 
+	// Response accounting (for $body_bytes_sent and $bytes_sent)
+	stats           *responseStatsWriter // counts response body bytes, shared with the access log
+	headerBytesSent int64                // estimated size of the status line and response headers
+
+	// Connection and server details (for golapis.var)
+	requestID    string // lazily generated $request_id
+	connID       uint64 // $connection (0 if the server did not provide HTTPConnContext)
+	connRequests uint64 // $connection_requests
+	serverName   string // $server_name
+
+	// User-defined variables (nil value = declared but unset). May be shared
+	// with subrequests created with share_all_vars.
+	vars map[string]*string
+
+	// Original request header block (nil if not recorded, see RawHeaderListener)
+	rawHeaderData []byte
+	internal      bool // subrequest created by location.capture
+
+	// golapis.ctx values injected from Go (SetCtx) and, for requests created
+	// with PrepareRequest, the contents of golapis.ctx after the handler ran (GetCtx)
+	ctxValues  map[string]any
+	ctxResult  map[string]any
+	captureCtx bool
+
+	// Downstream socket state (golapis.req.socket)
+	responseWriter http.ResponseWriter // underlying writer, used for read deadlines and hijacking
+	socketTaken    bool                // req.socket() has already returned a socket
+	bodyStreamed   bool                // body is being read through req.socket()
+	hijackedConn   net.Conn            // connection taken over by req.socket(true)
+
+	// Body spooling and multipart state
+	bodyFile        string          // temp file holding the body when it exceeded bodyBufferSize
+	multipartParsed bool            // multipart body has been parsed
+	multipartFields []queryArg      // non-file multipart fields
+	uploads         []*UploadedFile // file parts written to temp files
+	multipartErr    error           // error from parsing the multipart body
+	tempFiles       []string        // temp files removed by Cleanup
+
 	// Configuration
-	maxBodySize int64 // max body size in bytes (0 = unlimited)
+	maxBodySize    int64  // max body size in bytes (0 = unlimited)
+	bodyBufferSize int64  // bodies larger than this are spooled to a temp file (0 = never spool)
+	bodyTempPath   string // directory for spooled bodies and uploads ("" = os.TempDir())
 }
 
 // NewGolapisRequest creates a new GolapisRequest from an http.Request
@@ -37,6 +86,17 @@ func NewGolapisRequest(r *http.Request) *GolapisRequest {
 	}
 }
 
+// RequestID returns the request's unique identifier: 32 random hex digits,
+// generated on first use like nginx's $request_id
+func (r *GolapisRequest) RequestID() string {
+	if r.requestID == "" {
+		var buf [16]byte
+		rand.Read(buf[:])
+		r.requestID = hex.EncodeToString(buf[:])
+	}
+	return r.requestID
+}
+
 // StartTime returns the timestamp when the request was created
 func (r *GolapisRequest) StartTime() time.Time {
 	return r.startTime
@@ -58,11 +118,33 @@ func (r *GolapisRequest) FlushHeaders(w http.ResponseWriter) bool {
 	if status == 0 {
 		status = http.StatusOK
 	}
+	r.headerBytesSent = estimateHeaderBytes(r.Request, status, w.Header())
 	w.WriteHeader(status)
 	r.HeadersSent = true
 	return true
 }
 
+// estimateHeaderBytes estimates the size of the status line and header block
+// for a response. Headers added later by net/http (e.g. Date) are not included.
+func estimateHeaderBytes(req *http.Request, status int, header http.Header) int64 {
+	proto := "HTTP/1.1"
+	if req != nil && req.Proto != "" {
+		proto = req.Proto
+	}
+	var counter byteCounter
+	fmt.Fprintf(&counter, "%s %d %s\r\n", proto, status, http.StatusText(status))
+	header.Write(&counter)
+	return int64(counter) + 2
+}
+
+// byteCounter is an io.Writer that counts the bytes written to it
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
 // headerFlushingWriter wraps an http.ResponseWriter to automatically flush
 // accumulated response headers on the first write.
 type headerFlushingWriter struct {
@@ -77,23 +159,61 @@ func (w *headerFlushingWriter) Write(data []byte) (int, error) {
 }
 
 // WrapResponseWriter creates a headerFlushingWriter that will apply
-// accumulated headers from the GolapisRequest on first write.
+// accumulated headers from the GolapisRequest on first write. Body bytes are
+// counted by the responseStatsWriter w wraps, such as the access log's, or by
+// a new one.
 func (r *GolapisRequest) WrapResponseWriter(w http.ResponseWriter) *headerFlushingWriter {
+	r.responseWriter = w
+	r.stats = findResponseStatsWriter(w)
+	if r.stats == nil {
+		r.stats = newResponseStatsWriter(w)
+		w = r.stats
+	}
 	return &headerFlushingWriter{
 		ResponseWriter: w,
 		request:        r,
 	}
 }
 
+// findResponseStatsWriter returns the responseStatsWriter in w's Unwrap chain, or nil
+func findResponseStatsWriter(w http.ResponseWriter) *responseStatsWriter {
+	for w != nil {
+		if stats, ok := w.(*responseStatsWriter); ok {
+			return stats
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = unwrapper.Unwrap()
+	}
+	return nil
+}
+
+// bodyBytesSent returns the number of response body bytes written so far
+func (r *GolapisRequest) bodyBytesSent() int64 {
+	if r.stats == nil {
+		return 0
+	}
+	return r.stats.bodyBytes
+}
+
 // ReadBody reads and caches the request body. Safe to call multiple times.
 // Returns the cached body data and any error from the initial read.
 // If the body exceeds maxBodySize, returns ErrBodyTooLarge.
+// Bodies larger than bodyBufferSize are written to a temp file instead (see
+// BodyFile) and ReadBody returns nil data for them.
 func (r *GolapisRequest) ReadBody() ([]byte, error) {
 	if r.bodyRead {
 		return r.bodyData, r.bodyErr
 	}
 
 	r.bodyRead = true
+	if r.bodyStreamed {
+		r.bodyData = nil
+		r.bodyErr = ErrBodyStreamed
+		return nil, r.bodyErr
+	}
 	if r.Request.Body == nil {
 		r.bodyData = nil
 		r.bodyErr = nil
@@ -116,16 +236,33 @@ func (r *GolapisRequest) ReadBody() ([]byte, error) {
 		reader = io.LimitReader(r.Request.Body, r.maxBodySize+1)
 	}
 
-	data, err := io.ReadAll(reader)
+	// Buffer in memory up to bodyBufferSize, spooling anything larger to disk
+	memReader := reader
+	if r.bodyBufferSize > 0 {
+		memReader = io.LimitReader(reader, r.bodyBufferSize+1)
+	}
+
+	data, err := io.ReadAll(memReader)
 	if err != nil {
 		r.bodyData = nil
 		r.bodyErr = err
 		return nil, err
 	}
 
+	size := int64(len(data))
+	if r.bodyBufferSize > 0 && size > r.bodyBufferSize {
+		size, err = r.spoolBody(data, reader)
+		data = nil
+		if err != nil {
+			r.bodyErr = err
+			return nil, err
+		}
+	}
+
 	// Check if we hit the limit (read more than maxBodySize)
-	if r.maxBodySize > 0 && int64(len(data)) > r.maxBodySize {
+	if r.maxBodySize > 0 && size > r.maxBodySize {
 		r.bodyData = nil
+		r.bodyFile = ""
 		r.bodyErr = ErrBodyTooLarge
 		return nil, r.bodyErr
 	}
@@ -135,6 +272,59 @@ func (r *GolapisRequest) ReadBody() ([]byte, error) {
 	return r.bodyData, nil
 }
 
+// spoolBody writes the already buffered prefix and the rest of reader to a
+// temp file, recording it as the request's body file. Returns the body size.
+func (r *GolapisRequest) spoolBody(prefix []byte, reader io.Reader) (int64, error) {
+	f, err := r.createTempFile("golapis-body-*")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(prefix); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, reader)
+	if err != nil {
+		return 0, err
+	}
+	r.bodyFile = f.Name()
+	return int64(len(prefix)) + n, nil
+}
+
+// createTempFile creates a temp file in bodyTempPath that is removed by Cleanup
+func (r *GolapisRequest) createTempFile(pattern string) (*os.File, error) {
+	f, err := os.CreateTemp(r.bodyTempPath, pattern)
+	if err != nil {
+		return nil, err
+	}
+	r.tempFiles = append(r.tempFiles, f.Name())
+	return f, nil
+}
+
+// BodyFile returns the path of the temp file holding the request body, or ""
+// if the body was not read or was small enough to be kept in memory
+func (r *GolapisRequest) BodyFile() string {
+	return r.bodyFile
+}
+
+// bodyReader returns a reader over the cached body, whether in memory or spooled
+func (r *GolapisRequest) bodyReader() (io.ReadCloser, error) {
+	if r.bodyFile != "" {
+		return os.Open(r.bodyFile)
+	}
+	return io.NopCloser(bytes.NewReader(r.bodyData)), nil
+}
+
+// Cleanup removes temp files created for the request body and uploads.
+// Called by the HTTP handler once the request has completed.
+func (r *GolapisRequest) Cleanup() {
+	for _, path := range r.tempFiles {
+		os.Remove(path)
+	}
+	r.tempFiles = nil
+}
+
 // BodyWasRead returns true if ReadBody has been called
 func (r *GolapisRequest) BodyWasRead() bool {
 	return r.bodyRead
@@ -144,3 +334,16 @@ func (r *GolapisRequest) BodyWasRead() bool {
 func (r *GolapisRequest) GetBody() []byte {
 	return r.bodyData
 }
+
+// Hijacked returns true if the connection was taken over by req.socket(true).
+// The HTTP handler must not write a response for hijacked requests.
+func (r *GolapisRequest) Hijacked() bool {
+	return r.hijackedConn != nil
+}
+
+// CloseHijacked closes the connection taken over by req.socket(true), if any
+func (r *GolapisRequest) CloseHijacked() {
+	if r.hijackedConn != nil {
+		r.hijackedConn.Close()
+	}
+}
@@ -0,0 +1,92 @@
+package golapis
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRespGetHeaders(t *testing.T) {
+	w, _, err := runLuaWithHTTP(t, `
+		golapis.header["X-Single"] = "one"
+		golapis.header["Set-Cookie"] = { "a=1", "b=2" }
+		golapis.header.content_type = "text/plain"
+		local h = golapis.resp.get_headers()
+		golapis.say(h["x-single"], " ", h.content_type, " ", h["Content-Type"])
+		golapis.say(type(h["set-cookie"]), " ", h["set-cookie"][1], " ", h["set-cookie"][2])
+		local raw = golapis.resp.get_headers(0, true)
+		golapis.say(raw["X-Single"], " ", tostring(raw["x-single"]))
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+
+	expected := "one text/plain text/plain\ntable a=1 b=2\none nil\n"
+	if w.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, w.Body.String())
+	}
+}
+
+func TestRespGetHeadersTruncated(t *testing.T) {
+	w, _, err := runLuaWithHTTP(t, `
+		golapis.header["A-Header"] = "1"
+		golapis.header["B-Header"] = { "2", "3" }
+		golapis.header["C-Header"] = "4"
+		local h, err = golapis.resp.get_headers(2)
+		golapis.say(h["a-header"], " ", h["b-header"], " ", tostring(h["c-header"]), " ", err)
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+
+	expected := "1 2 nil truncated\n"
+	if w.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, w.Body.String())
+	}
+}
+
+func TestRespAddHeader(t *testing.T) {
+	w, _, err := runLuaWithHTTP(t, `
+		golapis.header["X-Multi"] = "one"
+		golapis.resp.add_header("X-Multi", "two")
+		golapis.resp.add_header("x_multi", { "three", 4 })
+		golapis.header.content_type = "text/plain"
+		golapis.resp.add_header("Content-Type", "text/html")
+		golapis.say("ok")
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+
+	if got := w.Header().Values("X-Multi"); !reflect.DeepEqual(got, []string{"one", "two", "three", "4"}) {
+		t.Errorf("X-Multi = %q", got)
+	}
+	if got := w.Header().Values("Content-Type"); !reflect.DeepEqual(got, []string{"text/html"}) {
+		t.Errorf("Content-Type = %q", got)
+	}
+}
+
+func TestRespAfterHeadersSent(t *testing.T) {
+	w, _, err := runLuaWithHTTP(t, `
+		golapis.say("body")
+		local ok, err = pcall(golapis.resp.add_header, "X-Late", "1")
+		golapis.say(tostring(ok), " ", err)
+		ok, err = pcall(golapis.resp.get_headers)
+		golapis.say(tostring(ok), " ", err)
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+
+	for _, want := range []string{
+		"false attempt to set header 'X-Late' after headers have been sent",
+		"false attempt to read response headers after headers have been sent",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("expected output to contain %q, got %q", want, w.Body.String())
+		}
+	}
+	if w.Header().Get("X-Late") != "" {
+		t.Error("late header should not be set")
+	}
+}
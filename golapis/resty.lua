@@ -0,0 +1,230 @@
+-- resty.lua
+-- OpenResty library compatible modules registered in package.preload:
+-- resty.sha256, resty.random, resty.aes and resty.string (backed by
+-- golapis.crypto) and resty.lock (backed by golapis.lock)
+local golapis = ...
+local crypto = golapis.crypto
+
+local preload = package.preload
+
+-- resty.sha256: incremental hashing. Updates are buffered and hashed on
+-- final(), so memory use grows with the amount of data hashed.
+preload["resty.sha256"] = function()
+  local _M = { _VERSION = "0.14" }
+  local mt = { __index = _M }
+
+  function _M.new(self)
+    return setmetatable({ chunks = {} }, mt)
+  end
+
+  function _M.update(self, s)
+    local chunks = self.chunks
+    chunks[#chunks + 1] = s
+    return true
+  end
+
+  function _M.final(self)
+    return crypto.sha256_bin(table.concat(self.chunks))
+  end
+
+  function _M.reset(self)
+    self.chunks = {}
+    return true
+  end
+
+  return _M
+end
+
+preload["resty.random"] = function()
+  local _M = { _VERSION = "0.14" }
+
+  function _M.bytes(len, strong)
+    return (crypto.random_bytes(len, strong))
+  end
+
+  return _M
+end
+
+preload["resty.string"] = function()
+  local _M = { _VERSION = "0.14" }
+
+  local byte, format, gsub = string.byte, string.format, string.gsub
+
+  function _M.to_hex(s)
+    return (gsub(s, ".", function(c)
+      return format("%02x", byte(c))
+    end))
+  end
+
+  -- Like C's atoi: leading whitespace, optional sign, digits; 0 otherwise
+  function _M.atoi(s)
+    local digits = string.match(s, "^%s*([-+]?%d+)")
+    return digits and tonumber(digits) or 0
+  end
+
+  return _M
+end
+
+preload["resty.aes"] = function()
+  local _M = { _VERSION = "0.14" }
+  local mt = { __index = _M }
+
+  -- Digest names used to derive keys with EVP_BytesToKey
+  _M.hash = {
+    md5 = "md5",
+    sha1 = "sha1",
+    sha224 = "sha224",
+    sha256 = "sha256",
+    sha384 = "sha384",
+    sha512 = "sha512",
+  }
+
+  local iv_lengths = { cbc = 16, ecb = 0, ctr = 16, gcm = 12 }
+
+  function _M.cipher(size, mode)
+    size = size or 128
+    mode = mode or "cbc"
+    if (size ~= 128 and size ~= 192 and size ~= 256) or not iv_lengths[mode] then
+      return nil
+    end
+    return { size = size, cipher = mode, method = "aes-" .. size .. "-" .. mode }
+  end
+
+  -- new(key, salt, cipher, hash, hash_rounds, iv_len, enable_padding)
+  -- hash is either a digest from _M.hash used to derive the key and IV from
+  -- key and salt, or a table { iv = ..., method = ... } giving the IV (and
+  -- optionally a function that turns key into the raw key) directly.
+  function _M.new(self, key, salt, cipher, hash, hash_rounds, iv_len, enable_padding)
+    cipher = cipher or _M.cipher()
+    hash = hash or _M.hash.md5
+    hash_rounds = hash_rounds or 1
+    local key_len = cipher.size / 8
+    iv_len = iv_len or key_len
+    if enable_padding == nil then
+      enable_padding = true
+    end
+
+    local gen_key, gen_iv
+    if type(hash) == "table" then
+      if not hash.iv then
+        return nil, "iv is needed"
+      end
+      if #hash.iv > iv_len then
+        return nil, "bad iv length"
+      end
+      if hash.method then
+        gen_key = hash.method(key)
+      else
+        gen_key = key
+      end
+      if #gen_key ~= key_len then
+        return nil, "bad key length"
+      end
+      gen_iv = hash.iv
+    else
+      if salt and #salt ~= 8 then
+        return nil, "salt must be 8 characters or nil"
+      end
+      gen_key, gen_iv = crypto.bytes_to_key(hash, key, salt, hash_rounds, key_len, iv_lengths[cipher.cipher])
+      if not gen_key then
+        return nil, gen_iv
+      end
+    end
+
+    -- Like OpenSSL, zero fill a short IV. GCM uses an iv_len byte IV.
+    local mode_iv_len = cipher.cipher == "gcm" and iv_len or iv_lengths[cipher.cipher]
+    gen_iv = (gen_iv .. string.rep("\0", mode_iv_len)):sub(1, mode_iv_len)
+
+    return setmetatable({
+      _mode = cipher.cipher,
+      _key = gen_key,
+      _iv = gen_iv,
+      _padding = enable_padding,
+    }, mt)
+  end
+
+  -- encrypt returns the ciphertext, and the authentication tag for gcm
+  function _M.encrypt(self, s)
+    local out, tag = crypto.aes_encrypt(self._mode, self._key, self._iv, s, self._padding)
+    if not out then
+      return nil, "EVP_EncryptFinal_ex failed"
+    end
+    return out, tag
+  end
+
+  function _M.decrypt(self, s, tag)
+    if self._mode == "gcm" and not tag then
+      return nil, "no tag"
+    end
+    local out = crypto.aes_decrypt(self._mode, self._key, self._iv, s, tag, self._padding)
+    if not out then
+      return nil, "EVP_DecryptFinal_ex failed"
+    end
+    return out
+  end
+
+  return _M
+end
+
+-- resty.lock: locks live in a process-wide Go table, so they are shared by
+-- every Lua state in the process. The dictionary name only namespaces keys.
+preload["resty.lock"] = function()
+  local lock = golapis.lock
+  local _M = { _VERSION = "0.09" }
+  local mt = { __index = _M }
+
+  function _M.new(_, dict_name, opts)
+    if type(dict_name) ~= "string" then
+      return nil, "dictionary not found"
+    end
+    opts = opts or {}
+    return setmetatable({
+      dict_name = dict_name,
+      exptime = opts.exptime or 30,
+      timeout = opts.timeout or 5,
+      step = opts.step or 0.001,
+      ratio = opts.ratio or 2,
+      max_step = opts.max_step or 0.5,
+    }, mt)
+  end
+
+  -- lock returns the seconds spent waiting, or nil and "timeout" or "locked"
+  function _M.lock(self, key)
+    if key == nil then
+      return nil, "nil key"
+    end
+    if self.key then
+      return nil, "locked"
+    end
+    local full_key = self.dict_name .. "\0" .. tostring(key)
+    local token, elapsed = lock.acquire(full_key, self.exptime, self.timeout,
+      self.step, self.ratio, self.max_step)
+    if not token then
+      return nil, elapsed
+    end
+    self.key, self.token = full_key, token
+    return elapsed
+  end
+
+  function _M.unlock(self)
+    local key, token = self.key, self.token
+    if not key then
+      return nil, "unlocked"
+    end
+    self.key, self.token = nil, nil
+    local ok, err = lock.release(key, token)
+    if not ok then
+      return nil, err
+    end
+    return 1
+  end
+
+  function _M.expire(self, time)
+    if not self.key then
+      return nil, "unlocked"
+    end
+    return lock.expire(self.key, self.token, time or self.exptime)
+  end
+
+  return _M
+end
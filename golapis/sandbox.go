@@ -0,0 +1,199 @@
+package golapis
+
+/*
+#include "lua_helpers.h"
+
+static int load_chunk(lua_State *L, const char *code, size_t len, const char *chunkname) {
+    return luaL_loadbuffer(L, code, len, chunkname);
+}
+*/
+import "C"
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+)
+
+//go:embed sandbox.lua
+var sandboxLua string
+
+// DefaultSandboxMaxStringRep is the default limit on string.rep results
+const DefaultSandboxMaxStringRep = 1 << 20
+
+// ErrNoSandbox is returned when loading sandboxed code into a state created
+// without Options.Sandbox
+var ErrNoSandbox = errors.New("state has no sandbox (see Options.Sandbox)")
+
+// SandboxConfig is the sandbox profile for running untrusted Lua code. Code
+// loaded with SandboxedEntryPoint or EvalSandboxed runs in its own
+// environment table holding only safe functions: the base functions that
+// can't load code or reach other environments, string (without dump), table,
+// math, bit, coroutine and, when the os library is open, os.clock, date,
+// difftime and time. golapis is a read-only view, except for status, ctx,
+// var and header. Other code in the state keeps full access.
+//
+// Bytecode can't be loaded, and the ffi, debug, jit, io and os modules can't
+// be required even if listed in Modules. Tables from required modules are
+// read-only views. Since strings share one metatable, string.rep results are
+// limited for all code in the state, and dump can't be called as a string
+// method, as in ("").dump(f), by any code.
+//
+// The sandbox doesn't limit memory. Options.MemoryLimit bounds table growth,
+// but it covers the whole state: untrusted code that reaches it makes trusted
+// code in the same state fail with "not enough memory" too. Run untrusted
+// code in its own state with a MemoryLimit to keep it from affecting trusted
+// handlers.
+type SandboxConfig struct {
+	Modules      []string // modules sandboxed code may require, e.g. "cjson"
+	MaxStringRep int      // max length of a string.rep result (0 = DefaultSandboxMaxStringRep)
+	AllowNetwork bool     // expose golapis.socket, golapis.http and golapis.location
+}
+
+// setupSandbox runs sandbox.lua and stores the environment constructor it
+// returns in the registry
+func (gls *GolapisLuaState) setupSandbox(config *SandboxConfig) error {
+	L := gls.luaState
+	if err := gls.loadChunk(sandboxLua, "=sandbox.lua"); err != nil {
+		return err
+	}
+
+	C.lua_rawgeti_wrapper(L, C.LUA_REGISTRYINDEX, gls.golapisRef)
+	C.lua_createtable(L, C.int(len(config.Modules)), 0)
+	for i, name := range config.Modules {
+		pushGoString(L, name)
+		C.lua_rawseti(L, -2, C.int(i+1))
+	}
+	maxRep := config.MaxStringRep
+	if maxRep <= 0 {
+		maxRep = DefaultSandboxMaxStringRep
+	}
+	C.lua_pushinteger(L, C.lua_Integer(maxRep))
+	if config.AllowNetwork {
+		C.lua_pushboolean(L, 1)
+	} else {
+		C.lua_pushboolean(L, 0)
+	}
+
+	if C.lua_pcall(L, 4, 1, 0) != 0 {
+		errMsg := C.GoString(C.lua_tostring_wrapper(L, -1))
+		C.lua_pop_wrapper(L, 1)
+		return fmt.Errorf("failed to set up sandbox: %s", errMsg)
+	}
+	gls.sandboxRef = C.luaL_ref_wrapper(L, C.LUA_REGISTRYINDEX)
+	return nil
+}
+
+// loadChunk loads code with the given chunk name onto the stack
+func (gls *GolapisLuaState) loadChunk(code, chunkname string) error {
+	ccode := C.CString(code)
+	defer C.free(unsafe.Pointer(ccode))
+	cname := C.CString(chunkname)
+	defer C.free(unsafe.Pointer(cname))
+
+	if C.load_chunk(gls.luaState, ccode, C.size_t(len(code)), cname) != 0 {
+		errMsg := C.GoString(C.lua_tostring_wrapper(gls.luaState, -1))
+		C.lua_pop_wrapper(gls.luaState, 1)
+		return newLuaSyntaxError(errMsg)
+	}
+	return nil
+}
+
+// loadSandboxed loads untrusted source code onto the stack and gives the
+// function a new sandbox environment
+func (gls *GolapisLuaState) loadSandboxed(code, chunkname string) error {
+	if gls.sandboxRef == 0 {
+		return ErrNoSandbox
+	}
+	if strings.HasPrefix(code, "\x1b") {
+		return errors.New("bytecode can't be loaded in the sandbox")
+	}
+	if err := gls.loadChunk(code, chunkname); err != nil {
+		return err
+	}
+	return gls.setSandboxEnv()
+}
+
+// setSandboxEnv sets a new sandbox environment on the function on top of the stack
+func (gls *GolapisLuaState) setSandboxEnv() error {
+	L := gls.luaState
+	C.lua_rawgeti_wrapper(L, C.LUA_REGISTRYINDEX, gls.sandboxRef)
+	if C.lua_pcall(L, 0, 1, 0) != 0 {
+		errMsg := C.GoString(C.lua_tostring_wrapper(L, -1))
+		C.lua_pop_wrapper(L, 2)
+		return fmt.Errorf("failed to create sandbox environment: %s", errMsg)
+	}
+	C.lua_setfenv(L, -2)
+	return nil
+}
+
+// SandboxedEntryPoint loads Entry, a FileEntryPoint or CodeEntryPoint, as
+// untrusted code that runs in a sandbox environment (see SandboxConfig). The
+// environment is created once, so globals set by the code are kept across
+// runs. The state must be created with Options.Sandbox.
+type SandboxedEntryPoint struct {
+	Entry EntryPoint
+}
+
+func (s SandboxedEntryPoint) load(gls *GolapisLuaState) error {
+	switch entry := s.Entry.(type) {
+	case FileEntryPoint:
+		if strings.HasSuffix(entry.Filename, ".moon") {
+			if gls.sandboxRef == 0 {
+				return ErrNoSandbox
+			}
+			// Compiled from source, so it can't be bytecode
+			if err := gls.loadMoonFile(entry.Filename); err != nil {
+				return err
+			}
+			if err := gls.setSandboxEnv(); err != nil {
+				return err
+			}
+			break
+		}
+		data, err := os.ReadFile(entry.Filename)
+		if err != nil {
+			return err
+		}
+		code := string(data)
+		if strings.HasPrefix(code, "#") {
+			// Skip a shebang line like luaL_loadfile, keeping line numbers
+			if i := strings.IndexByte(code, '\n'); i >= 0 {
+				code = code[i:]
+			} else {
+				code = ""
+			}
+		}
+		if err := gls.loadSandboxed(code, "@"+entry.Filename); err != nil {
+			return err
+		}
+	case CodeEntryPoint:
+		if err := gls.loadSandboxed(entry.Code, entry.Code); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("cannot sandbox entry point %s", s.Entry)
+	}
+	gls.storeEntryPoint()
+	return nil
+}
+
+func (s SandboxedEntryPoint) String() string {
+	return "sandboxed " + s.Entry.String()
+}
+
+// EvalSandboxed runs code like Eval in a new sandbox environment (see
+// SandboxConfig). The state must be created with Options.Sandbox.
+func (gls *GolapisLuaState) EvalSandboxed(ctx context.Context, code string) ([]interface{}, error) {
+	return gls.runForResults(ctx, &StateEvent{
+		Type:          EventRunString,
+		Code:          code,
+		Sandboxed:     true,
+		Context:       ctx,
+		ReturnResults: true,
+		Response:      make(chan *StateResponse, 1),
+	})
+}
@@ -0,0 +1,206 @@
+-- sandbox.lua
+-- Called once when a state is created with Options.Sandbox, with full access.
+-- Returns a function that creates a new environment table for untrusted code.
+local golapis, allowed_modules, max_string_rep, allow_network = ...
+
+local error, type, tostring, tonumber = error, type, tostring, tonumber
+local getmetatable, setmetatable, rawget = getmetatable, setmetatable, rawget
+local require, pairs, ipairs = require, pairs, ipairs
+
+-- string.rep is limited for all code: strings share one metatable, so
+-- ("x"):rep(n) reaches the real string table from inside the sandbox
+do
+  local rep = string.rep
+  function string.rep(s, n, sep)
+    n = tonumber(n) or 0
+    if n > 0 then
+      local size = #tostring(s) * n
+      if sep ~= nil then
+        size = size + #tostring(sep) * (n - 1)
+      end
+      if size > max_string_rep then
+        error("string.rep result too large", 2)
+      end
+    end
+    return rep(s, n, sep)
+  end
+end
+
+-- Strings share one metatable, whose __index is the string table, so
+-- ("").dump would reach string.dump. String methods get a table without
+-- dump instead; trusted code can still call string.dump directly.
+do
+  local methods = setmetatable({
+    dump = function()
+      error("string.dump is not available as a string method", 2)
+    end,
+  }, { __index = string })
+  getmetatable("").__index = methods
+end
+
+-- Modules that are never available to sandboxed code
+local blocked_modules = { ffi = true, debug = true, jit = true, io = true, os = true }
+
+-- Read-only views of tables shared with trusted code, cached per table. Each
+-- view refers back to its table, so values are weak too: without ephemerons a
+-- weak-keyed entry would keep its key alive forever.
+local views = setmetatable({}, { __mode = "kv" })
+
+local function readonly(t)
+  if type(t) ~= "table" then
+    return t
+  end
+  local view = views[t]
+  if view == nil then
+    view = setmetatable({}, {
+      __index = function(_, k)
+        return readonly(t[k])
+      end,
+      __newindex = function(_, k)
+        error("attempt to modify read-only table (field '" .. tostring(k) .. "')", 2)
+      end,
+      __call = function(_, ...)
+        return t(...)
+      end,
+      __metatable = false,
+    })
+    views[t] = view
+  end
+  return view
+end
+
+-- golapis fields that are hidden, or passed through instead of read-only
+local hidden_golapis = { debug = true }
+if not allow_network then
+  hidden_golapis.socket = true
+  hidden_golapis.http = true
+  hidden_golapis.location = true
+end
+local writable_golapis = { status = true, ctx = true }
+local passthrough_golapis = { var = true, header = true, ctx = true, status = true }
+
+local golapis_view = setmetatable({}, {
+  __index = function(_, k)
+    if hidden_golapis[k] then
+      return nil
+    end
+    if passthrough_golapis[k] then
+      return golapis[k]
+    end
+    return readonly(golapis[k])
+  end,
+  __newindex = function(_, k, v)
+    if not writable_golapis[k] then
+      error("attempt to modify read-only table (field '" .. tostring(k) .. "')", 2)
+    end
+    golapis[k] = v
+  end,
+  __metatable = false,
+})
+
+-- Metatables set by sandboxed code; only these can be read or replaced
+local owned_metatables = setmetatable({}, { __mode = "k" })
+
+local function sandbox_getmetatable(v)
+  local mt = getmetatable(v)
+  if mt ~= nil and owned_metatables[mt] then
+    return mt
+  end
+  return nil
+end
+
+local function sandbox_setmetatable(t, mt)
+  if type(t) ~= "table" then
+    error("bad argument #1 to 'setmetatable' (table expected, got " .. type(t) .. ")", 2)
+  end
+  local current = getmetatable(t)
+  if current ~= nil and not owned_metatables[current] then
+    error("cannot change a protected metatable", 2)
+  end
+  if mt ~= nil then
+    if type(mt) ~= "table" then
+      error("bad argument #2 to 'setmetatable' (nil or table expected)", 2)
+    end
+    owned_metatables[mt] = true
+  end
+  return setmetatable(t, mt)
+end
+
+local allowed = {}
+for _, name in ipairs(allowed_modules) do
+  if not blocked_modules[name] then
+    allowed[name] = true
+  end
+end
+
+local function sandbox_require(name)
+  if type(name) ~= "string" or not allowed[name] then
+    error("module '" .. tostring(name) .. "' is not allowed in the sandbox", 2)
+  end
+  return readonly(require(name))
+end
+
+local safe_globals = {
+  "assert", "error", "ipairs", "next", "pairs", "pcall", "rawequal", "select",
+  "tonumber", "tostring", "type", "unpack", "xpcall", "_VERSION",
+}
+
+local safe_libs = {
+  string = {
+    "byte", "char", "find", "format", "gmatch", "gsub", "len", "lower",
+    "match", "rep", "reverse", "sub", "upper",
+  },
+  table = { "concat", "insert", "maxn", "remove", "sort" },
+  math = {
+    "abs", "acos", "asin", "atan", "atan2", "ceil", "cos", "cosh", "deg",
+    "exp", "floor", "fmod", "frexp", "huge", "ldexp", "log", "log10", "max",
+    "min", "modf", "pi", "pow", "rad", "random", "sin", "sinh", "sqrt", "tan",
+    "tanh",
+  },
+  bit = {
+    "arshift", "band", "bnot", "bor", "bswap", "bxor", "lshift", "rol", "ror",
+    "rshift", "tobit", "tohex",
+  },
+  coroutine = { "create", "resume", "running", "status", "wrap", "yield" },
+  os = { "clock", "date", "difftime", "time" },
+}
+
+-- Captured now so later changes to the globals don't reach the sandbox
+local base = {}
+for _, name in ipairs(safe_globals) do
+  base[name] = _G[name]
+end
+local libs = {}
+for lib, names in pairs(safe_libs) do
+  local source = _G[lib]
+  if type(source) == "table" then
+    local copy = {}
+    for _, name in ipairs(names) do
+      copy[name] = source[name]
+    end
+    libs[lib] = copy
+  end
+end
+
+return function()
+  local env = {}
+  for name, value in pairs(base) do
+    env[name] = value
+  end
+  for lib, funcs in pairs(libs) do
+    local copy = {}
+    for name, value in pairs(funcs) do
+      copy[name] = value
+    end
+    env[lib] = copy
+  end
+  env.getmetatable = sandbox_getmetatable
+  env.setmetatable = sandbox_setmetatable
+  env.require = sandbox_require
+  env.golapis = golapis_view
+  if rawget(_G, "ngx") == golapis then
+    env.ngx = golapis_view
+  end
+  env._G = env
+  return env
+end
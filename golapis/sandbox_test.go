@@ -0,0 +1,207 @@
+package golapis
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newSandboxState(t *testing.T, config *SandboxConfig) *GolapisLuaState {
+	t.Helper()
+	opts := DefaultOptions()
+	opts.Sandbox = config
+	gls, _ := newOptionsState(t, opts)
+	return gls
+}
+
+func TestSandboxEscapesClosed(t *testing.T) {
+	gls := newSandboxState(t, &SandboxConfig{Modules: []string{"cjson", "ffi"}})
+
+	escapes := []struct {
+		name string
+		code string
+	}{
+		{"io", `return io.open("/etc/passwd")`},
+		{"os.execute", `return os.execute("true")`},
+		{"os.getenv", `return os.getenv("HOME")`},
+		{"load", `return load("return 1")`},
+		{"loadstring", `return loadstring("return 1")`},
+		{"loadfile", `return loadfile("/etc/passwd")`},
+		{"dofile", `return dofile("/etc/passwd")`},
+		{"debug", `return debug.getregistry()`},
+		{"getfenv", `return getfenv(0)`},
+		{"setfenv", `return setfenv(1, {})`},
+		{"rawset", `return rawset(golapis, "say", nil)`},
+		{"collectgarbage", `return collectgarbage("stop")`},
+		{"newproxy", `return newproxy(true)`},
+		{"module", `return module("x")`},
+		{"string.dump", `return string.dump(function() end)`},
+		{"string.dump method", `return ("").dump(function() end)`},
+		{"require ffi", `return require("ffi")`},
+		{"require os", `return require("os")`},
+		{"require from disk", `return require("some_module_on_disk")`},
+		{"package", `return package.loaded`},
+		{"jit", `return jit.off()`},
+		{"string metatable", `return getmetatable("").__index`},
+		{"golapis metatable", `return getmetatable(golapis).__index`},
+		{"protected metatable", `setmetatable(golapis.var, {})`},
+		{"modify golapis", `golapis.say = nil`},
+		{"modify golapis subtable", `golapis.req.get_headers = nil`},
+		{"modify module", `require("cjson").encode = nil`},
+		{"golapis.debug", `return golapis.debug.cancel_timers()`},
+		{"golapis.socket", `return golapis.socket.tcp()`},
+		{"string.rep", `return #string.rep("x", 2 * 1024 * 1024)`},
+		{"string.rep method", `return #("x"):rep(1024 * 1024, ",")`},
+	}
+	for _, tt := range escapes {
+		if _, err := gls.EvalSandboxed(context.Background(), tt.code); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestSandboxAllowed(t *testing.T) {
+	gls := newSandboxState(t, &SandboxConfig{Modules: []string{"cjson"}})
+
+	results, err := gls.EvalSandboxed(context.Background(), `
+		local cjson = require("cjson")
+		local mt = { __index = function(_, k) return k .. "!" end }
+		local obj = setmetatable({}, mt)
+		local ok = pcall(error, "caught")
+		return cjson.encode({ a = 1 }), obj.hi, getmetatable(obj) == mt,
+			string.upper("x"), #string.rep("ab", 3, ","), math.max(1, 2), ok
+	`)
+	if err != nil {
+		t.Fatalf("EvalSandboxed: %v", err)
+	}
+	expected := []interface{}{`{"a":1}`, "hi!", true, "X", int64(8), int64(2), false}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected %#v, got %#v", expected, results)
+	}
+}
+
+func TestSandboxIsolatedFromTrustedCode(t *testing.T) {
+	gls := newSandboxState(t, &SandboxConfig{})
+
+	_, err := gls.EvalSandboxed(context.Background(), `
+		leaked = true
+		string.upper = nil
+		_G.print = nil
+	`)
+	if err != nil {
+		t.Fatalf("EvalSandboxed: %v", err)
+	}
+
+	// Trusted code keeps its globals and full library access
+	results, err := gls.Eval(context.Background(), `
+		return leaked, string.upper("x"), type(print), type(io.open), type(require("ffi"))
+	`)
+	if err != nil {
+		t.Fatalf("Eval: %v", err)
+	}
+	expected := []interface{}{nil, "X", "function", "function", "table"}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected %#v, got %#v", expected, results)
+	}
+
+	// Each EvalSandboxed gets a new environment
+	results, err = gls.EvalSandboxed(context.Background(), `return leaked, string.upper("y")`)
+	if err != nil {
+		t.Fatalf("EvalSandboxed: %v", err)
+	}
+	if !reflect.DeepEqual(results, []interface{}{nil, "Y"}) {
+		t.Errorf("unexpected results %#v", results)
+	}
+}
+
+func TestSandboxRejectsBytecode(t *testing.T) {
+	gls := newSandboxState(t, &SandboxConfig{})
+
+	results, err := gls.Eval(context.Background(), `return string.dump(function() return 1 end)`)
+	if err != nil {
+		t.Fatalf("Eval: %v", err)
+	}
+	bytecode := results[0].(string)
+
+	if _, err := gls.EvalSandboxed(context.Background(), bytecode); err == nil || !strings.Contains(err.Error(), "bytecode") {
+		t.Errorf("expected bytecode error, got %v", err)
+	}
+	if err := gls.LoadEntryPoint(SandboxedEntryPoint{CodeEntryPoint{Code: bytecode}}); err == nil {
+		t.Error("expected bytecode entry point to be rejected")
+	}
+}
+
+func TestSandboxTableGrowth(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Sandbox = &SandboxConfig{}
+	opts.MemoryLimit = 8 << 20
+	gls, _ := newOptionsState(t, opts)
+
+	_, err := gls.EvalSandboxed(context.Background(), `
+		local t = {}
+		for i = 1, 1e8 do t[i] = i end
+	`)
+	if err == nil || !strings.Contains(err.Error(), "not enough memory") {
+		t.Errorf("expected out of memory error, got %v", err)
+	}
+}
+
+func TestSandboxedEntryPoint(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Sandbox = &SandboxConfig{}
+	gls, buf := newOptionsState(t, opts)
+
+	err := gls.LoadEntryPoint(SandboxedEntryPoint{CodeEntryPoint{Code: `
+		runs = (runs or 0) + 1
+		golapis.say(runs, " ", type(io))
+	`}})
+	if err != nil {
+		t.Fatalf("LoadEntryPoint: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := gls.RunEntryPoint(); err != nil {
+			t.Fatalf("RunEntryPoint: %v", err)
+		}
+	}
+	if output := buf.String(); output != "1 nil\n2 nil\n" {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func TestSandboxRequiresOption(t *testing.T) {
+	gls, _ := newOptionsState(t, DefaultOptions())
+	if _, err := gls.EvalSandboxed(context.Background(), `return 1`); !errors.Is(err, ErrNoSandbox) {
+		t.Errorf("expected ErrNoSandbox, got %v", err)
+	}
+}
+
+func TestSandboxViewsCollected(t *testing.T) {
+	gls := newSandboxState(t, &SandboxConfig{})
+
+	if _, err := gls.Eval(context.Background(), `
+		probe = setmetatable({}, { __mode = "k" })
+		golapis.shared = { x = 1 }
+		probe[golapis.shared] = true
+	`); err != nil {
+		t.Fatalf("Eval: %v", err)
+	}
+	if _, err := gls.EvalSandboxed(context.Background(), `return golapis.shared.x`); err != nil {
+		t.Fatalf("EvalSandboxed: %v", err)
+	}
+
+	// Once trusted code drops the table, its cached view doesn't keep it alive
+	results, err := gls.Eval(context.Background(), `
+		golapis.shared = nil
+		collectgarbage()
+		collectgarbage()
+		return next(probe) == nil
+	`)
+	if err != nil {
+		t.Fatalf("Eval: %v", err)
+	}
+	if !reflect.DeepEqual(results, []interface{}{true}) {
+		t.Errorf("expected the shared table to be collected, got %#v", results)
+	}
+}
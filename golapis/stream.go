@@ -0,0 +1,458 @@
+package golapis
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// StreamServerConfig holds configuration for the stream (raw TCP) and UDP servers
+type StreamServerConfig struct {
+	NgxAlias        bool          // alias golapis table to global ngx
+	ShutdownTimeout time.Duration // max graceful shutdown wait before sessions are closed
+}
+
+// DefaultStreamServerConfig returns the default stream server configuration.
+func DefaultStreamServerConfig() *StreamServerConfig {
+	return &StreamServerConfig{
+		ShutdownTimeout: DefaultShutdownTimeout,
+	}
+}
+
+func normalizeStreamServerConfig(config *StreamServerConfig) *StreamServerConfig {
+	if config == nil {
+		return DefaultStreamServerConfig()
+	}
+
+	normalized := *config
+	if normalized.ShutdownTimeout == 0 {
+		normalized.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	return &normalized
+}
+
+// errNoMoreData is returned when reading past the single datagram of a UDP session
+var errNoMoreData = errors.New("no more data")
+
+// StreamRequest holds the state of a single stream session: one downstream
+// connection in TCP mode, or one datagram in UDP mode
+type StreamRequest struct {
+	Conn        net.Conn  // The downstream connection (datagram reply conn for UDP)
+	Protocol    string    // "TCP" or "UDP"
+	localAddr   net.Addr  // Local (server) address of the session
+	remoteAddr  net.Addr  // Remote (client) address of the session
+	startTime   time.Time // When the session was accepted
+	socketTaken bool      // True after golapis.req.socket() returned the downstream socket
+}
+
+// NewStreamRequest creates a new StreamRequest for an accepted connection
+func NewStreamRequest(conn net.Conn) *StreamRequest {
+	return &StreamRequest{
+		Conn:       conn,
+		Protocol:   "TCP",
+		localAddr:  conn.LocalAddr(),
+		remoteAddr: conn.RemoteAddr(),
+		startTime:  time.Now(),
+	}
+}
+
+// NewUDPStreamRequest creates a new StreamRequest for a datagram received on pc
+// from peer. Writes to the session's Conn are sent back to peer as datagrams.
+func NewUDPStreamRequest(pc net.PacketConn, peer net.Addr, data []byte) *StreamRequest {
+	conn := &udpDatagramConn{pc: pc, peer: peer, data: data}
+	return &StreamRequest{
+		Conn:       conn,
+		Protocol:   "UDP",
+		localAddr:  pc.LocalAddr(),
+		remoteAddr: peer,
+		startTime:  time.Now(),
+	}
+}
+
+// StartTime returns the timestamp when the session was accepted
+func (r *StreamRequest) StartTime() time.Time {
+	return r.startTime
+}
+
+// LocalAddr returns the local (server side) address of the session
+func (r *StreamRequest) LocalAddr() net.Addr {
+	return r.localAddr
+}
+
+// RemoteAddr returns the remote (client side) address of the session
+func (r *StreamRequest) RemoteAddr() net.Addr {
+	return r.remoteAddr
+}
+
+// ServeStreamConn runs the loaded entry point for a single downstream connection.
+// Anything written with golapis.say/print goes to the connection, and
+// golapis.req.socket() returns a cosocket bound to it. The connection is closed
+// once the entry point (including any yielded work) completes.
+func (gls *GolapisLuaState) ServeStreamConn(conn net.Conn) error {
+	defer conn.Close()
+
+	req := NewStreamRequest(conn)
+	resp := make(chan *StateResponse, 1)
+	gls.eventChan <- &StateEvent{
+		Type:          EventRunEntryPoint,
+		OutputWriter:  conn,
+		StreamRequest: req,
+		Response:      resp,
+	}
+
+	result := <-resp
+	return result.Error
+}
+
+// ServePacket runs the loaded entry point for a single datagram received on pc
+// from peer. golapis.req.socket() returns a UDP cosocket whose receive returns
+// the datagram and whose send replies to peer; golapis.say/print output is also
+// sent to peer, one datagram per call.
+func (gls *GolapisLuaState) ServePacket(pc net.PacketConn, peer net.Addr, data []byte) error {
+	req := NewUDPStreamRequest(pc, peer, data)
+	defer req.Conn.Close()
+
+	resp := make(chan *StateResponse, 1)
+	gls.eventChan <- &StateEvent{
+		Type:          EventRunEntryPoint,
+		OutputWriter:  req.Conn,
+		StreamRequest: req,
+		Response:      resp,
+	}
+
+	result := <-resp
+	return result.Error
+}
+
+// udpDatagramConn adapts one received datagram to net.Conn. Reads return the
+// datagram once; writes are sent back to the peer over the shared listener.
+type udpDatagramConn struct {
+	pc   net.PacketConn
+	peer net.Addr
+
+	mu     sync.Mutex
+	data   []byte
+	read   bool
+	closed bool
+}
+
+func (c *udpDatagramConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if c.read {
+		return 0, errNoMoreData
+	}
+	c.read = true
+	// Like a datagram socket, excess bytes beyond len(b) are discarded
+	return copy(b, c.data), nil
+}
+
+func (c *udpDatagramConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	return c.pc.WriteTo(b, c.peer)
+}
+
+// Close ends the session; the shared listener stays open.
+func (c *udpDatagramConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *udpDatagramConn) LocalAddr() net.Addr  { return c.pc.LocalAddr() }
+func (c *udpDatagramConn) RemoteAddr() net.Addr { return c.peer }
+
+// Deadlines are no-ops: reads never block and the listener is shared
+func (c *udpDatagramConn) SetDeadline(t time.Time) error      { return nil }
+func (c *udpDatagramConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *udpDatagramConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// streamListenAddr converts a listen spec into a network and address.
+// Accepts a bare port ("1234"), a host:port pair, or "unix:/path/to.sock".
+// For datagram listeners the network is "udp" or "unixgram".
+func streamListenAddr(listen string, datagram bool) (network, address string) {
+	network = "tcp"
+	if datagram {
+		network = "udp"
+	}
+	if strings.HasPrefix(listen, "unix:") {
+		if datagram {
+			return "unixgram", strings.TrimPrefix(listen, "unix:")
+		}
+		return "unix", strings.TrimPrefix(listen, "unix:")
+	}
+	if !strings.Contains(listen, ":") {
+		return network, ":" + listen
+	}
+	return network, listen
+}
+
+// newStreamLuaState creates, loads and starts the shared Lua state for a
+// stream or UDP server, exiting the process on failure.
+func newStreamLuaState(entry EntryPoint, config *StreamServerConfig) *GolapisLuaState {
+	// Create single shared Lua state at server startup
+	lua := NewGolapisLuaState()
+	if lua == nil {
+		log.Fatal("Failed to create Lua state")
+	}
+
+	if config.NgxAlias {
+		lua.SetupNgxAlias()
+	}
+
+	// Load the entrypoint at startup
+	if err := lua.LoadEntryPoint(entry); err != nil {
+		lua.Close()
+		log.Fatalf("Failed to load Lua script %s: %v", entry, err)
+	}
+
+	// Start the event loop (runs for lifetime of server)
+	lua.Start()
+	return lua
+}
+
+// notifyStreamShutdown calls stop once on SIGINT/SIGTERM and returns a channel
+// that is closed when shutdown has started.
+func notifyStreamShutdown(stop func()) <-chan struct{} {
+	shutdownStarted := make(chan struct{})
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		signal.Stop(c)
+		close(shutdownStarted)
+		fmt.Println("\nShutting down gracefully...")
+		stop()
+	}()
+	return shutdownStarted
+}
+
+// waitStreamSessions waits for active sessions to finish. If they are still
+// running after timeout, forceClose is called and the wait continues.
+func waitStreamSessions(wg *sync.WaitGroup, timeout time.Duration, forceClose func()) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		forceClose()
+		<-done
+	}
+}
+
+// StartStreamServer starts a raw TCP (or unix socket) server that executes the
+// given Lua script for each accepted connection.
+// Uses a single shared GolapisLuaState for all sessions with cooperative scheduling
+func StartStreamServer(entry EntryPoint, listen string, config *StreamServerConfig) {
+	network, address := streamListenAddr(listen, false)
+	fmt.Printf("Starting stream server on %s with script: %s\n", listen, entry)
+	config = normalizeStreamServerConfig(config)
+
+	lua := newStreamLuaState(entry, config)
+	defer lua.Close()
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if network == "unix" {
+		defer os.Remove(address)
+	}
+
+	var sessionWg sync.WaitGroup
+	var connsMu sync.Mutex
+	conns := make(map[net.Conn]struct{})
+
+	shutdownStarted := notifyStreamShutdown(func() { ln.Close() })
+
+	fmt.Printf("Listening on %s:%s\n", network, address)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			log.Fatal(err)
+		}
+
+		connsMu.Lock()
+		conns[conn] = struct{}{}
+		connsMu.Unlock()
+
+		sessionWg.Add(1)
+		go func() {
+			defer sessionWg.Done()
+			defer func() {
+				connsMu.Lock()
+				delete(conns, conn)
+				connsMu.Unlock()
+			}()
+			if err := lua.ServeStreamConn(conn); err != nil {
+				log.Printf("stream session %s error: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+
+	select {
+	case <-shutdownStarted:
+		// Give active sessions time to finish, then force-close their
+		// connections so pending socket operations fail and threads unwind.
+		waitStreamSessions(&sessionWg, config.ShutdownTimeout, func() {
+			connsMu.Lock()
+			for conn := range conns {
+				conn.Close()
+			}
+			connsMu.Unlock()
+		})
+		lua.Wait()
+	default:
+	}
+	lua.Stop()
+}
+
+// StartUDPServer starts a UDP (or unix datagram) server that executes the given
+// Lua script once for each received datagram.
+// Uses a single shared GolapisLuaState for all datagrams with cooperative scheduling
+func StartUDPServer(entry EntryPoint, listen string, config *StreamServerConfig) {
+	network, address := streamListenAddr(listen, true)
+	fmt.Printf("Starting UDP server on %s with script: %s\n", listen, entry)
+	config = normalizeStreamServerConfig(config)
+
+	lua := newStreamLuaState(entry, config)
+	defer lua.Close()
+
+	pc, err := net.ListenPacket(network, address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer pc.Close()
+	if network == "unixgram" {
+		defer os.Remove(address)
+	}
+
+	var sessionWg sync.WaitGroup
+
+	// Unblock ReadFrom on shutdown but keep the socket open so in-flight
+	// sessions can still send their replies.
+	shutdownStarted := notifyStreamShutdown(func() { pc.SetReadDeadline(time.Now()) })
+
+	fmt.Printf("Listening on %s:%s\n", network, address)
+	buf := make([]byte, 65536)
+	for {
+		n, peer, err := pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-shutdownStarted:
+			default:
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					continue
+				}
+				log.Fatal(err)
+			}
+			break
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		sessionWg.Add(1)
+		go func() {
+			defer sessionWg.Done()
+			if err := lua.ServePacket(pc, peer, data); err != nil {
+				log.Printf("udp session %s error: %v", peer, err)
+			}
+		}()
+	}
+
+	select {
+	case <-shutdownStarted:
+		waitStreamSessions(&sessionWg, config.ShutdownTimeout, func() { pc.Close() })
+		lua.Wait()
+	default:
+	}
+	lua.Stop()
+}
+
+// resolveStreamVar resolves an nginx stream-style variable name for a session.
+// Returns nil if the variable is not set or not applicable.
+func resolveStreamVar(req *StreamRequest, key string) *string {
+	var result string
+
+	switch key {
+	case "remote_addr", "remote_port", "binary_remote_addr":
+		host, port := streamAddrParts(req.RemoteAddr())
+		switch key {
+		case "remote_addr":
+			result = host
+		case "remote_port":
+			if port == "" {
+				return nil
+			}
+			result = port
+		case "binary_remote_addr":
+			value, ok := binaryIP(host)
+			if !ok {
+				return nil
+			}
+			result = value
+		}
+	case "server_addr":
+		host, _ := streamAddrParts(req.LocalAddr())
+		result = host
+	case "server_port":
+		_, port := streamAddrParts(req.LocalAddr())
+		if port == "" {
+			return nil
+		}
+		result = port
+	case "protocol":
+		result = req.Protocol
+	case "session_time":
+		result = strconv.FormatFloat(time.Since(req.startTime).Seconds(), 'f', 3, 64)
+	default:
+		return nil
+	}
+
+	return &result
+}
+
+// streamAddrParts splits a session address into host and port.
+// Unix socket addresses are reported as "unix:" with no port, matching nginx.
+func streamAddrParts(addr net.Addr) (host, port string) {
+	if addr == nil {
+		return "", ""
+	}
+	if addr.Network() == "unix" || addr.Network() == "unixgram" {
+		return "unix:", ""
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String(), ""
+	}
+	return host, port
+}
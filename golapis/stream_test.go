@@ -0,0 +1,334 @@
+package golapis
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runStreamSession loads code as the entry point, serves one TCP connection
+// with it, and runs client against the other end of that connection.
+func runStreamSession(t *testing.T, code string, client func(conn net.Conn)) error {
+	t.Helper()
+
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+
+	if err := gls.LoadEntryPoint(CodeEntryPoint{Code: code}); err != nil {
+		t.Fatalf("Failed to load entry point: %v", err)
+	}
+
+	gls.Start()
+	defer gls.Stop()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- gls.ServeStreamConn(conn)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	client(conn)
+
+	select {
+	case err := <-errCh:
+		gls.Wait()
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream session did not finish")
+		return nil
+	}
+}
+
+func TestStreamEchoLines(t *testing.T) {
+	var replies []string
+	err := runStreamSession(t, `
+		local sock = assert(golapis.req.socket())
+		while true do
+			local line, err = sock:receive()
+			if not line then break end
+			sock:send("echo: " .. line .. "\n")
+		end
+	`, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for _, msg := range []string{"hello", "world"} {
+			conn.Write([]byte(msg + "\r\n"))
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Errorf("read failed: %v", err)
+				return
+			}
+			replies = append(replies, line)
+		}
+		conn.(*net.TCPConn).CloseWrite()
+	})
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+
+	expected := []string{"echo: hello\n", "echo: world\n"}
+	if len(replies) != len(expected) {
+		t.Fatalf("expected %d replies, got %v", len(expected), replies)
+	}
+	for i := range expected {
+		if replies[i] != expected[i] {
+			t.Errorf("reply %d: expected %q, got %q", i, expected[i], replies[i])
+		}
+	}
+}
+
+func TestStreamReceiveSizeAndSay(t *testing.T) {
+	var output string
+	err := runStreamSession(t, `
+		local sock = assert(golapis.req.socket())
+		local data, err = sock:receive(5)
+		golapis.say("got ", data)
+	`, func(conn net.Conn) {
+		conn.Write([]byte("abcdefgh"))
+		out, _ := io.ReadAll(conn)
+		output = string(out)
+	})
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	if output != "got abcde\n" {
+		t.Errorf("expected %q, got %q", "got abcde\n", output)
+	}
+}
+
+func TestStreamReceiveTimeout(t *testing.T) {
+	var output string
+	err := runStreamSession(t, `
+		local sock = assert(golapis.req.socket())
+		sock:settimeout(50)
+		local data, err = sock:receiveany(10)
+		golapis.say(tostring(data), " ", err)
+	`, func(conn net.Conn) {
+		out, _ := io.ReadAll(conn)
+		output = string(out)
+	})
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	if output != "nil timeout\n" {
+		t.Errorf("expected %q, got %q", "nil timeout\n", output)
+	}
+}
+
+func TestStreamSocketRestrictions(t *testing.T) {
+	var output string
+	err := runStreamSession(t, `
+		local sock = assert(golapis.req.socket())
+		local again, err = golapis.req.socket()
+		golapis.say("dup: ", tostring(again), " ", err)
+		local ok, err = sock:connect("127.0.0.1", 1)
+		golapis.say("connect: ", tostring(ok), " ", err)
+		ok, err = sock:setkeepalive()
+		golapis.say("keepalive: ", tostring(ok), " ", err)
+	`, func(conn net.Conn) {
+		out, _ := io.ReadAll(conn)
+		output = string(out)
+	})
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+
+	for _, want := range []string{
+		"dup: nil duplicate call",
+		"connect: nil not supported for downstream sockets",
+		"keepalive: nil not supported for downstream sockets",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected output to contain %q, got %q", want, output)
+		}
+	}
+}
+
+func TestStreamVars(t *testing.T) {
+	var output string
+	var clientAddr string
+	err := runStreamSession(t, `
+		golapis.say(golapis.var.remote_addr, ":", golapis.var.remote_port)
+		golapis.say(golapis.var.server_addr)
+		golapis.say(golapis.var.protocol)
+		golapis.say(#golapis.var.binary_remote_addr)
+		golapis.say(tostring(golapis.var.request_uri))
+	`, func(conn net.Conn) {
+		clientAddr = conn.LocalAddr().String()
+		out, _ := io.ReadAll(conn)
+		output = string(out)
+	})
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+
+	expected := clientAddr + "\n127.0.0.1\nTCP\n4\nnil\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestStreamExit(t *testing.T) {
+	var output string
+	err := runStreamSession(t, `
+		golapis.say("before")
+		golapis.exit(0)
+		golapis.say("after")
+	`, func(conn net.Conn) {
+		out, _ := io.ReadAll(conn)
+		output = string(out)
+	})
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	if output != "before\n" {
+		t.Errorf("expected %q, got %q", "before\n", output)
+	}
+}
+
+// runUDPSession loads code as the entry point, sends payload to a UDP listener
+// served by it, and returns every reply datagram received before the session ends.
+func runUDPSession(t *testing.T, code string, payload string) ([]string, error) {
+	t.Helper()
+
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+
+	if err := gls.LoadEntryPoint(CodeEntryPoint{Code: code}); err != nil {
+		t.Fatalf("Failed to load entry point: %v", err)
+	}
+
+	gls.Start()
+	defer gls.Stop()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer pc.Close()
+
+	client, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte(payload)); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+
+	buf := make([]byte, 65536)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, peer, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Failed to read datagram: %v", err)
+	}
+
+	sessionErr := gls.ServePacket(pc, peer, append([]byte(nil), buf[:n]...))
+	gls.Wait()
+
+	var replies []string
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	for {
+		n, err := client.Read(buf)
+		if err != nil {
+			break
+		}
+		replies = append(replies, string(buf[:n]))
+	}
+	return replies, sessionErr
+}
+
+func TestUDPSessionReply(t *testing.T) {
+	replies, err := runUDPSession(t, `
+		local sock = assert(golapis.req.socket())
+		local data = assert(sock:receive())
+		assert(sock:send("pong: " .. data))
+		local more, err = sock:receive()
+		assert(more == nil)
+		sock:send(err)
+	`, "ping")
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+
+	expected := []string{"pong: ping", "no more data"}
+	if len(replies) != len(expected) {
+		t.Fatalf("expected %d replies, got %q", len(expected), replies)
+	}
+	for i := range expected {
+		if replies[i] != expected[i] {
+			t.Errorf("reply %d: expected %q, got %q", i, expected[i], replies[i])
+		}
+	}
+}
+
+func TestUDPSessionVarsAndSay(t *testing.T) {
+	replies, err := runUDPSession(t, `
+		golapis.print(golapis.var.protocol)
+		golapis.print(golapis.var.remote_addr, " ", tostring(golapis.var.remote_port ~= nil))
+		local sock = assert(golapis.req.socket())
+		local ok, err = sock:setpeername("127.0.0.1", 53)
+		golapis.print(tostring(ok), " ", err)
+	`, "x")
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+
+	expected := []string{"UDP", "127.0.0.1 true", "nil not supported for downstream sockets"}
+	if len(replies) != len(expected) {
+		t.Fatalf("expected %d replies, got %q", len(expected), replies)
+	}
+	for i := range expected {
+		if replies[i] != expected[i] {
+			t.Errorf("reply %d: expected %q, got %q", i, expected[i], replies[i])
+		}
+	}
+}
+
+func TestStreamListenAddr(t *testing.T) {
+	tests := []struct {
+		listen   string
+		datagram bool
+		network  string
+		address  string
+	}{
+		{"8080", false, "tcp", ":8080"},
+		{"127.0.0.1:9000", false, "tcp", "127.0.0.1:9000"},
+		{"unix:/tmp/golapis.sock", false, "unix", "/tmp/golapis.sock"},
+		{"5353", true, "udp", ":5353"},
+		{"unix:/tmp/golapis.sock", true, "unixgram", "/tmp/golapis.sock"},
+	}
+	for _, tt := range tests {
+		network, address := streamListenAddr(tt.listen, tt.datagram)
+		if network != tt.network || address != tt.address {
+			t.Errorf("streamListenAddr(%q, %v) = %q, %q; want %q, %q",
+				tt.listen, tt.datagram, network, address, tt.network, tt.address)
+		}
+	}
+}
@@ -29,6 +29,7 @@ type TCPSocket struct {
 	connected      bool          // true after successful connect
 	closed         bool          // true after close() called
 	isUnix         bool          // true for unix:/ domain sockets
+	downstream     bool          // bound to the downstream connection (golapis.req.socket)
 	gen            uint64        // increments to invalidate in-flight async operations
 	ownerThread    *LuaThread    // thread context that created this socket (for request affinity)
 
@@ -161,15 +162,8 @@ func consumeLineFromBuffer(sock *TCPSocket) (string, bool) {
 // Exported Functions (called from C wrappers)
 // =============================================================================
 
-//export golapis_socket_tcp_new
-func golapis_socket_tcp_new(L *C.lua_State) C.int {
-	thread := getLuaThreadFromRegistry(L)
-	sock := &TCPSocket{
-		connectTimeout: 0,
-		readTimeout:    0,
-		writeTimeout:   0,
-		ownerThread:    thread,
-	}
+// pushTCPSocket registers sock and pushes a userdata handle for it onto L's stack.
+func pushTCPSocket(L *C.lua_State, sock *TCPSocket) uint64 {
 	id := registerTCPSocket(sock)
 
 	// Create userdata containing the socket ID
@@ -179,6 +173,19 @@ func golapis_socket_tcp_new(L *C.lua_State) C.int {
 	// Apply the TCP socket metatable
 	C.luaL_getmetatable_wrapper(L, cStrTCPMetatable)
 	C.lua_setmetatable(L, -2)
+	return id
+}
+
+//export golapis_socket_tcp_new
+func golapis_socket_tcp_new(L *C.lua_State) C.int {
+	thread := getLuaThreadFromRegistry(L)
+	sock := &TCPSocket{
+		connectTimeout: 0,
+		readTimeout:    0,
+		writeTimeout:   0,
+		ownerThread:    thread,
+	}
+	id := pushTCPSocket(L, sock)
 
 	if debugEnabled {
 		debugLog("tcp.new: id=%d co=%p", id, L)
@@ -254,6 +261,12 @@ func golapis_tcp_connect(L *C.lua_State) C.int {
 		return 2
 	}
 
+	if sock.downstream {
+		C.lua_pushnil(L)
+		pushGoString(L, "not supported for downstream sockets")
+		return 2
+	}
+
 	if !checkTCPSocketBusy(L, sock, true, true, true) {
 		return 2
 	}
@@ -338,16 +351,16 @@ func golapis_tcp_connect(L *C.lua_State) C.int {
 			debugLog("tcp.connect: id=%d unix=%s timeout=%v", sockID, path, timeout)
 		}
 		sock.connecting = true
+		// Aborting the thread cancels the connect
+		ctx := thread.context()
 		go func() {
-			var conn net.Conn
-			var err error
-
+			dialer := &net.Dialer{}
 			if timeout > 0 {
-				conn, err = net.DialTimeout("unix", path, timeout)
-			} else {
-				conn, err = net.Dial("unix", path)
+				dialer.Timeout = timeout
 			}
 
+			conn, err := dialer.DialContext(ctx, "unix", path)
+
 			if err != nil {
 				if debugEnabled {
 					debugLog("tcp.connect: id=%d unix=%s error=%s", sockID, path, normalizeNetError(err))
@@ -439,16 +452,15 @@ func golapis_tcp_connect(L *C.lua_State) C.int {
 		debugLog("tcp.connect: id=%d addr=%s timeout=%v", sockID, addr, timeout)
 	}
 	sock.connecting = true
+	// Aborting the thread cancels the connect
+	ctx := thread.context()
 	go func() {
-		var conn net.Conn
-		var err error
-
 		dialer := &net.Dialer{}
 		if timeout > 0 {
 			dialer.Timeout = timeout
 		}
 
-		conn, err = dialer.Dial("tcp", addr)
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
 
 		if err != nil {
 			if debugEnabled {
@@ -1089,6 +1101,31 @@ func golapis_tcp_close(L *C.lua_State) C.int {
 	return 1
 }
 
+// closeThreadTCPSockets closes the sockets owned by an aborted thread,
+// interrupting any operation in progress. The downstream socket is left to
+// the server.
+func closeThreadTCPSockets(thread *LuaThread) {
+	tcpSocketMu.Lock()
+	defer tcpSocketMu.Unlock()
+	for id, sock := range tcpSocketMap {
+		if sock.ownerThread != thread || sock.closed || sock.downstream {
+			continue
+		}
+		if debugEnabled {
+			debugLog("tcp.abort: id=%d", id)
+		}
+		if sock.conn != nil {
+			sock.conn.Close()
+		}
+		sock.conn = nil
+		sock.closed = true
+		sock.connected = false
+		sock.readBuf = nil
+		sock.readBufPos = 0
+		sock.gen++
+	}
+}
+
 //export golapis_tcp_setkeepalive
 func golapis_tcp_setkeepalive(L *C.lua_State) C.int {
 	sock, sockID := getTCPSocketFromUserdata(L, 1)
@@ -1113,6 +1150,12 @@ func golapis_tcp_setkeepalive(L *C.lua_State) C.int {
 		return 2
 	}
 
+	if sock.downstream {
+		C.lua_pushnil(L)
+		pushGoString(L, "not supported for downstream sockets")
+		return 2
+	}
+
 	if !checkTCPSocketBusy(L, sock, true, true, true) {
 		return 2
 	}
@@ -1246,7 +1289,9 @@ func golapis_tcp_gc(L *C.lua_State) C.int {
 		if debugEnabled {
 			debugLog("tcp.gc: id=%d closed=%v connected=%v", id, sock.closed, sock.connected)
 		}
-		if !sock.closed && sock.conn != nil {
+		// The downstream connection is owned by the server and is closed
+		// when the session ends, not when its socket object is collected.
+		if !sock.closed && sock.conn != nil && !sock.downstream {
 			sock.conn.Close()
 		}
 		sock.conn = nil
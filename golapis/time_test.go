@@ -244,3 +244,82 @@ func TestNowVsTime(t *testing.T) {
 		t.Errorf("now() and time() should be related, got: %q", output)
 	}
 }
+
+func TestCookieTime(t *testing.T) {
+	output, err := runLuaAndCapture(t, `
+		golapis.say(golapis.cookie_time(1290079655))
+		golapis.say(golapis.cookie_time(2208988800))
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+	expected := "Thu, 18-Nov-10 11:27:35 GMT\nSat, 01-Jan-2040 00:00:00 GMT\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestHTTPTime(t *testing.T) {
+	output, err := runLuaAndCapture(t, `
+		golapis.say(golapis.http_time(1290079655))
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+	if output != "Thu, 18 Nov 2010 11:27:35 GMT\n" {
+		t.Errorf("unexpected output: %q", output)
+	}
+}
+
+func TestParseHTTPTime(t *testing.T) {
+	output, err := runLuaAndCapture(t, `
+		golapis.say(golapis.parse_http_time("Thu, 18 Nov 2010 11:27:35 GMT"))
+		golapis.say(golapis.parse_http_time("Thursday, 18-Nov-10 11:27:35 GMT"))
+		golapis.say(golapis.parse_http_time("Thu Nov 18 11:27:35 2010"))
+		golapis.say(tostring(golapis.parse_http_time("not a date")))
+		golapis.say(golapis.parse_http_time(golapis.http_time(1700000000)))
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+	expected := "1290079655\n1290079655\n1290079655\nnil\n1700000000\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestTimeFormatArgumentErrors(t *testing.T) {
+	_, err := runLuaAndCapture(t, `golapis.cookie_time("abc")`)
+	if err == nil || !strings.Contains(err.Error(), "number argument only") {
+		t.Errorf("expected number argument error, got %v", err)
+	}
+	_, err = runLuaAndCapture(t, `golapis.http_time()`)
+	if err == nil || !strings.Contains(err.Error(), "expecting one argument") {
+		t.Errorf("expected argument count error, got %v", err)
+	}
+}
+
+func TestUTCTimeAndLocalTime(t *testing.T) {
+	output, err := runLuaAndCapture(t, `
+		golapis.say(golapis.utctime())
+		golapis.say(golapis.localtime())
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected output: %q", output)
+	}
+	utc, err := time.Parse("2006-01-02 15:04:05", lines[0])
+	if err != nil {
+		t.Fatalf("failed to parse utctime %q: %v", lines[0], err)
+	}
+	if diff := time.Since(utc); diff < -2*time.Second || diff > 2*time.Second {
+		t.Errorf("utctime too far from now: %v", diff)
+	}
+	if _, err := time.ParseInLocation("2006-01-02 15:04:05", lines[1], time.Local); err != nil {
+		t.Errorf("failed to parse localtime %q: %v", lines[1], err)
+	}
+}
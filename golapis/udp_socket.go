@@ -52,6 +52,7 @@ type UDPSocket struct {
 	connected   bool          // true after successful setpeername
 	closed      bool          // true after close() called
 	isUnix      bool          // true for unix:/ domain sockets
+	downstream  bool          // bound to the downstream peer (golapis.req.socket in UDP mode)
 	gen         uint64        // increments to invalidate in-flight async operations
 	ownerThread *LuaThread    // thread context that created this socket (for request affinity)
 }
@@ -177,13 +178,8 @@ func appendLuaValue(L *C.lua_State, idx C.int, buf *[]byte, strict bool) (bool,
 // Exported Functions (called from C wrappers)
 // =============================================================================
 
-//export golapis_socket_udp_new
-func golapis_socket_udp_new(L *C.lua_State) C.int {
-	thread := getLuaThreadFromRegistry(L)
-	sock := &UDPSocket{
-		timeout:     0,
-		ownerThread: thread,
-	}
+// pushUDPSocket registers sock and pushes a userdata handle for it onto L's stack.
+func pushUDPSocket(L *C.lua_State, sock *UDPSocket) uint64 {
 	id := registerUDPSocket(sock)
 
 	// Create userdata containing the socket ID
@@ -193,6 +189,17 @@ func golapis_socket_udp_new(L *C.lua_State) C.int {
 	// Apply the UDP socket metatable
 	C.luaL_getmetatable_wrapper(L, cStrUDPMetatable)
 	C.lua_setmetatable(L, -2)
+	return id
+}
+
+//export golapis_socket_udp_new
+func golapis_socket_udp_new(L *C.lua_State) C.int {
+	thread := getLuaThreadFromRegistry(L)
+	sock := &UDPSocket{
+		timeout:     0,
+		ownerThread: thread,
+	}
+	pushUDPSocket(L, sock)
 
 	return 1
 }
@@ -228,6 +235,12 @@ func golapis_udp_bind(L *C.lua_State) C.int {
 		return 2
 	}
 
+	if sock.downstream {
+		C.lua_pushnil(L)
+		pushGoString(L, "not supported for downstream sockets")
+		return 2
+	}
+
 	if C.lua_gettop(L) < 2 || C.lua_isstring(L, 2) == 0 {
 		C.lua_pushnil(L)
 		pushGoString(L, "bind requires an address argument")
@@ -265,6 +278,12 @@ func golapis_udp_setpeername(L *C.lua_State) C.int {
 		return 2
 	}
 
+	if sock.downstream {
+		C.lua_pushnil(L)
+		pushGoString(L, "not supported for downstream sockets")
+		return 2
+	}
+
 	if sock.connected && sock.conn != nil {
 		sock.conn.Close()
 		sock.conn = nil
@@ -359,6 +378,7 @@ func golapis_udp_setpeername(L *C.lua_State) C.int {
 	// Capture values for goroutine (read-only in goroutine)
 	localAddrStr := sock.localAddr
 	gen := sock.gen
+	ctx := thread.context()
 
 	go func() {
 		var localAddr net.Addr
@@ -367,7 +387,7 @@ func golapis_udp_setpeername(L *C.lua_State) C.int {
 		}
 
 		dialer := &net.Dialer{LocalAddr: localAddr}
-		conn, err := dialer.Dial("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		conn, err := dialer.DialContext(ctx, "udp", net.JoinHostPort(host, strconv.Itoa(port)))
 		if err != nil {
 			thread.state.eventChan <- &StateEvent{
 				Type:         EventResumeThread,
@@ -557,6 +577,25 @@ func golapis_udp_close(L *C.lua_State) C.int {
 	return 1
 }
 
+// closeThreadUDPSockets closes the sockets owned by an aborted thread,
+// interrupting any operation in progress
+func closeThreadUDPSockets(thread *LuaThread) {
+	udpSocketMu.Lock()
+	defer udpSocketMu.Unlock()
+	for _, sock := range udpSocketMap {
+		if sock.ownerThread != thread || sock.closed || sock.downstream {
+			continue
+		}
+		if sock.conn != nil {
+			sock.conn.Close()
+		}
+		sock.conn = nil
+		sock.closed = true
+		sock.connected = false
+		sock.gen++
+	}
+}
+
 //export golapis_udp_gc
 func golapis_udp_gc(L *C.lua_State) C.int {
 	sock, id := getUDPSocketFromUserdata(L, 1)
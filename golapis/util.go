@@ -179,3 +179,33 @@ func parseQueryString(rawQuery string, maxArgs int) ([]queryArg, bool) {
 
 	return result, truncated
 }
+
+// quoteSQLStr quotes a string as a MySQL string literal, like ngx.quote_sql_str
+func quoteSQLStr(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s) + 2)
+	sb.WriteByte('\'')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case 0:
+			sb.WriteString(`\0`)
+		case '\b':
+			sb.WriteString(`\b`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case 0x1a:
+			sb.WriteString(`\Z`)
+		case '\\', '\'', '"':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('\'')
+	return sb.String()
+}
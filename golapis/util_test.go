@@ -358,3 +358,25 @@ func TestUnescapeURI(t *testing.T) {
 		})
 	}
 }
+
+func TestQuoteSQLStr(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{name: "empty string", input: "", expected: `''`},
+		{name: "plain", input: "hello", expected: `'hello'`},
+		{name: "quotes", input: `it's "here"`, expected: `'it\'s \"here\"'`},
+		{name: "backslash", input: `a\b`, expected: `'a\\b'`},
+		{name: "control characters", input: "\x00\b\n\r\t\x1a", expected: `'\0\b\n\r\t\Z'`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quoteSQLStr(tt.input); got != tt.expected {
+				t.Errorf("quoteSQLStr(%q) = %q, want %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package golapis
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runLuaWithRequest runs code in the HTTP request context of r
+func runLuaWithRequest(t *testing.T, r *http.Request, code string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+
+	gls.Start()
+	defer gls.Stop()
+
+	w := httptest.NewRecorder()
+	req := NewGolapisRequest(r)
+	wrappedWriter := req.WrapResponseWriter(w)
+
+	resp := make(chan *StateResponse, 1)
+	gls.eventChan <- &StateEvent{
+		Type:         EventRunString,
+		Code:         code,
+		OutputWriter: wrappedWriter,
+		Request:      req,
+		Response:     resp,
+	}
+
+	result := <-resp
+	gls.Wait()
+	req.FlushHeaders(w)
+
+	return w, result.Error
+}
+
+func TestVarCookie(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Add("Cookie", "session=abc%20123; theme=dark")
+	r.Header.Add("Cookie", "Theme=light; empty=")
+
+	w, err := runLuaWithRequest(t, r, `
+		golapis.say(golapis.var.cookie_session)
+		golapis.say(golapis.var.cookie_theme)
+		golapis.say(golapis.var.cookie_THEME)
+		golapis.say("[", golapis.var.cookie_empty, "]")
+		golapis.say(tostring(golapis.var.cookie_missing))
+	`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "abc%20123\ndark\ndark\n[]\nnil\n"
+	if w.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, w.Body.String())
+	}
+}
+
+func TestVarArg(t *testing.T) {
+	r := httptest.NewRequest("GET", "/search?q=hello+world&Page=2&page=3&flag&empty=", nil)
+
+	w, err := runLuaWithRequest(t, r, `
+		golapis.say(golapis.var.arg_q)
+		golapis.say(golapis.var.arg_page)
+		golapis.say(tostring(golapis.var.arg_flag))
+		golapis.say("[", golapis.var.arg_empty, "]")
+		golapis.say(tostring(golapis.var.arg_missing))
+	`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "hello+world\n2\nnil\n[]\nnil\n"
+	if w.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, w.Body.String())
+	}
+}
+
+func TestVarRequestDetails(t *testing.T) {
+	r := httptest.NewRequest("POST", "/a/b%20c?x=1", strings.NewReader("hello"))
+	r.RemoteAddr = "10.1.2.3:45678"
+	r.Header.Set("Content-Type", "text/plain")
+	r.Header.Set("Content-Length", "5")
+
+	w, err := runLuaWithRequest(t, r, `
+		golapis.say(golapis.var.uri)
+		golapis.say(golapis.var.document_uri)
+		golapis.say(golapis.var.server_protocol)
+		golapis.say(golapis.var.remote_port)
+		golapis.say(#golapis.var.binary_remote_addr)
+		golapis.say(golapis.var.content_type)
+		golapis.say(golapis.var.content_length)
+		golapis.say(tonumber(golapis.var.request_length) > 5)
+		golapis.say(tostring(golapis.var.connection))
+	`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "/a/b c\n/a/b c\nHTTP/1.1\n45678\n4\ntext/plain\n5\ntrue\nnil\n"
+	if w.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, w.Body.String())
+	}
+}
+
+func TestVarResponseAccounting(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+
+	w, err := runLuaWithRequest(t, r, `
+		local before = golapis.var.status
+		golapis.status = 201
+		golapis.print("hello")
+		golapis.print(" ", before, " ", golapis.var.status, " ", golapis.var.body_bytes_sent)
+		golapis.print(" ", tonumber(golapis.var.bytes_sent) > tonumber(golapis.var.body_bytes_sent))
+	`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "hello 000 201 5 true"
+	if w.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, w.Body.String())
+	}
+}
+
+func TestVarBodyBytesSentMatchesAccessLog(t *testing.T) {
+	logs := captureLog(t)
+
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+	err := gls.LoadEntryPoint(CodeEntryPoint{Code: `
+		golapis.print("hello world")
+		golapis.ctx.sent = golapis.var.body_bytes_sent
+		golapis.print(" ", golapis.ctx.sent)
+	`})
+	if err != nil {
+		t.Fatalf("Failed to load entry point: %v", err)
+	}
+	gls.Start()
+	defer gls.Stop()
+
+	handler := logHTTPRequestsWithFormat(gls.HTTPHandler(nil), "sent=$body_bytes_sent", false, nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	gls.Wait()
+
+	// The access log counts the same writes, including the ones after the read
+	if w.Body.String() != "hello world 11" {
+		t.Errorf("unexpected body %q", w.Body.String())
+	}
+	if !strings.Contains(logs.String(), "sent=14") {
+		t.Errorf("expected access log to count 14 bytes, got %q", logs.String())
+	}
+}
+
+func TestVarTimesAndRequestID(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+
+	w, err := runLuaWithRequest(t, r, `
+		local id = golapis.var.request_id
+		golapis.say(#id, " ", id == golapis.var.request_id, " ", id:match("^[0-9a-f]+$") ~= nil)
+		golapis.say(golapis.var.request_time:match("^%d+%.%d%d%d$") ~= nil)
+		golapis.say(golapis.var.msec:match("^%d+%.%d%d%d$") ~= nil)
+		golapis.say(golapis.var.time_local:match("^%d%d/%a%a%a/%d%d%d%d:%d%d:%d%d:%d%d [+-]%d%d%d%d$") ~= nil)
+		golapis.say(golapis.var.time_iso8601:match("^%d%d%d%d%-%d%d%-%d%dT%d%d:%d%d:%d%d[+-]%d%d:%d%d$") ~= nil)
+	`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "32 true true\ntrue\ntrue\ntrue\ntrue\n"
+	if w.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, w.Body.String())
+	}
+}
+
+func TestVarServerAndConnection(t *testing.T) {
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+
+	err := gls.LoadEntryPoint(CodeEntryPoint{Code: `
+		golapis.print(golapis.var.server_addr, " ", golapis.var.server_name, " ",
+			golapis.var.connection, " ", golapis.var.connection_requests)
+	`})
+	if err != nil {
+		t.Fatalf("Failed to load entry point: %v", err)
+	}
+
+	gls.Start()
+	defer gls.Stop()
+
+	config := DefaultHTTPServerConfig()
+	config.ServerName = "example.com"
+	server := httptest.NewUnstartedServer(gls.HTTPHandler(config))
+	server.Config.ConnContext = HTTPConnContext
+	server.Start()
+	defer server.Close()
+
+	// Both requests reuse the same keep-alive connection
+	client := server.Client()
+	var bodies []string
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		bodies = append(bodies, string(body))
+	}
+
+	first := strings.Fields(bodies[0])
+	second := strings.Fields(bodies[1])
+	if len(first) != 4 || len(second) != 4 {
+		t.Fatalf("unexpected output: %q", bodies)
+	}
+	if first[0] != "127.0.0.1" || first[1] != "example.com" {
+		t.Errorf("unexpected server vars: %q", bodies[0])
+	}
+	if first[2] != second[2] {
+		t.Errorf("expected same connection id, got %q and %q", first[2], second[2])
+	}
+	if first[3] != "1" || second[3] != "2" {
+		t.Errorf("expected connection_requests 1 and 2, got %q and %q", first[3], second[3])
+	}
+}
+
+func TestVarAssignArgsAndURI(t *testing.T) {
+	r := httptest.NewRequest("GET", "/old/path?a=1", nil)
+
+	w, err := runLuaWithRequest(t, r, `
+		golapis.var.args = "b=2&c=3"
+		golapis.say(golapis.var.args, " ", golapis.var.arg_b, " ", tostring(golapis.var.arg_a))
+		golapis.var.uri = "/new/path"
+		golapis.say(golapis.var.uri)
+		local ok, err = pcall(function() golapis.var.request_method = "POST" end)
+		golapis.say(tostring(ok))
+		ok, err = pcall(function() golapis.var.args = {} end)
+		golapis.say(tostring(ok))
+	`)
+	if err != nil {
+		t.Fatalf("Lua error: %v", err)
+	}
+
+	expected := "b=2&c=3 2 nil\n/new/path\nfalse\nfalse\n"
+	if w.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, w.Body.String())
+	}
+}
+
+// runLuaHandlerWithVars serves a request to uri through HTTPHandler with the
+// given user-defined variables, routing location.capture through the same mux
+func runLuaHandlerWithVars(t *testing.T, uri string, code string, vars map[string]string) string {
+	t.Helper()
+
+	gls := NewGolapisLuaState()
+	if gls == nil {
+		t.Fatal("Failed to create Lua state")
+	}
+	defer gls.Close()
+
+	if err := gls.LoadEntryPoint(CodeEntryPoint{Code: code}); err != nil {
+		t.Fatalf("Failed to load entry point: %v", err)
+	}
+
+	gls.Start()
+	defer gls.Stop()
+
+	config := DefaultHTTPServerConfig()
+	config.Variables = vars
+	mux := http.NewServeMux()
+	mux.Handle("/", gls.HTTPHandler(config))
+	gls.httpMux = mux
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", uri, nil))
+	gls.Wait()
+
+	return w.Body.String()
+}
+
+func TestVarUserDefined(t *testing.T) {
+	body := runLuaHandlerWithVars(t, "/", `
+		golapis.say(golapis.var.user, " ", golapis.var.empty == "")
+		golapis.var.user = "bob"
+		golapis.var.count = 5
+		golapis.say(golapis.var.user, " ", golapis.var.count)
+		golapis.var.user = nil
+		golapis.say(tostring(golapis.var.user))
+		local ok, err = pcall(function() golapis.var.undeclared = "x" end)
+		golapis.say(tostring(ok), " ", err)
+	`, map[string]string{"user": "anonymous", "empty": "", "count": "0"})
+
+	for _, want := range []string{
+		"anonymous true\n",
+		"bob 5\n",
+		"nil\n",
+		`false variable "undeclared" not found for writing`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected output to contain %q, got %q", want, body)
+		}
+	}
+}
+
+func TestVarUserDefinedPerRequest(t *testing.T) {
+	vars := map[string]string{"user": "anonymous"}
+	code := `
+		golapis.say(golapis.var.user)
+		golapis.var.user = "changed"
+	`
+	for i := 0; i < 2; i++ {
+		if body := runLuaHandlerWithVars(t, "/", code, vars); body != "anonymous\n" {
+			t.Errorf("request %d: expected %q, got %q", i, "anonymous\n", body)
+		}
+	}
+	if vars["user"] != "anonymous" {
+		t.Errorf("config defaults were modified: %q", vars["user"])
+	}
+}
+
+func TestVarCaptureInheritance(t *testing.T) {
+	code := `
+		if golapis.var.uri == "/inner" then
+			golapis.print(golapis.var.user, ",", golapis.var.extra)
+			golapis.var.user = "inner"
+			return
+		end
+		golapis.var.user = "outer"
+		local copy = golapis.location.capture("/inner", { copy_all_vars = true, vars = { extra = 1 } })
+		golapis.say("copy: ", copy.body, " parent: ", golapis.var.user)
+		local share = golapis.location.capture("/inner", { share_all_vars = true })
+		golapis.say("share: ", share.body, " parent: ", golapis.var.user)
+		local plain = golapis.location.capture("/inner")
+		golapis.say("plain: ", plain.body)
+	`
+	body := runLuaHandlerWithVars(t, "/outer", code, map[string]string{"user": "default", "extra": "-"})
+
+	expected := "copy: outer,1 parent: outer\nshare: outer,- parent: inner\nplain: default,-\n"
+	if body != expected {
+		t.Errorf("expected %q, got %q", expected, body)
+	}
+}
+
+func TestFormatAccessLog(t *testing.T) {
+	r := httptest.NewRequest("GET", "/path?q=1", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("User-Agent", "test-agent")
+
+	req := NewGolapisRequest(r)
+	req.vars = newRequestVars(map[string]string{"user": "alice", "empty": ""})
+
+	line := formatAccessLog(`$remote_addr "$request" $status $body_bytes_sent "${http_user_agent}" $user $empty $missing $`,
+		r, req, time.Now(), 201, 42, false)
+
+	expected := `10.0.0.1 "GET /path?q=1 HTTP/1.1" 201 42 "test-agent" alice - - $`
+	if line != expected {
+		t.Errorf("expected %q, got %q", expected, line)
+	}
+}
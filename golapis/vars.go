@@ -0,0 +1,279 @@
+package golapis
+
+/*
+#include "lua_helpers.h"
+*/
+import "C"
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// writableVars lists predefined variables that can be assigned through golapis.var
+var writableVars = map[string]bool{
+	"args": true,
+	"uri":  true,
+}
+
+// subrequestVarsKey is the context key carrying a parent request's variables
+// into a location.capture subrequest routed through the HTTP mux
+type subrequestVarsKey struct{}
+
+// subrequestVars describes how a subrequest inherits its parent's variables
+type subrequestVars struct {
+	vars   map[string]*string // parent's user-defined variables
+	shared bool               // true: share the parent's map (share_all_vars), false: copy it
+	set    map[string]string  // explicit values from the capture "vars" option
+}
+
+// newRequestVars creates the user-defined variable table for a request from
+// the declared defaults in the server config
+func newRequestVars(defaults map[string]string) map[string]*string {
+	vars := make(map[string]*string, len(defaults))
+	for name, value := range defaults {
+		v := value
+		vars[name] = &v
+	}
+	return vars
+}
+
+// copyRequestVars returns a copy of a variable table
+func copyRequestVars(vars map[string]*string) map[string]*string {
+	copied := make(map[string]*string, len(vars))
+	for name, value := range vars {
+		if value != nil {
+			v := *value
+			copied[name] = &v
+		} else {
+			copied[name] = nil
+		}
+	}
+	return copied
+}
+
+// applySubrequestVars sets up a subrequest's variables from its parent
+func (r *GolapisRequest) applySubrequestVars(sv *subrequestVars) {
+	if sv == nil {
+		return
+	}
+	if sv.shared {
+		r.vars = sv.vars
+	} else if sv.vars != nil {
+		for name, value := range copyRequestVars(sv.vars) {
+			r.setVar(name, value)
+		}
+	}
+	for name, value := range sv.set {
+		r.setVar(name, &value)
+	}
+}
+
+// setVar assigns a user-defined variable, declaring it if needed. A nil value
+// leaves the variable declared but unset.
+func (r *GolapisRequest) setVar(name string, value *string) {
+	if r.vars == nil {
+		r.vars = make(map[string]*string)
+	}
+	r.vars[name] = value
+}
+
+// assignVar assigns a variable from Lua, following nginx rules: only writable
+// predefined variables and variables declared in the server config (or set
+// from Go) can be assigned.
+func (r *GolapisRequest) assignVar(name string, value *string) error {
+	if writableVars[name] {
+		newValue := ""
+		if value != nil {
+			newValue = *value
+		}
+		switch name {
+		case "args":
+			r.Request.URL.RawQuery = newValue
+		case "uri":
+			r.Request.URL.Path = newValue
+			r.Request.URL.RawPath = ""
+		}
+		return nil
+	}
+
+	if _, declared := r.vars[name]; !declared {
+		return fmt.Errorf("variable \"%s\" not found for writing; maybe it is a built-in variable that is not changeable or you forgot to use \"set $%s '';\" in the config to define it", name, name)
+	}
+	r.setVar(name, value)
+	return nil
+}
+
+// SetVar declares a user-defined variable for the request, visible to Lua as
+// golapis.var.<name>. It overrides any default from HTTPServerConfig.Variables
+// and can be reassigned from Lua. Call it before the request is handled.
+func (r *GolapisRequest) SetVar(name, value string) {
+	r.setVar(name, &value)
+}
+
+// GetVar returns the value of a request variable: a user-defined variable if
+// declared, otherwise a built-in one such as "request_uri" or "arg_page". The
+// boolean is false if the variable is unset. After the handler has returned it
+// reflects any assignments made from Lua.
+func (r *GolapisRequest) GetVar(name string) (string, bool) {
+	if value, declared := r.vars[name]; declared {
+		if value == nil {
+			return "", false
+		}
+		return *value, true
+	}
+	if value := resolveVar(r, name); value != nil {
+		return *value, true
+	}
+	return "", false
+}
+
+// SetCtx pre-populates golapis.ctx[key] for the request. The value may be nil,
+// a boolean, number, string, []byte, a struct (see Marshal), or a map or slice
+// of those; maps, slices and structs become Lua tables. Call it before the
+// request is handled.
+func (r *GolapisRequest) SetCtx(key string, value any) error {
+	batch := AcquireBatch()
+	defer ReleaseBatch(batch)
+	if err := encodeGoValue(batch, reflect.ValueOf(value), 0); err != nil {
+		return fmt.Errorf("golapis.ctx.%s: %w", key, err)
+	}
+
+	if r.ctxValues == nil {
+		r.ctxValues = make(map[string]any)
+	}
+	r.ctxValues[key] = value
+	return nil
+}
+
+// GetCtx returns golapis.ctx[key] as left by the handler, converted to Go
+// (see luaToGoValue). It is only available for requests created with
+// PrepareRequest, after the handler has returned. Values that can't be
+// converted, such as functions, are omitted.
+func (r *GolapisRequest) GetCtx(key string) (any, bool) {
+	value, ok := r.ctxResult[key]
+	return value, ok
+}
+
+//export golapis_var_newindex
+func golapis_var_newindex(L *C.lua_State) C.int {
+	// Stack: [var_table, key, value]
+	if C.lua_isstring(L, 2) == 0 {
+		pushGoString(L, "variable name must be a string")
+		return -1
+	}
+	name := C.GoString(C.lua_tostring_wrapper(L, 2))
+
+	thread := getLuaThreadFromRegistry(L)
+	if thread != nil && thread.stream != nil {
+		pushGoString(L, fmt.Sprintf("variable \"%s\" not changeable", name))
+		return -1
+	}
+	if thread == nil || thread.request == nil {
+		pushGoString(L, "golapis.var can only be used in HTTP request context")
+		return -1
+	}
+
+	var value *string
+	switch C.lua_type(L, 3) {
+	case C.LUA_TNIL:
+	case C.LUA_TSTRING, C.LUA_TNUMBER:
+		v := string(luaStringBytes(L, 3))
+		value = &v
+	default:
+		typeName := C.GoString(C.lua_typename(L, C.lua_type(L, 3)))
+		pushGoString(L, fmt.Sprintf("bad variable value type: %s (string, number or nil expected)", typeName))
+		return -1
+	}
+
+	if err := thread.request.assignVar(name, value); err != nil {
+		pushGoString(L, err.Error())
+		return -1
+	}
+	return 0
+}
+
+// accessLogKey is the context key for the per-request access log record
+type accessLogKey struct{}
+
+// accessLogRecord lets HTTPHandler hand the GolapisRequest back to the
+// access log middleware so the log format can read request variables
+type accessLogRecord struct {
+	req *GolapisRequest
+}
+
+// withAccessLogRecord attaches an empty access log record to the request context
+func withAccessLogRecord(r *http.Request) (*http.Request, *accessLogRecord) {
+	record := &accessLogRecord{}
+	return r.WithContext(context.WithValue(r.Context(), accessLogKey{}, record)), record
+}
+
+// formatAccessLog interpolates $name and ${name} variables in format.
+// Variables that resolve to nil are logged as "-".
+func formatAccessLog(format string, r *http.Request, req *GolapisRequest, startTime time.Time, status int, bodyBytes int64, trustProxyHeaders bool) string {
+	if req == nil {
+		// Non-Lua routes (e.g. file servers): resolve built-in variables only
+		req = NewGolapisRequest(r)
+		req.startTime = startTime
+	}
+
+	lookup := func(name string) string {
+		switch name {
+		case "status":
+			return strconv.Itoa(status)
+		case "body_bytes_sent":
+			return strconv.FormatInt(bodyBytes, 10)
+		case "remote_addr":
+			return requestRemoteAddr(r, trustProxyHeaders)
+		case "request":
+			return fmt.Sprintf("%s %s %s", r.Method, r.RequestURI, r.Proto)
+		case "time_local":
+			return startTime.Format("02/Jan/2006:15:04:05 -0700")
+		case "request_time":
+			return strconv.FormatFloat(time.Since(startTime).Seconds(), 'f', 3, 64)
+		}
+		if value := resolveVar(req, name); value != nil && *value != "" {
+			return *value
+		}
+		return "-"
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '$' || i+1 >= len(format) {
+			sb.WriteByte(c)
+			continue
+		}
+
+		if format[i+1] == '{' {
+			if end := strings.IndexByte(format[i+2:], '}'); end >= 0 {
+				sb.WriteString(lookup(format[i+2 : i+2+end]))
+				i += end + 2
+				continue
+			}
+			sb.WriteByte(c)
+			continue
+		}
+
+		j := i + 1
+		for j < len(format) && isVarNameChar(format[j]) {
+			j++
+		}
+		if j == i+1 {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteString(lookup(format[i+1 : j]))
+		i = j - 1
+	}
+	return sb.String()
+}
+
+func isVarNameChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
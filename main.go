@@ -29,12 +29,15 @@ var (
 
 func main() {
 	httpFlag := flag.Bool("http", false, "Start as HTTP server")
-	portFlag := flag.String("port", "8080", "Port for HTTP server")
+	streamFlag := flag.Bool("stream", false, "Start as raw TCP stream server")
+	udpFlag := flag.Bool("udp", false, "Start as UDP server (one run per datagram)")
+	portFlag := flag.String("port", "8080", "Port for HTTP or stream server (or unix:/path for stream)")
 	versionFlag := flag.Bool("version", false, "Print version information and exit")
 	vFlag := flag.Bool("v", false, "show version information")
 	eFlag := flag.String("e", "", "execute string 'stat'")
 	lFlag := flag.String("l", "", "require library 'name'")
 	ngxFlag := flag.Bool("ngx", false, "alias golapis table to global ngx")
+	devFlag := flag.Bool("dev", false, "show error pages with tracebacks in HTTP mode")
 	var fileServers fileServerFlags
 	flag.Var(&fileServers, "file-server", "Serve static files: LOCAL_PATH:URL_PREFIX (can be repeated)")
 	flag.Parse()
@@ -60,8 +63,11 @@ func main() {
 		fmt.Fprintln(os.Stderr, "  --       stop handling options")
 		fmt.Fprintln(os.Stderr, "  -        execute stdin and stop handling options")
 		fmt.Fprintln(os.Stderr, "  --http   start HTTP server mode")
-		fmt.Fprintln(os.Stderr, "  --port   port for HTTP server (default 8080)")
+		fmt.Fprintln(os.Stderr, "  --stream start raw TCP stream server mode")
+		fmt.Fprintln(os.Stderr, "  --udp    start UDP server mode")
+		fmt.Fprintln(os.Stderr, "  --port   port for HTTP/stream server (default 8080)")
 		fmt.Fprintln(os.Stderr, "  --ngx    alias golapis table to global ngx")
+		fmt.Fprintln(os.Stderr, "  --dev    show error pages with tracebacks (HTTP mode)")
 		fmt.Fprintln(os.Stderr, "  --file-server PATH[:URL] serve static files (can be repeated)")
 		os.Exit(1)
 	}
@@ -73,17 +79,34 @@ func main() {
 		scriptArgs = args[1:]
 	}
 
-	if *httpFlag {
+	serverModes := 0
+	for _, enabled := range []bool{*httpFlag, *streamFlag, *udpFlag} {
+		if enabled {
+			serverModes++
+		}
+	}
+	if serverModes > 1 {
+		fmt.Fprintln(os.Stderr, "--http, --stream and --udp cannot be used together")
+		os.Exit(1)
+	}
+
+	if serverModes > 0 {
 		var entry golapis.EntryPoint
 		if *eFlag != "" {
 			entry = golapis.CodeEntryPoint{Code: *eFlag}
 		} else if filename != "" {
 			entry = golapis.FileEntryPoint{Filename: filename}
 		} else {
-			fmt.Fprintln(os.Stderr, "HTTP mode requires a script file or -e code")
+			fmt.Fprintln(os.Stderr, "server mode requires a script file or -e code")
 			os.Exit(1)
 		}
-		startHTTPServer(entry, *portFlag, *ngxFlag, fileServers)
+		if *streamFlag {
+			startStreamServer(entry, *portFlag, *ngxFlag)
+		} else if *udpFlag {
+			startUDPServer(entry, *portFlag, *ngxFlag)
+		} else {
+			startHTTPServer(entry, *portFlag, *ngxFlag, *devFlag, fileServers)
+		}
 	} else {
 		runSingleExecution(filename, scriptArgs, *lFlag, *eFlag, *ngxFlag)
 	}
@@ -154,9 +177,14 @@ func runSingleExecution(filename string, scriptArgs []string, requireLib string,
 	lua.Wait()
 }
 
-func startHTTPServer(entry golapis.EntryPoint, port string, ngxAlias bool, fileServers []string) {
+func startHTTPServer(entry golapis.EntryPoint, port string, ngxAlias bool, dev bool, fileServers []string) {
 	config := golapis.DefaultHTTPServerConfig()
 	config.NgxAlias = ngxAlias
+	if dev {
+		config.ErrorHandler = golapis.DevErrorHandler
+	} else {
+		config.ErrorHandler = golapis.ProductionErrorHandler
+	}
 
 	// Parse file server mappings
 	for _, fs := range fileServers {
@@ -181,3 +209,15 @@ func startHTTPServer(entry golapis.EntryPoint, port string, ngxAlias bool, fileS
 
 	golapis.StartHTTPServer(entry, port, config)
 }
+
+func startStreamServer(entry golapis.EntryPoint, listen string, ngxAlias bool) {
+	config := golapis.DefaultStreamServerConfig()
+	config.NgxAlias = ngxAlias
+	golapis.StartStreamServer(entry, listen, config)
+}
+
+func startUDPServer(entry golapis.EntryPoint, listen string, ngxAlias bool) {
+	config := golapis.DefaultStreamServerConfig()
+	config.NgxAlias = ngxAlias
+	golapis.StartUDPServer(entry, listen, config)
+}